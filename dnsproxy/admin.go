@@ -0,0 +1,483 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AdminHandler returns an HTTP handler for the administration API of the
+// proxy, which is to be served on a trusted network only:
+//
+//	GET  /                              dashboard of the stats and routes
+//	GET  /stats                         Stats of the queries
+//	GET  /routes                        routes and default upstreams
+//	POST /routes?route=...              add a route (ParseRoute)
+//	DELETE /routes?domain=example.com.  remove the routes of a domain
+//	GET  /ready                         200 OK if an upstream answered the
+//	                                    last health check, 503 if not
+//	GET  /cache?name=example.com.       responses cached for a name
+//	POST /cache/flush?name=example.com. flush a name, with &subtree=1 its
+//	                                    subdomains too, without name all
+//	GET  /cache/snapshot                responses cached, for a Peer
+//	GET  /config                        Config shared with a Peer
+//	GET  /bans                          clients banned, as JSON
+//	POST /bans?client=10.0.0.7          ban a client, for &for=1h or
+//	                                    BanTime, with &reason=
+//	DELETE /bans?client=10.0.0.7        lift the ban of a client
+//	GET  /faults                        faults injected, one per line
+//	PUT  /faults                        replace the faults with the ones of
+//	                                    the body, one per line (ParseFault)
+//	GET  /debug                         rules of the queries whose
+//	                                    decisions are logged, one per line
+//	PUT  /debug                         replace the rules with the ones of
+//	                                    the body, one per line (ParseRule)
+//	GET  /query?name=example.com.       Trace of a query, with &type=AAAA
+//	                                    its type, A by default, and
+//	                                    &client=10.0.0.1 its client
+//	GET  /tail                          queries answered, as they are, as
+//	                                    server-sent events of QueryLogEntry,
+//	                                    with &client=10.0.0.0/24 those of
+//	                                    clients, &name=*.example.com. of
+//	                                    names and &rcode=NXDOMAIN of rcodes
+//	GET  /history                       queries of the History, the most
+//	                                    recent first, with &client=,
+//	                                    &trace_id=, &name=*.example.com.,
+//	                                    &since= and
+//	                                    &until= (RFC 3339 or a duration ago,
+//	                                    e.g. 24h) and &limit= (1000)
+//	GET  /report                        Report of each client from the
+//	                                    History, with &since= (24h ago by
+//	                                    default), &until=, &client= and
+//	                                    &top= names (10)
+//
+// Faults can only be changed if FaultInjection is set.
+//
+// Against DNS rebinding, requests are only served for a Host which is an IP
+// address, localhost or one of AdminHosts. Against cross-site requests from
+// browsers, requests other than GET must have the AdminHeader, which
+// cannot be set without the consent of the API (CORS preflight).
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.adminDashboard)
+	mux.HandleFunc("/stats", p.adminStats)
+	mux.HandleFunc("/routes", p.adminRoutes)
+	mux.HandleFunc("/ready", p.adminReady)
+	mux.HandleFunc("/cache", p.adminCache)
+	mux.HandleFunc("/cache/flush", p.adminCacheFlush)
+	mux.HandleFunc("/cache/snapshot", p.adminCacheSnapshot)
+	mux.HandleFunc("/config", p.adminConfig)
+	mux.HandleFunc("/bans", p.adminBans)
+	mux.HandleFunc("/faults", p.adminFaults)
+	mux.HandleFunc("/debug", p.adminDebug)
+	mux.HandleFunc("/query", p.adminQuery)
+	mux.HandleFunc("/tail", p.adminTail)
+	mux.HandleFunc("/history", p.adminHistory)
+	mux.HandleFunc("/report", p.adminReport)
+	return p.adminGuard(mux)
+}
+
+// AdminHeader is the header which requests changing the state of the
+// administration API must have, with any value.
+const AdminHeader = "X-DNS-Proxy-Admin"
+
+// adminGuard serves the requests of h allowed by AdminHandler.
+func (p *Proxy) adminGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if net.ParseIP(strings.Trim(host, "[]")) == nil && host != "localhost" &&
+			!contains(p.AdminHosts, host) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && r.Header.Get(AdminHeader) == "" {
+			http.Error(w, "missing "+AdminHeader+" header", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) adminReady(w http.ResponseWriter, r *http.Request) {
+	if !p.Ready() {
+		http.Error(w, "unready: no upstream answers", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// cacheEntryJSON is a cached response in the administration API.
+type cacheEntryJSON struct {
+	Key    string   `json:"key"`
+	Rcode  string   `json:"rcode"`
+	Answer []string `json:"answer"`
+	Ns     []string `json:"ns,omitempty"`
+	Extra  []string `json:"extra,omitempty"`
+}
+
+func (p *Proxy) adminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.Cache == nil {
+		http.Error(w, "no cache", http.StatusNotFound)
+		return
+	}
+	name := r.FormValue("name")
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	entries, err := p.Cache.Entries(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := []cacheEntryJSON{}
+	for k, m := range entries {
+		list = append(list, cacheEntryJSON{
+			Key:    k,
+			Rcode:  dns.RcodeToString[m.Rcode],
+			Answer: rrStrings(m.Answer),
+			Ns:     rrStrings(m.Ns),
+			Extra:  rrStrings(m.Extra),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	writeJSON(w, list)
+}
+
+func (p *Proxy) adminCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.Cache == nil {
+		http.Error(w, "no cache", http.StatusNotFound)
+		return
+	}
+	name := r.FormValue("name")
+	if _, ok := dns.IsDomainName(name); name != "" && !ok {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	subtree, _ := strconv.ParseBool(r.FormValue("subtree"))
+	n, err := p.Cache.Flush(name, subtree)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+func (p *Proxy) adminFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, f := range p.Faults() {
+			fmt.Fprintln(w, f)
+		}
+	case "PUT":
+		if !p.FaultInjection {
+			http.Error(w, "fault injection disabled", http.StatusForbidden)
+			return
+		}
+		lines, err := readLines(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var faults []*Fault
+		for _, line := range lines {
+			f, err := ParseFault(line)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid fault %q: %v", line, err), http.StatusBadRequest)
+				return
+			}
+			faults = append(faults, f)
+		}
+		p.SetFaults(faults)
+		writeJSON(w, map[string]int{"faults": len(faults)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) adminDebug(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, rule := range p.DebugRules() {
+			fmt.Fprintln(w, rule)
+		}
+	case "PUT":
+		lines, err := readLines(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.SetDebugRules(lines); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"rules": len(lines)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// traceJSON is the trace of a query in the administration API.
+type traceJSON struct {
+	Steps    []string `json:"steps"`
+	Route    string   `json:"route,omitempty"`
+	Upstream string   `json:"upstream,omitempty"`
+	Cache    string   `json:"cache,omitempty"`
+	Rcode    string   `json:"rcode,omitempty"`
+	Answer   []string `json:"answer,omitempty"`
+}
+
+func (p *Proxy) adminQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := r.FormValue("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+	}
+	client := net.IPv4(127, 0, 0, 1)
+	if c := r.FormValue("client"); c != "" {
+		if client = net.ParseIP(c); client == nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	t := p.Trace(req, client)
+	tj := traceJSON{Steps: t.Steps, Upstream: t.Upstream, Cache: t.Cache}
+	if tj.Steps == nil {
+		tj.Steps = []string{}
+	}
+	if t.Route != nil {
+		tj.Route = t.Route.String()
+	}
+	if t.Response != nil {
+		tj.Rcode = dns.RcodeToString[t.Response.Rcode]
+		tj.Answer = rrStrings(t.Response.Answer)
+	}
+	writeJSON(w, tj)
+}
+
+// tailKeepAlive is how often a comment is sent to tails with no query, so
+// that proxies between keep them open.
+const tailKeepAlive = 15 * time.Second
+
+func (p *Proxy) adminTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	f := TailFilter{Rcode: -1}
+	if c := r.FormValue("client"); c != "" {
+		if p.QueryLog != nil && p.QueryLog.HashKey != nil {
+			// Not to tell which network a hashed client is in.
+			http.Error(w, "clients are hashed", http.StatusBadRequest)
+			return
+		}
+		n, err := ParseNet(c)
+		if err != nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+		f.Client = n
+	}
+	if f.Name = r.FormValue("name"); f.Name != "" {
+		if _, err := path.Match(f.Name, ""); err != nil {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+	}
+	if rc := r.FormValue("rcode"); rc != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(rc)]
+		if !ok {
+			http.Error(w, "invalid rcode", http.StatusBadRequest)
+			return
+		}
+		f.Rcode = rcode
+	}
+	queries, stop := p.Tail(f)
+	defer stop()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	t := time.NewTicker(tailKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-queries:
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		case <-t.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func (p *Proxy) adminHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.History == nil {
+		http.Error(w, "no history", http.StatusNotFound)
+		return
+	}
+	f := HistoryFilter{Client: r.FormValue("client"), Name: r.FormValue("name"),
+		TraceID: r.FormValue("trace_id"), Limit: 1000}
+	if _, err := path.Match(f.Name, ""); err != nil {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if f.Since, err = parseHistoryTime(r.FormValue("since")); err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	if f.Until, err = parseHistoryTime(r.FormValue("until")); err != nil {
+		http.Error(w, "invalid until", http.StatusBadRequest)
+		return
+	}
+	if l := r.FormValue("limit"); l != "" {
+		if f.Limit, err = strconv.Atoi(l); err != nil || f.Limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := p.History.Search(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func (p *Proxy) adminReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.History == nil {
+		http.Error(w, "no history", http.StatusNotFound)
+		return
+	}
+	since, until := time.Now().Add(-24*time.Hour), time.Now()
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = parseHistoryTime(s); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if u := r.FormValue("until"); u != "" {
+		var err error
+		if until, err = parseHistoryTime(u); err != nil {
+			http.Error(w, "invalid until", http.StatusBadRequest)
+			return
+		}
+	}
+	n := 10
+	if t := r.FormValue("top"); t != "" {
+		var err error
+		if n, err = strconv.Atoi(t); err != nil || n < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := p.History.Report(since, until, r.FormValue("client"), n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// parseHistoryTime parses a time in RFC 3339, or as a duration ago, zero if
+// empty.
+func parseHistoryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readLines returns the non-empty lines of the body of a request.
+func readLines(r *http.Request) ([]string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// rrStrings returns records in presentation format, leaving out OPT.
+func rrStrings(rrs []dns.RR) []string {
+	var s []string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			s = append(s, rr.String())
+		}
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,215 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// banWindow is the interval the queries and errors of clients are counted
+// in for BanQueries and BanErrors.
+const banWindow = time.Minute
+
+// defaultBanTime is how long clients are banned if BanTime is not set.
+const defaultBanTime = 10 * time.Minute
+
+// banTime returns how long clients are banned.
+func (p *Proxy) banTime() time.Duration {
+	if p.BanTime > 0 {
+		return p.BanTime
+	}
+	return defaultBanTime
+}
+
+// A Ban denies the queries of a client until it expires, as set by
+// BanAction.
+type Ban struct {
+	Client net.IP    `json:"client"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// banCount counts the queries of a client in a window.
+type banCount struct {
+	queries, errors int
+}
+
+// Bans returns the bans not expired, the first to expire first.
+func (p *Proxy) Bans() []*Ban {
+	now := time.Now()
+	p.banMu.Lock()
+	defer p.banMu.Unlock()
+	var bans []*Ban
+	for _, b := range p.bans {
+		if now.Before(b.Until) {
+			c := *b
+			bans = append(bans, &c)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// AddBan bans a client for d, replacing any ban of it.
+func (p *Proxy) AddBan(client net.IP, d time.Duration, reason string) {
+	p.banMu.Lock()
+	defer p.banMu.Unlock()
+	p.addBan(client, d, reason)
+}
+
+// addBan bans a client with banMu held, removing the bans expired.
+func (p *Proxy) addBan(client net.IP, d time.Duration, reason string) {
+	if p.bans == nil {
+		p.bans = make(map[string]*Ban)
+	}
+	now := time.Now()
+	for k, b := range p.bans {
+		if now.After(b.Until) {
+			delete(p.bans, k)
+		}
+	}
+	p.bans[client.String()] = &Ban{Client: client, Until: now.Add(d), Reason: reason}
+}
+
+// RemoveBan lifts the ban of a client and reports whether there was one.
+func (p *Proxy) RemoveBan(client net.IP) bool {
+	p.banMu.Lock()
+	defer p.banMu.Unlock()
+	_, ok := p.bans[client.String()]
+	delete(p.bans, client.String())
+	return ok
+}
+
+// banned reports whether the client of a query is banned, counting the
+// query for BanQueries.
+func (p *Proxy) banned(q *Query) bool {
+	if q.Client == nil {
+		return false
+	}
+	key := q.Client.String()
+	p.banMu.Lock()
+	defer p.banMu.Unlock()
+	if b := p.bans[key]; b != nil {
+		if q.Time.Before(b.Until) {
+			return true
+		}
+		delete(p.bans, key)
+	}
+	if p.BanQueries > 0 && !q.DryRun {
+		p.countBan(q, func(c *banCount) bool {
+			c.queries++
+			return c.queries > p.BanQueries
+		}, fmt.Sprintf("more than %d queries in %v", p.BanQueries, banWindow))
+	}
+	return false
+}
+
+// countBan counts a query of a client with banMu held, banning it if
+// exceeded returns true, unless it is exempt.
+func (p *Proxy) countBan(q *Query, exceeded func(*banCount) bool, reason string) {
+	if q.Time.Sub(p.banStart) >= banWindow || p.banCounts == nil {
+		p.banStart = q.Time
+		p.banCounts = make(map[string]*banCount)
+	}
+	key := q.Client.String()
+	c := p.banCounts[key]
+	if c == nil {
+		c = &banCount{}
+		p.banCounts[key] = c
+	}
+	if !exceeded(c) {
+		return
+	}
+	for _, n := range p.BanExempt {
+		if n.Contains(q.Client) {
+			return
+		}
+	}
+	delete(p.banCounts, key)
+	d := p.banTime()
+	p.addBan(q.Client, d, reason)
+	p.debugf(q, "client banned for %v: %s", d, reason)
+	if p.Alert != nil {
+		go p.Alert(&Event{Time: q.Time, Kind: EventBan,
+			Message: fmt.Sprintf("banned %s for %v: %s", q.Client, d, reason)})
+	}
+}
+
+// banWriter counts the error responses to a client for BanErrors: those
+// other than NOERROR and SERVFAIL, caused by the queries rather than the
+// upstreams, e.g. of scanners and random subdomain floods. Only the rcodes
+// of upstreams (or cached) count, not those answered by the proxy itself,
+// e.g. NXDOMAIN for blocked names or REFUSED for rebinding.
+type banWriter struct {
+	dns.ResponseWriter
+	p *Proxy
+	q *Query
+}
+
+func (w *banWriter) WriteMsg(m *dns.Msg) error {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeServerFailure && m.Rcode == w.q.upstreamRcode {
+		p := w.p
+		p.banMu.Lock()
+		p.countBan(w.q, func(c *banCount) bool {
+			c.errors++
+			return c.errors > p.BanErrors
+		}, fmt.Sprintf("more than %d errors in %v", p.BanErrors, banWindow))
+		p.banMu.Unlock()
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// banAnswer answers the query of a banned client as set by BanAction.
+func (p *Proxy) banAnswer(q *Query) {
+	if p.BanAction != "drop" {
+		reply(q.W, q.Req, dns.RcodeRefused)
+	}
+}
+
+func (p *Proxy) adminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		bans := p.Bans()
+		if bans == nil {
+			bans = []*Ban{}
+		}
+		writeJSON(w, bans)
+	case "POST":
+		client := net.ParseIP(r.FormValue("client"))
+		if client == nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+		d := p.banTime()
+		if s := r.FormValue("for"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		reason := r.FormValue("reason")
+		if reason == "" {
+			reason = "banned by an administrator"
+		}
+		p.AddBan(client, d, reason)
+		writeJSON(w, map[string]int{"added": 1})
+	case "DELETE":
+		client := net.ParseIP(r.FormValue("client"))
+		if client == nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+		n := 0
+		if p.RemoveBan(client) {
+			n = 1
+		}
+		writeJSON(w, map[string]int{"removed": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
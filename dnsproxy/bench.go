@@ -0,0 +1,181 @@
+package dnsproxy
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// BenchOptions are the load generated by Bench.
+type BenchOptions struct {
+	// Names are the patterns of the names queried, picked at random:
+	// "{random}" is replaced by a random label, to miss caches, and "{n}"
+	// by the number of the query.
+	Names []string
+	// Types are the types queried, picked at random.
+	Types []uint16
+	// QPS is the rate of queries per second, reached from StartQPS over
+	// Ramp, at once if Ramp is zero, then kept until Duration.
+	QPS      float64
+	StartQPS float64
+	Ramp     time.Duration
+	Duration time.Duration
+	// MaxInFlight bounds the queries waiting for a response, which slows
+	// down the load below QPS when the target cannot keep up.
+	MaxInFlight int
+	// Interval is how often the results of the queries of the last
+	// interval are reported, none if zero.
+	Interval time.Duration
+}
+
+// BenchResult are the results of queries sent by Bench.
+type BenchResult struct {
+	Elapsed time.Duration
+	Sent    uint64
+	// Failed is the number of queries without response, e.g. timed out,
+	// and Rcodes the number of responses by rcode.
+	Failed uint64
+	Rcodes map[string]uint64
+	// Latency percentiles of the responses.
+	P50, P90, P99, Max time.Duration
+
+	latencies []time.Duration
+}
+
+// QPS returns the rate of the queries sent.
+func (r *BenchResult) QPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// ErrorRate returns the ratio of the queries done which failed or were
+// answered SERVFAIL.
+func (r *BenchResult) ErrorRate() float64 {
+	done := r.Failed
+	for _, n := range r.Rcodes {
+		done += n
+	}
+	if done == 0 {
+		return 0
+	}
+	return float64(r.Failed+r.Rcodes["SERVFAIL"]) / float64(done)
+}
+
+// add counts the outcome of a query.
+func (r *BenchResult) add(resp *dns.Msg, err error, latency time.Duration) {
+	if err != nil {
+		r.Failed++
+		return
+	}
+	r.Rcodes[dns.RcodeToString[resp.Rcode]]++
+	r.latencies = append(r.latencies, latency)
+}
+
+// finish computes the percentiles of the latencies.
+func (r *BenchResult) finish(elapsed time.Duration) {
+	r.Elapsed = elapsed
+	if len(r.latencies) == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	at := func(p float64) time.Duration {
+		return r.latencies[int(p*float64(len(r.latencies)-1))]
+	}
+	r.P50, r.P90, r.P99, r.Max = at(0.5), at(0.9), at(0.99), r.latencies[len(r.latencies)-1]
+}
+
+func newBenchResult() *BenchResult {
+	return &BenchResult{Rcodes: make(map[string]uint64)}
+}
+
+// benchName returns a name of a pattern for query n.
+func benchName(pattern string, n uint64) string {
+	for strings.Contains(pattern, "{random}") {
+		label := make([]byte, 10)
+		for i := range label {
+			label[i] = "abcdefghijklmnopqrstuvwxyz0123456789"[rand.Intn(36)]
+		}
+		pattern = strings.Replace(pattern, "{random}", string(label), 1)
+	}
+	pattern = strings.ReplaceAll(pattern, "{n}", strconv.FormatUint(n, 10))
+	return dns.Fqdn(pattern)
+}
+
+// Bench sends queries to upstream as configured by o, as the proxy would,
+// calling report with the results of each interval, one at a time, and
+// returns the results of all queries.
+func (p *Proxy) Bench(upstream string, o BenchOptions, report func(*BenchResult)) *BenchResult {
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		inFlight = make(chan struct{}, o.MaxInFlight)
+		total    = newBenchResult()
+		window   = newBenchResult()
+		start    = time.Now()
+		windowAt = start
+		next     = start
+	)
+	// flush reports the window if its interval is over, with mu held.
+	flush := func(now time.Time, force bool) {
+		if report == nil || o.Interval <= 0 || (!force && now.Sub(windowAt) < o.Interval) {
+			return
+		}
+		window.finish(now.Sub(windowAt))
+		report(window)
+		window, windowAt = newBenchResult(), now
+	}
+	for n := uint64(0); ; n++ {
+		now := time.Now()
+		elapsed := now.Sub(start)
+		if elapsed >= o.Duration {
+			break
+		}
+		rate := o.QPS
+		if o.Ramp > 0 && elapsed < o.Ramp {
+			rate = o.StartQPS + (o.QPS-o.StartQPS)*float64(elapsed)/float64(o.Ramp)
+		}
+		if rate < 1 {
+			rate = 1
+		}
+		if d := next.Sub(now); d > 0 {
+			time.Sleep(d)
+		}
+		next = next.Add(time.Duration(float64(time.Second) / rate))
+		inFlight <- struct{}{}
+		m := new(dns.Msg)
+		m.SetQuestion(benchName(o.Names[rand.Intn(len(o.Names))], n), o.Types[rand.Intn(len(o.Types))])
+		mu.Lock()
+		total.Sent++
+		window.Sent++
+		flush(time.Now(), false)
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sent := time.Now()
+			resp, err := p.Exchange(upstream, m)
+			latency := time.Since(sent)
+			<-inFlight
+			mu.Lock()
+			defer mu.Unlock()
+			total.add(resp, err, latency)
+			window.add(resp, err, latency)
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	flush(time.Now(), true)
+	total.finish(time.Since(start))
+	return total
+}
@@ -0,0 +1,185 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// hostAddrs are the addresses of the host name of an upstream, as last
+// resolved.
+type hostAddrs struct {
+	ips      []net.IP
+	resolved time.Time
+}
+
+// resolver returns the resolver of the host names of upstreams: one
+// querying the Bootstrap servers if any, else the system resolver.
+func (p *Proxy) resolver() *net.Resolver {
+	if len(p.Bootstrap) == 0 {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		// The resolver retries, with another server at random.
+		server := p.Bootstrap[rand.Intn(len(p.Bootstrap))]
+		return (&net.Dialer{}).DialContext(ctx, network, server)
+	}}
+}
+
+// lookupHost returns the addresses of the host name of an upstream,
+// resolved again once older than BootstrapRefresh. If that fails, the
+// addresses last resolved are kept until the next refresh.
+func (p *Proxy) lookupHost(host string) ([]net.IP, error) {
+	p.hostsMu.Lock()
+	h := p.hosts[host]
+	p.hostsMu.Unlock()
+	if h != nil && time.Since(h.resolved) < p.BootstrapRefresh {
+		return h.ips, nil
+	}
+	ips, err := p.resolveHost(host)
+	if err != nil && h != nil {
+		p.logf("cannot resolve upstream %s, keeping %v: %v", host, h.ips, err)
+		p.hostsMu.Lock()
+		p.hosts[host] = &hostAddrs{ips: h.ips, resolved: time.Now()}
+		p.hostsMu.Unlock()
+		return h.ips, nil
+	}
+	return ips, err
+}
+
+// resolveHost resolves the host name of an upstream and keeps its
+// addresses.
+func (p *Proxy) resolveHost(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	ips, err := p.resolver().LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	p.hostsMu.Lock()
+	defer p.hostsMu.Unlock()
+	if p.hosts == nil {
+		p.hosts = make(map[string]*hostAddrs)
+	}
+	p.hosts[host] = &hostAddrs{ips: ips, resolved: time.Now()}
+	return ips, nil
+}
+
+// WatchHosts resolves the host names of the default upstreams and of the
+// upstreams of routes now, and again every BootstrapRefresh until stop is
+// closed, so that their addresses follow endpoints whose addresses rotate
+// without queries waiting for a resolution. Errors are logged, the
+// addresses last resolved are kept.
+func (p *Proxy) WatchHosts(stop <-chan struct{}) {
+	if p.BootstrapRefresh <= 0 {
+		return
+	}
+	t := time.NewTicker(p.BootstrapRefresh)
+	defer t.Stop()
+	for {
+		for _, host := range p.upstreamHosts() {
+			if _, err := p.resolveHost(host); err != nil {
+				p.logf("cannot resolve upstream %s: %v", host, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// upstreams returns the default upstreams and the upstreams of routes.
+func (p *Proxy) upstreams() []string {
+	p.mu.RLock()
+	upstreams := append([]string(nil), p.Default...)
+	p.mu.RUnlock()
+	for _, r := range p.Routes() {
+		if r.Upstreams != nil {
+			upstreams = append(upstreams, r.Upstreams.Addrs()...)
+		}
+	}
+	return upstreams
+}
+
+// upstreamHost returns the host name of an upstream, false if it is
+// given by IP.
+func upstreamHost(upstream string) (string, bool) {
+	var host string
+	if isDoH(upstream) {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return "", false
+		}
+		host = u.Hostname()
+	} else {
+		_, addr := parseUpstream(upstream)
+		var err error
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			return "", false
+		}
+	}
+	return host, host != "" && net.ParseIP(host) == nil
+}
+
+// upstreamHosts returns the host names of the default upstreams and of the
+// upstreams of routes, DNS over HTTPS ones excepted: their connections
+// resolve them.
+func (p *Proxy) upstreamHosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, u := range p.upstreams() {
+		host, ok := upstreamHost(u)
+		if !ok || isDoH(u) || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// CheckUpstreams checks that the default upstreams, the upstreams of routes
+// and the shadow are valid and that their host names resolve, unless a
+// SOCKS5 proxy resolves them, as a preflight check of a configuration, and
+// returns the errors found.
+func (p *Proxy) CheckUpstreams() []error {
+	var errs []error
+	check := func(q *Query, upstreams []string) {
+		for _, u := range upstreams {
+			if !ValidUpstream(u) {
+				errs = append(errs, fmt.Errorf("invalid upstream %q", u))
+				continue
+			}
+			if p.socks5(q) != "" {
+				continue
+			}
+			host, ok := upstreamHost(u)
+			if ok {
+				if _, err := p.resolveHost(host); err != nil {
+					errs = append(errs, fmt.Errorf("upstream %s: %v", u, err))
+				}
+			}
+			if p.selfUpstream(u) {
+				errs = append(errs, fmt.Errorf("upstream %s: %v", u, errLoop))
+			}
+		}
+	}
+	p.mu.RLock()
+	defaults := append([]string(nil), p.Default...)
+	p.mu.RUnlock()
+	if p.Shadow != "" {
+		defaults = append(defaults, p.Shadow)
+	}
+	check(&Query{}, defaults)
+	for _, r := range p.Routes() {
+		if r.Upstreams != nil {
+			check(&Query{Route: r}, r.Upstreams.Addrs())
+		}
+	}
+	return errs
+}
@@ -0,0 +1,469 @@
+package dnsproxy
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Cache stores responses to queries by key until their TTL expires.
+type Cache interface {
+	// Get returns a copy of the response stored for key with its TTLs
+	// decreased by its age, or nil if there is none or it expired.
+	Get(key string) *dns.Msg
+	// Set stores a response for key for ttl.
+	Set(key string, m *dns.Msg, ttl time.Duration)
+	// Entries returns the responses stored for a name, by key.
+	Entries(name string) (map[string]*dns.Msg, error)
+	// Flush removes the responses for a name, and for its subdomains if
+	// subtree, or all responses if name is empty, and returns how many.
+	Flush(name string, subtree bool) (int, error)
+}
+
+// keyName returns the name of the question of a cache key.
+func keyName(key string) string {
+	if i := strings.IndexByte(key, ' '); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// flushMatch reports whether a cache key is flushed for name and subtree.
+// The counters of quotas are never flushed.
+func flushMatch(key, name string, subtree bool) bool {
+	if isCounter(key) {
+		return false
+	}
+	if name == "" {
+		return true
+	}
+	n := keyName(key)
+	return n == name || subtree && dns.IsSubDomain(name, n)
+}
+
+// cacheKey returns the key of the response to a query: its question, the
+// DNSSEC bits and where it is routed, since different upstreams can give
+// different answers.
+func (p *Proxy) cacheKey(q *Query) string {
+	var view string
+	switch {
+	case q.Route != nil && q.Route.spec != "":
+		view = q.Route.spec
+	case q.Route != nil:
+		view = fmt.Sprintf("%s=%p", q.Route.Domain, q.Route)
+	case p.isDefault(q):
+		view = "default"
+	default:
+		view = q.Upstream
+	}
+	question := q.Req.Question[0]
+	var do bool
+	if opt := q.Req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s %d %d do=%t cd=%t @%s", strings.ToLower(question.Name), question.Qtype,
+		question.Qclass, do, q.Req.CheckingDisabled, view)
+}
+
+// isDefault reports whether the upstream of a query is one of the default
+// ones.
+func (p *Proxy) isDefault(q *Query) bool {
+	for _, d := range p.config(q).Default {
+		if d == q.Upstream {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheStage answers queries from the cache of the proxy, if any, and
+// stores the responses of upstreams in it.
+func (p *Proxy) cacheStage(next Handler) Handler {
+	return func(q *Query) {
+		if p.Cache == nil || q.Upstream == "" || isTransfer(q.Req) {
+			next(q)
+			return
+		}
+		key := p.cacheKey(q)
+		if m := p.Cache.Get(key); m != nil {
+			p.debugf(q, "answered from cache")
+			if q.DryRun {
+				q.trace.Cache, q.trace.Route = "hit", q.Route
+			} else {
+				p.stats.cacheHit(q.Req.Question[0].Qtype)
+			}
+			m.Id = q.Req.Id
+			m.Question = q.Req.Question
+			q.upstreamRcode = m.Rcode
+			q.W.WriteMsg(m)
+			return
+		}
+		if q.DryRun {
+			p.debugf(q, "not in cache")
+			q.trace.Cache = "miss"
+			next(q)
+			return
+		}
+		p.stats.cacheMiss(q.Req.Question[0].Qtype)
+		q.W = &cacheWriter{ResponseWriter: q.W, cache: p.Cache, key: key}
+		next(q)
+	}
+}
+
+// cacheWriter stores the responses of upstreams in a cache.
+type cacheWriter struct {
+	dns.ResponseWriter
+	cache Cache
+	key   string
+}
+
+func (w *cacheWriter) WriteMsg(m *dns.Msg) error {
+	if ttl, ok := cacheTTL(m); ok {
+		w.cache.Set(w.key, m.Copy(), ttl)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// cacheTTL returns how long a response can be cached: the lowest TTL of
+// its records or, for negative answers, of its SOA (RFC 2308).
+func cacheTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	negative := m.Rcode == dns.RcodeNameError || len(m.Answer) == 0
+	ttl := uint32(0)
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			t := h.Ttl
+			if soa, ok := rr.(*dns.SOA); ok && negative && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	if negative && !hasSOA(m.Ns) {
+		return 0, false
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// aged returns a copy of a response with its TTLs decreased by age.
+func aged(m *dns.Msg, age time.Duration) *dns.Msg {
+	m = m.Copy()
+	secs := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > secs {
+				h.Ttl -= secs
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// A MemoryCache is a Cache and Counters in memory, which can be saved to
+// and loaded from a snapshot to survive restarts. Create one with
+// NewMemoryCache.
+type MemoryCache struct {
+	// MaxSize is the maximum number of responses and counters, evicting an
+	// arbitrary response when full: when full of counters, no response is
+	// stored and no counter created. No limit if zero.
+	MaxSize int
+
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	swept     time.Time // last removal of expired entries
+	bytes     int64     // of the keys and packed responses
+	evictions uint64
+	expired   uint64
+}
+
+// CacheStats is the state of a cache.
+type CacheStats struct {
+	// Entries is the number of responses and counters, and Bytes their
+	// size, packed, with their keys.
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// Evictions is the number of responses evicted to make room for
+	// others, and Expired of those removed once expired.
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+}
+
+// A StatsCache is a Cache which reports its state in the stats of the
+// proxy.
+type StatsCache interface {
+	Cache
+	CacheStats() CacheStats
+}
+
+type cacheEntry struct {
+	Msg     []byte // packed, nil for counters
+	Count   int64
+	Stored  time.Time
+	Expires time.Time
+}
+
+// errCacheFull is the error of the counters not created in a MemoryCache
+// full of counters.
+var errCacheFull = errors.New("cache full of counters")
+
+// NewMemoryCache returns an empty cache of at most size responses.
+func NewMemoryCache(size int) *MemoryCache {
+	return &MemoryCache{MaxSize: size, entries: make(map[string]*cacheEntry)}
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(key string) *dns.Msg {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !time.Now().Before(e.Expires) {
+		c.remove(key)
+		c.expired++
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(e.Msg); err != nil {
+		return nil
+	}
+	return aged(m, time.Since(e.Stored))
+}
+
+// Set implements Cache.
+func (c *MemoryCache) Set(key string, m *dns.Msg, ttl time.Duration) {
+	buf, err := m.Pack()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && !c.makeRoom(now) {
+		return
+	}
+	c.add(key, &cacheEntry{Msg: buf, Stored: now, Expires: now.Add(ttl)})
+}
+
+// makeRoom makes room for a new entry if the cache is full, with c.mu
+// held, removing the expired entries or else an arbitrary response, and
+// reports whether there is room.
+func (c *MemoryCache) makeRoom(now time.Time) bool {
+	if c.MaxSize <= 0 || len(c.entries) < c.MaxSize {
+		return true
+	}
+	if c.sweep(now); len(c.entries) < c.MaxSize {
+		return true
+	}
+	for k := range c.entries {
+		if !isCounter(k) {
+			c.remove(k)
+			c.evictions++
+			return true
+		}
+	}
+	return false
+}
+
+// sweep removes the expired entries, with c.mu held, unless it did less
+// than a minute ago: counters are seldom read once expired.
+func (c *MemoryCache) sweep(now time.Time) {
+	if now.Sub(c.swept) <= time.Minute {
+		return
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.Expires) {
+			c.remove(k)
+			c.expired++
+		}
+	}
+	c.swept = now
+}
+
+// add stores an entry, replacing any for key, with c.mu held.
+func (c *MemoryCache) add(key string, e *cacheEntry) {
+	c.remove(key)
+	c.entries[key] = e
+	c.bytes += int64(len(key) + len(e.Msg))
+}
+
+// remove removes the entry for key, if any, with c.mu held.
+func (c *MemoryCache) remove(key string) {
+	if e, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.bytes -= int64(len(key) + len(e.Msg))
+	}
+}
+
+// Incr implements Counters.
+func (c *MemoryCache) Incr(key string, expires time.Time) (int64, error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+	e, ok := c.entries[key]
+	if !ok && !c.makeRoom(now) {
+		return 0, errCacheFull
+	}
+	if !ok || !now.Before(e.Expires) {
+		e = &cacheEntry{Stored: now, Expires: expires}
+		c.add(key, e)
+	}
+	e.Count++
+	return e.Count, nil
+}
+
+// Entries implements Cache.
+func (c *MemoryCache) Entries(name string) (map[string]*dns.Msg, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	var keys []string
+	c.mu.Lock()
+	for k := range c.entries {
+		if keyName(k) == name {
+			keys = append(keys, k)
+		}
+	}
+	c.mu.Unlock()
+	entries := make(map[string]*dns.Msg)
+	for _, k := range keys {
+		if m := c.Get(k); m != nil {
+			entries[k] = m
+		}
+	}
+	return entries, nil
+}
+
+// Flush implements Cache.
+func (c *MemoryCache) Flush(name string, subtree bool) (int, error) {
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k := range c.entries {
+		if flushMatch(k, name, subtree) {
+			c.remove(k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Len returns the number of responses and counters in the cache, expired
+// ones included.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// CacheStats implements StatsCache.
+func (c *MemoryCache) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.entries), Bytes: c.bytes,
+		Evictions: c.evictions, Expired: c.expired}
+}
+
+// Save writes a snapshot of the responses which have not expired.
+func (c *MemoryCache) Save(w io.Writer) error {
+	now := time.Now()
+	c.mu.Lock()
+	entries := make(map[string]*cacheEntry, len(c.entries))
+	for k, e := range c.entries {
+		if now.Before(e.Expires) {
+			// Copy the entry, its count changes once c.mu is released.
+			e := *e
+			entries[k] = &e
+		}
+	}
+	c.mu.Unlock()
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+// Load adds the responses of a snapshot which have not expired since, up
+// to the maximum size, and returns how many there were.
+func (c *MemoryCache) Load(r io.Reader) (int, error) {
+	var entries map[string]*cacheEntry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range entries {
+		if c.MaxSize > 0 && len(c.entries) >= c.MaxSize {
+			break
+		}
+		if now.Before(e.Expires) {
+			c.add(k, e)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// LoadFile adds the responses of a snapshot saved with SaveFile, see Load.
+func (c *MemoryCache) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
+
+// SaveFile saves a snapshot to a temporary file renamed over path, so that
+// path is never left half written.
+func (c *MemoryCache) SaveFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := c.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,269 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// linkTypeRaw is the pcap link type of packets starting with their IP
+// header.
+const linkTypeRaw = 101
+
+// A Capture writes the queries of clients and the responses to them to a
+// pcap file, for debugging without capturing packets as root. Messages are
+// written as UDP datagrams whatever their transport. Create one with
+// NewCapture and insert its Stage first in the chain of a proxy.
+type Capture struct {
+	// Filter restricts the capture to the queries it matches, if not nil.
+	Filter *Rule
+	// Until is when the capture stops, never if zero.
+	Until time.Time
+	// MaxSize is the size in bytes of the file after which it is rotated,
+	// no limit if zero.
+	MaxSize int64
+	// MaxFiles is the number of files kept by rotation, the current one
+	// (path) and the previous ones (path.1, path.2, ...). The oldest
+	// packets are dropped if one.
+	MaxFiles int
+
+	path string
+	mu   sync.Mutex
+	f    *os.File // nil once stopped
+	size int64
+}
+
+// NewCapture returns a capture to the pcap file at path, created or
+// truncated, kept with one previous file of up to 100MB each.
+func NewCapture(path string) (*Capture, error) {
+	c := &Capture{MaxSize: 100 << 20, MaxFiles: 2, path: path}
+	if err := c.create(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AppendCapture returns a capture appending to the pcap file at path if it
+// was written by a Capture, e.g. of the process upgraded still writing to
+// it until it stops, else as NewCapture.
+func AppendCapture(path string) (*Capture, error) {
+	c := &Capture{MaxSize: 100 << 20, MaxFiles: 2, path: path}
+	if f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0); err == nil {
+		var h [24]byte
+		fi, err := f.Stat()
+		if _, rerr := io.ReadFull(f, h[:]); rerr == nil && err == nil &&
+			binary.LittleEndian.Uint32(h[0:]) == 0xa1b2c3d4 &&
+			binary.LittleEndian.Uint32(h[20:]) == linkTypeRaw {
+			c.f, c.size = f, fi.Size()
+			return c, nil
+		}
+		f.Close()
+	}
+	if err := c.create(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// create starts the current file with the pcap header. Packets are
+// appended, whole, so that two processes can write to it during an upgrade.
+func (c *Capture) create() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	var h [24]byte
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], 65535)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	if _, err := f.Write(h[:]); err != nil {
+		f.Close()
+		return err
+	}
+	c.f, c.size = f, int64(len(h))
+	return nil
+}
+
+// rotate renames the current file to path.1, the previous ones to the
+// next number, dropping the oldest, and creates a new current file.
+func (c *Capture) rotate() error {
+	c.f.Close()
+	c.f = nil
+	for i := c.MaxFiles - 1; i > 0; i-- {
+		from := c.path
+		if i > 1 {
+			from += "." + strconv.Itoa(i-1)
+		}
+		if err := os.Rename(from, c.path+"."+strconv.Itoa(i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return c.create()
+}
+
+// Close stops the capture.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// Stage is the middleware capturing the queries matching the filter and
+// the responses to them, for the chain of a proxy.
+func (c *Capture) Stage(next Handler) Handler {
+	return func(q *Query) {
+		if !c.Until.IsZero() && q.Time.After(c.Until) {
+			c.Close()
+			next(q)
+			return
+		}
+		if q.DryRun || c.Filter != nil && !c.Filter.MatchQuery(q) {
+			next(q)
+			return
+		}
+		client, dest := captureAddr(q.Client, q.W.RemoteAddr()), captureAddr(nil, q.Dest)
+		c.write(client, dest, q.Req)
+		q.W = &captureWriter{ResponseWriter: q.W, capture: c, client: client, dest: dest}
+		next(q)
+	}
+}
+
+// captureWriter captures the responses to a query.
+type captureWriter struct {
+	dns.ResponseWriter
+	capture      *Capture
+	client, dest *net.UDPAddr
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	w.capture.write(w.dest, w.client, m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// captureAddr returns the address of a packet captured: ip, if not nil,
+// and the port of addr.
+func captureAddr(ip net.IP, addr net.Addr) *net.UDPAddr {
+	a := &net.UDPAddr{IP: ip}
+	if addr == nil {
+		return a
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return a
+	}
+	if a.IP == nil {
+		a.IP = net.ParseIP(host)
+	}
+	a.Port, _ = strconv.Atoi(port)
+	return a
+}
+
+// write writes a message from src to dst as a UDP datagram over IPv4, or
+// IPv6 if either address is not IPv4.
+func (c *Capture) write(src, dst *net.UDPAddr, m *dns.Msg) {
+	payload, err := m.Pack()
+	if err != nil {
+		return
+	}
+	pkt, err := udpPacket(src, dst, payload)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	var h [16]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(pkt)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	n := int64(len(h) + len(pkt))
+	if c.MaxSize > 0 && c.size+n > c.MaxSize {
+		if err := c.rotate(); err != nil {
+			return
+		}
+	}
+	if _, err := c.f.Write(append(h[:], pkt...)); err != nil {
+		return
+	}
+	c.size += n
+}
+
+// udpPacket returns an IP packet of a UDP datagram from src to dst.
+func udpPacket(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	v4 := src4 != nil && dst4 != nil
+	ipLen := 40
+	if v4 {
+		ipLen = 20
+	}
+	if ipLen+8+len(payload) > 65535 {
+		return nil, fmt.Errorf("message of %d bytes too long", len(payload))
+	}
+	pkt := make([]byte, ipLen+8+len(payload))
+	udp := pkt[ipLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+	// The checksum covers a pseudo header of the addresses, protocol and
+	// length, and the datagram.
+	var pseudo []byte
+	if v4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[6] = 0x40 // don't fragment
+		pkt[8] = 64   // TTL
+		pkt[9] = 17   // UDP
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], ^checksum(0, pkt[:20]))
+		pseudo = append(append([]byte(nil), pkt[12:20]...), 0, 17, udp[4], udp[5])
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(udp)))
+		pkt[6] = 17 // UDP
+		pkt[7] = 64 // hop limit
+		copy(pkt[8:24], src.IP.To16())
+		copy(pkt[24:40], dst.IP.To16())
+		pseudo = append(append([]byte(nil), pkt[8:40]...), 0, 0, udp[4], udp[5], 0, 0, 0, 17)
+	}
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return pkt, nil
+}
+
+// checksum adds b to the ones' complement sum of the Internet checksum.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
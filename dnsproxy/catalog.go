@@ -0,0 +1,213 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// A Catalog mirrors a catalog zone (RFC 9432) from its primary, as a
+// Secondary, and configures the proxy for its member zones, the targets of
+// the PTR records under zones.<catalog>, as the catalog changes: each member
+// is mirrored from the same primary as a Secondary, or, with Routes, routed
+// to it. Create one with NewCatalog, add its Stage to the chain of the proxy
+// and Run it.
+type Catalog struct {
+	// Routes routes the member zones to the primary instead of mirroring
+	// them. Proxy is the proxy to add the routes to, kept whatever its
+	// routes are set to and not removed by RemoveRoutes.
+	Routes bool
+	Proxy  *Proxy
+	// Alert is called with an EventRefreshError when the catalog or a
+	// member zone cannot be refreshed, if not nil.
+	Alert func(*Event)
+	// ErrorLog logs the changes of members and invalid catalogs.
+	// If nil, the standard logger is used.
+	ErrorLog *log.Logger
+
+	zone    *Secondary
+	mu      sync.RWMutex
+	members map[string]*catalogMember // by zone
+	stop    <-chan struct{}           // of Run
+}
+
+// catalogMember is a member zone, with the Secondary mirroring it unless
+// routed.
+type catalogMember struct {
+	zone *Secondary
+	stop chan struct{}
+}
+
+// NewCatalog returns the catalog zone origin transferred from primary.
+func NewCatalog(origin, primary string) *Catalog {
+	c := &Catalog{zone: NewSecondary(origin, primary),
+		members: make(map[string]*catalogMember)}
+	c.zone.changed = c.update
+	return c
+}
+
+// Members returns the member zones, sorted.
+func (c *Catalog) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	zones := make([]string, 0, len(c.members))
+	for z := range c.members {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// Stage is the middleware answering the queries for the mirrored member
+// zones, and for the catalog itself so that it can be transferred, for the
+// chain of a proxy.
+func (c *Catalog) Stage(next Handler) Handler {
+	catalog := c.zone.Stage(next)
+	return func(q *Query) {
+		if m := c.member(q.Name); m != nil && m.zone != nil {
+			m.zone.Stage(next)(q)
+			return
+		}
+		catalog(q)
+	}
+}
+
+// member returns the member zone a name is in, nil if none.
+func (c *Catalog) member(name string) *catalogMember {
+	name = strings.ToLower(dns.Fqdn(name))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if m, ok := c.members[name[i:]]; ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// Run mirrors the catalog until stop is closed, see Secondary.Run, and its
+// member zones unless routed.
+func (c *Catalog) Run(stop <-chan struct{}) {
+	c.mu.Lock()
+	c.stop = stop
+	c.mu.Unlock()
+	c.zone.Alert = c.Alert
+	c.zone.Run(stop)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for z, m := range c.members {
+		if m.stop != nil {
+			close(m.stop)
+		}
+		delete(c.members, z)
+	}
+}
+
+// update adds and removes member zones as the catalog changed. An invalid
+// or expired catalog leaves them as they were.
+func (c *Catalog) update() {
+	zones, err := c.catalogMembers()
+	if err != nil {
+		c.logf("catalog %s: %v", c.zone.Origin, err)
+		return
+	}
+	if zones == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for z, m := range c.members {
+		if zones[z] {
+			continue
+		}
+		if m.stop != nil {
+			close(m.stop)
+		}
+		if c.Routes && c.Proxy != nil {
+			c.Proxy.removeRoutes("*."+z, c.zone.Origin)
+		}
+		delete(c.members, z)
+		c.logf("catalog %s: removed zone %s", c.zone.Origin, z)
+	}
+	for z := range zones {
+		if _, ok := c.members[z]; ok {
+			continue
+		}
+		m := &catalogMember{}
+		if c.Routes {
+			if c.Proxy != nil {
+				r, err := ParseRoute("*." + z + "=" + c.zone.Primary)
+				if err != nil {
+					c.logf("catalog %s: zone %s: %v", c.zone.Origin, z, err)
+					continue
+				}
+				r.catalog = c.zone.Origin
+				c.Proxy.AddRoute(r)
+			}
+		} else {
+			m.zone = NewSecondary(z, c.zone.Primary)
+			m.zone.Alert = c.Alert
+			m.stop = make(chan struct{})
+			go m.zone.Run(mergeStop(c.stop, m.stop))
+		}
+		c.members[z] = m
+		c.logf("catalog %s: added zone %s", c.zone.Origin, z)
+	}
+}
+
+// catalogMembers returns the member zones of the catalog, which must be of
+// version 2, nil if it has expired.
+func (c *Catalog) catalogMembers() (map[string]bool, error) {
+	c.zone.mu.RLock()
+	defer c.zone.mu.RUnlock()
+	if c.zone.soa == nil {
+		return nil, nil
+	}
+	version := ""
+	for _, rr := range rrsOfType(c.zone.names["version."+c.zone.Origin], dns.TypeTXT) {
+		version = strings.Join(rr.(*dns.TXT).Txt, "")
+	}
+	if version != "2" {
+		return nil, fmt.Errorf("unsupported schema version %q", version)
+	}
+	zones := make(map[string]bool)
+	suffix := ".zones." + c.zone.Origin
+	for owner, rrs := range c.zone.names {
+		// Member PTRs are at <unique-N>.zones.<catalog>, properties below.
+		if !strings.HasSuffix(owner, suffix) || strings.Contains(strings.TrimSuffix(owner, suffix), ".") {
+			continue
+		}
+		for _, rr := range rrsOfType(rrs, dns.TypePTR) {
+			zones[strings.ToLower(dns.Fqdn(rr.(*dns.PTR).Ptr))] = true
+		}
+	}
+	return zones, nil
+}
+
+// mergeStop returns a channel closed once either a or b is, a may be nil.
+func mergeStop(a, b <-chan struct{}) <-chan struct{} {
+	if a == nil {
+		return b
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(stop)
+	}()
+	return stop
+}
+
+func (c *Catalog) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,88 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Certificate is a TLS certificate loaded from files which can be
+// reloaded without restarting the listeners using it, e.g. after a
+// renewal. Create one with LoadCertificate and use its GetCertificate in
+// a tls.Config.
+type Certificate struct {
+	CertFile, KeyFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time // of the files when loaded, the latest
+}
+
+// LoadCertificate loads a certificate and its key from PEM files.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{CertFile: certFile, KeyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the files again. On error, the previous certificate stays
+// in use.
+func (c *Certificate) Reload() error {
+	modified := c.modTime()
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.modified = &cert, modified
+	return nil
+}
+
+// modTime returns when the files were last modified, zero if unknown.
+func (c *Certificate) modTime() time.Time {
+	var t time.Time
+	for _, name := range []string{c.CertFile, c.KeyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// GetCertificate returns the certificate, for tls.Config.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate when its files are modified, checking
+// every interval until stop is closed. Errors are logged, e.g. of a
+// certificate written before its key, and retried at the next check.
+func (c *Certificate) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		c.mu.RLock()
+		modified := c.modified
+		c.mu.RUnlock()
+		if !c.modTime().After(modified) {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			log.Printf("cannot reload certificate %s: %v", c.CertFile, err)
+			continue
+		}
+		log.Printf("reloaded certificate %s", c.CertFile)
+	}
+}
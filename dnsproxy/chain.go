@@ -0,0 +1,143 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Query is the state of a query as it goes through the stages of a proxy.
+// Stages may replace W and Req (e.g. to rewrite the query) and set Upstream
+// to decide where the query is forwarded, and Route for how.
+type Query struct {
+	W        dns.ResponseWriter
+	Req      *dns.Msg
+	Name     string // name of the first question, possibly rewritten
+	Client   net.IP
+	Group    string   // group of the client, if any
+	Dest     net.Addr // address the client sent the query to
+	Time     time.Time
+	Upstream string // upstream to forward to, empty until routed
+	Route    *Route // route the query matched, if any
+	Verdict  string // action of the policy, or block if blocked, if any
+	// TLS is the state of the connection of queries over TLS and HTTPS,
+	// with the certificate of the client if it sent one.
+	TLS *tls.ConnectionState
+	// Identity is the user authenticated by the DNS over HTTPS server, if
+	// any, see BasicAuth and TokenAuth.
+	Identity string
+	// TraceID identifies the query in the debug log, the query log and
+	// its history, and the extended errors of TraceEDE, so that a
+	// complaint about a response can be tied to what the proxy did.
+	TraceID string
+	// DryRun is set for queries traced by Trace: stages decide as usual
+	// but leave out side effects, such as counting or forwarding the query.
+	DryRun bool
+
+	trace  *Trace
+	chased int       // CNAMEs chased across routes, see ChaseCNAMEs
+	config *Snapshot // see Proxy.config
+	// upstreamRcode is the rcode of the response of the upstream, or of
+	// the cache, NOERROR if none, see banWriter.
+	upstreamRcode int
+}
+
+// A Handler handles a query, either answering it or passing it on.
+type Handler func(*Query)
+
+// A Middleware wraps the next handler of a chain into a new handler.
+type Middleware func(next Handler) Handler
+
+type stage struct {
+	name string
+	mw   Middleware
+}
+
+// chain is an ordered list of named stages a query goes through.
+type chain struct {
+	stages []stage
+}
+
+func (c *chain) index(name string) int {
+	for i, s := range c.stages {
+		if s.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *chain) use(name string, mw Middleware) {
+	c.stages = append(c.stages, stage{name: name, mw: mw})
+}
+
+func (c *chain) insertBefore(before, name string, mw Middleware) error {
+	i := c.index(before)
+	if i < 0 {
+		return fmt.Errorf("no stage %q", before)
+	}
+	c.stages = append(c.stages[:i], append([]stage{{name: name, mw: mw}}, c.stages[i:]...)...)
+	return nil
+}
+
+func (c *chain) remove(name string) error {
+	i := c.index(name)
+	if i < 0 {
+		return fmt.Errorf("no stage %q", name)
+	}
+	c.stages = append(c.stages[:i], c.stages[i+1:]...)
+	return nil
+}
+
+// handler builds the chain into a DNS handler: queries go through each
+// stage in order and to final if they all pass them on.
+func (c *chain) handler(final Handler) dns.HandlerFunc {
+	h := final
+	for i := len(c.stages) - 1; i >= 0; i-- {
+		h = c.stages[i].mw(h)
+	}
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		q := &Query{W: w, Req: req, Client: clientIP(w), Dest: destAddr(w), Time: time.Now(),
+			TraceID: newTraceID()}
+		if len(req.Question) > 0 {
+			q.Name = req.Question[0].Name
+		}
+		if s, ok := w.(dns.ConnectionStater); ok {
+			q.TLS = s.ConnectionState()
+		}
+		if i, ok := w.(interface{ Identity() string }); ok {
+			q.Identity = i.Identity()
+		}
+		if t, ok := w.(*traceWriter); ok {
+			q.DryRun, q.trace = true, t.trace
+		}
+		h(q)
+	}
+}
+
+// newTraceID returns a random trace ID of 16 hexadecimal digits, as the
+// span IDs of OpenTelemetry.
+func newTraceID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+func clientIP(w dns.ResponseWriter) net.IP {
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// destAddr returns the address a query was sent to, which is the original
+// destination for queries intercepted in transparent mode.
+func destAddr(w dns.ResponseWriter) net.Addr {
+	if a, ok := w.RemoteAddr().(interface{ OrigDst() net.Addr }); ok {
+		return a.OrigDst()
+	}
+	return w.LocalAddr()
+}
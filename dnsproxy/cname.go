@@ -0,0 +1,90 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChase bounds the CNAMEs chased across routes for a query, so
+// that CNAME loops between routes end.
+const maxCNAMEChase = 8
+
+// routeOf returns the route of a query for name, nil for the default
+// upstreams.
+func (p *Proxy) routeOf(q *Query, name string) *Route {
+	for _, r := range p.config(q).Routes {
+		if r.match(name, q.Client, q.Group, q.Time) {
+			return r
+		}
+	}
+	return nil
+}
+
+// danglingCNAME returns the target the CNAMEs of the answer to a query
+// lead to if the answer has no records for it, else "".
+func danglingCNAME(q *Query, m *dns.Msg) string {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return ""
+	}
+	qtype := q.Req.Question[0].Qtype
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	name := q.Name
+	for i := 0; i <= len(m.Answer); i++ {
+		var next string
+		for _, rr := range m.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			} else if rr.Header().Rrtype == qtype {
+				return ""
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	if strings.EqualFold(name, q.Name) {
+		return ""
+	}
+	return name
+}
+
+// chaseWriter resolves the target of a dangling CNAME in the response to
+// a query through its own route, if it is not the one of the query, and
+// appends its records, see ChaseCNAMEs.
+type chaseWriter struct {
+	dns.ResponseWriter
+	p     *Proxy
+	q     *Query
+	route Handler // route stage, to resolve the target through
+}
+
+func (w *chaseWriter) WriteMsg(m *dns.Msg) error {
+	q := w.q
+	target := danglingCNAME(q, m)
+	if target == "" || q.chased >= maxCNAMEChase || w.p.routeOf(q, target) == q.Route {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	w.p.debugf(q, "chasing CNAME to %s through its route", target)
+	sw := &searchWriter{ResponseWriter: w.ResponseWriter}
+	sq := *q
+	sq.W = sw
+	sq.Req = q.Req.Copy()
+	sq.Req.Question[0].Name, sq.Name = target, target
+	sq.Upstream, sq.Route, sq.Verdict = "", nil, ""
+	sq.chased = q.chased + 1
+	w.route(&sq)
+	if r := sw.msg; r != nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+		m.Rcode = r.Rcode
+		m.Answer = append(m.Answer, r.Answer...)
+		m.Ns = r.Ns
+		m.AuthenticatedData = m.AuthenticatedData && r.AuthenticatedData
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,123 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Consul discovers upstreams from the healthy instances of Consul services.
+type Consul struct {
+	// Addr is the address of the Consul agent HTTP API, e.g. "127.0.0.1:8500".
+	Addr string
+	// Token is the ACL token, if any.
+	Token string
+	// Client to make requests with, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// consulWait is how long a blocking query waits for catalog changes.
+const consulWait = 5 * time.Minute
+
+// Watch keeps set updated with the healthy instances of service until stop
+// is closed, using blocking queries to learn about changes as they happen.
+// Errors are retried after a delay, keeping the last known instances.
+func (c *Consul) Watch(service string, set *UpstreamSet, stop <-chan struct{}) {
+	var index uint64
+	for {
+		start := time.Now()
+		addrs, next, err := c.instances(service, index, stop)
+		// Rate limit in case queries stop blocking, longer after errors.
+		delay := time.Second - time.Since(start)
+		if err != nil {
+			delay, index = 5*time.Second, 0
+		} else {
+			// The index going backwards means it was reset, start over.
+			if next < index {
+				next = 0
+			}
+			index = next
+			set.Set(addrs)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// instances returns the healthy instances of service, blocking until the
+// catalog changes past index.
+func (c *Consul) instances(service string, index uint64, stop <-chan struct{}) ([]string, uint64, error) {
+	u := url.URL{
+		Scheme: "http",
+		Host:   c.Addr,
+		Path:   "/v1/health/service/" + url.PathEscape(service),
+		RawQuery: url.Values{
+			"passing": {"1"},
+			"index":   {strconv.FormatUint(index, 10)},
+			"wait":    {fmt.Sprintf("%ds", int(consulWait.Seconds()))},
+		}.Encode(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s", resp.Status)
+	}
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul: %v", err)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul: invalid index: %v", err)
+	}
+	var addrs []string
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	sort.Strings(addrs)
+	return addrs, next, nil
+}
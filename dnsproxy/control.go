@@ -0,0 +1,147 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Control serves commands on a local control socket, for scripts on the
+// host of a proxy without the administration API, like unbound-control.
+// Each connection sends a command on a line and gets its output, the last
+// line "ok" or "error: ...":
+//
+//	reload                        run Reload
+//	flush [name [subtree]]        flush the cache, a name, or a name and
+//	                              its subdomains
+//	routes                        list the routes, one per line
+//	route add domain=upstream...  add a route (ParseRoute)
+//	route remove domain           remove the routes of a domain
+//	verbosity 0|1                 stop or start logging the decisions
+//	                              about every query, replacing the debug
+//	                              rules (see SetDebugRules)
+//	stats                         Stats of the queries as JSON
+type Control struct {
+	Proxy *Proxy
+	// Reload, if not nil, reloads the configuration, e.g. the certificate
+	// and the policy.
+	Reload func() error
+}
+
+// controlTimeout bounds reading a command and writing its output.
+const controlTimeout = 10 * time.Second
+
+// ListenControl listens on a unix socket at path, replacing a stale one,
+// only reachable by the user of the proxy.
+func ListenControl(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve serves the commands of the connections of a listener until it is
+// closed.
+func (c *Control) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(controlTimeout))
+			line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			if err := c.run(conn, strings.Fields(line)); err != nil {
+				fmt.Fprintf(conn, "error: %v\n", err)
+				return
+			}
+			fmt.Fprintln(conn, "ok")
+		}()
+	}
+}
+
+// run runs a command, writing its output to w.
+func (c *Control) run(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command")
+	}
+	p := c.Proxy
+	cmd := args[0]
+	if len(args) > 1 {
+		cmd += " " + args[1]
+	}
+	switch {
+	case args[0] == "reload" && len(args) == 1:
+		if c.Reload == nil {
+			return fmt.Errorf("nothing to reload")
+		}
+		return c.Reload()
+	case args[0] == "flush" && len(args) <= 3:
+		if p.Cache == nil {
+			return fmt.Errorf("no cache")
+		}
+		var name string
+		var subtree bool
+		if len(args) > 1 {
+			name = args[1]
+		}
+		if len(args) > 2 {
+			if args[2] != "subtree" {
+				return fmt.Errorf("usage: flush [name [subtree]]")
+			}
+			subtree = true
+		}
+		n, err := p.Cache.Flush(name, subtree)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "flushed %d\n", n)
+	case args[0] == "routes" && len(args) == 1:
+		for _, r := range p.Routes() {
+			fmt.Fprintln(w, r)
+		}
+	case cmd == "route add" && len(args) == 3:
+		r, err := ParseRoute(args[2])
+		if err != nil {
+			return err
+		}
+		p.AddRoute(r)
+	case cmd == "route remove" && len(args) == 3:
+		fmt.Fprintf(w, "removed %d\n", p.RemoveRoutes(args[2]))
+	case args[0] == "verbosity" && len(args) == 2:
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 || v > 1 {
+			return fmt.Errorf("usage: verbosity 0|1")
+		}
+		var rules []string
+		if v > 0 {
+			rules = []string{"."}
+		}
+		return p.SetDebugRules(rules)
+	case args[0] == "stats" && len(args) == 1:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p.Stats())
+	default:
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	return nil
+}
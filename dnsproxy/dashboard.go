@@ -0,0 +1,181 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// routeJSON is a route in the administration API.
+type routeJSON struct {
+	Route     string   `json:"route"`
+	Domain    string   `json:"domain"`
+	Upstreams []string `json:"upstreams"`
+	Clients   []string `json:"clients,omitempty"`
+	Scheduled bool     `json:"scheduled,omitempty"`
+}
+
+func (p *Proxy) adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, p.Stats())
+}
+
+func (p *Proxy) adminRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		route, err := ParseRoute(r.FormValue("route"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid route: %v", err), http.StatusBadRequest)
+			return
+		}
+		p.AddRoute(route)
+		writeJSON(w, map[string]int{"added": 1})
+		return
+	case "DELETE":
+		domain := r.FormValue("domain")
+		if domain == "" {
+			http.Error(w, "missing domain", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"removed": p.RemoveRoutes(domain)})
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	routes := []routeJSON{}
+	for _, route := range p.Routes() {
+		rj := routeJSON{
+			Route:     route.String(),
+			Domain:    route.Domain,
+			Upstreams: route.Upstreams.Addrs(),
+			Scheduled: len(route.Schedule) > 0,
+		}
+		for _, n := range route.Clients {
+			rj.Clients = append(rj.Clients, n.String())
+		}
+		routes = append(routes, rj)
+	}
+	p.mu.RLock()
+	defaults := append([]string{}, p.Default...)
+	p.mu.RUnlock()
+	writeJSON(w, map[string]interface{}{"routes": routes, "default": defaults})
+}
+
+func (p *Proxy) adminDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	strings.NewReader(dashboardHTML).WriteTo(w)
+}
+
+// dashboardHTML is the page of the dashboard, refreshing itself from the
+// /stats and /routes endpoints, and searching /history if any.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>DNS reverse proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+.cards { display: flex; gap: 1em; flex-wrap: wrap; }
+.card { border: 1px solid #ccc; border-radius: 4px; padding: 0.8em 1.2em; min-width: 8em; }
+.card b { display: block; font-size: 1.6em; }
+table { border-collapse: collapse; }
+td, th { border-bottom: 1px solid #eee; padding: 0.2em 0.8em; text-align: left; }
+.grid { display: flex; gap: 3em; flex-wrap: wrap; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>DNS reverse proxy</h1>
+<div class="cards">
+<div class="card">QPS<b id="qps">-</b></div>
+<div class="card">Queries<b id="queries">-</b></div>
+<div class="card">Blocked<b id="blocked">-</b></div>
+<div class="card">Cache hits<b id="cache">-</b></div>
+</div>
+<h2>Queries per second, last minute</h2>
+<svg id="chart" width="600" height="100"></svg>
+<div class="grid">
+<div><h2>Top names</h2><table id="names"></table></div>
+<div><h2>Top blocked</h2><table id="blocks"></table></div>
+<div><h2>Responses</h2><table id="rcodes"></table></div>
+</div>
+<h2>Upstreams</h2>
+<table id="upstreams"></table>
+<h2>Routes</h2>
+<table id="routes"></table>
+<div id="history" hidden>
+<h2>History</h2>
+<form id="search">
+Client <input name="client" size="15"> Name <input name="name" placeholder="*.example.com.">
+Since <input name="since" value="24h" size="5"> <button>Search</button>
+</form>
+<table id="found"></table>
+</div>
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"})[c]);
+}
+function table(id, head, rows) {
+  document.getElementById(id).innerHTML =
+    "<tr>" + head.map(h => "<th>" + esc(h) + "</th>").join("") + "</tr>" +
+    rows.map(r => "<tr>" + r.map(c => "<td>" + c + "</td>").join("") + "</tr>").join("");
+}
+function chart(qps) {
+  const max = Math.max(1, ...qps), w = 600 / Math.max(1, qps.length);
+  document.getElementById("chart").innerHTML = qps.map((v, i) =>
+    '<rect x="' + i * w + '" y="' + (100 - 100 * v / max) + '" width="' + (w - 1) +
+    '" height="' + 100 * v / max + '" fill="#4a7"><title>' + v + '</title></rect>').join("");
+}
+function name(a, u) {
+  return esc(a) + (u ? " (" + esc(u) + ")" : "");
+}
+async function refresh() {
+  try {
+    const s = await (await fetch("stats")).json();
+    const last = s.qps.slice(-10);
+    document.getElementById("qps").textContent = (last.reduce((a, b) => a + b, 0) / Math.max(1, last.length)).toFixed(1);
+    document.getElementById("queries").textContent = s.queries;
+    document.getElementById("blocked").textContent = s.blocked;
+    document.getElementById("cache").textContent = s.cache_hits + " (" + Math.round(s.cache_hit_ratio * 100) + "%)";
+    chart(s.qps);
+    table("names", ["Name", "Queries"], s.top_names.map(n => [name(n.name, n.unicode), n.count]));
+    table("blocks", ["Name", "Blocked"], s.top_blocked.map(n => [name(n.name, n.unicode), n.count]));
+    table("rcodes", ["Rcode", "Responses"], Object.entries(s.rcodes).map(([k, v]) => [esc(k), v]));
+    table("upstreams", ["Upstream", "Queries", "Failures", "Latency", "Last error"],
+      Object.entries(s.upstreams).sort().map(([a, u]) => [esc(a) + (u.down ? ' <span class="bad">down</span>' : ""), u.queries,
+        '<span class="' + (u.failures ? "bad" : "") + '">' + u.failures + "</span>",
+        (u.latency / 1e6).toFixed(1) + " ms", esc(u.last_error || "")]));
+    const r = await (await fetch("routes")).json();
+    table("routes", ["Domain", "Upstreams", "Clients", "Scheduled"],
+      r.routes.map(x => [esc(x.domain), esc(x.upstreams.join(" ")), esc((x.clients || []).join(" ")), x.scheduled ? "yes" : ""])
+        .concat([["<i>default</i>", esc(r.default.join(" ")), "", ""]]));
+  } catch (e) {
+    console.log(e);
+  }
+}
+document.getElementById("search").onsubmit = async e => {
+  e.preventDefault();
+  const q = new URLSearchParams(new FormData(e.target));
+  q.set("limit", "500");
+  const h = await (await fetch("history?" + q)).json();
+  table("found", ["Time", "Client", "Name", "Type", "Rcode", "Upstream"],
+    h.map(x => [esc(new Date(x.time).toLocaleString()), esc(x.client), name(x.name || "", x.unicode), esc(x.type), esc(x.rcode), esc(x.upstream || "")]));
+};
+fetch("history?limit=1").then(r => document.getElementById("history").hidden = !r.ok);
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
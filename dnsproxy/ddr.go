@@ -0,0 +1,95 @@
+package dnsproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// resolverArpa is the name clients query to discover the encrypted
+// endpoints of their resolver (RFC 9462).
+const resolverArpa = "_dns.resolver.arpa."
+
+// ddrTTL is the TTL of the records of designated resolvers.
+const ddrTTL = 300
+
+// A DDR advertises the encrypted endpoints of the proxy to clients with
+// Discovery of Designated Resolvers (RFC 9462), so that they upgrade from
+// plain DNS: it answers the SVCB queries for _dns.resolver.arpa and for
+// _dns.Name (RFC 9461). Clients only upgrade if the certificate of the
+// endpoints is valid for Name, and for the address they query for
+// _dns.resolver.arpa.
+type DDR struct {
+	// Name of the proxy in its certificate, e.g. "dns.example.com.".
+	Name string
+	// TLSPort is the port of DNS over TLS, 0 if none.
+	TLSPort int
+	// DoHPort is the port of DNS over HTTPS, 0 if none, and DoHPath the
+	// path it is served on.
+	DoHPort int
+	DoHPath string
+	// HTTP3 advertises DNS over HTTPS over HTTP/3 too.
+	HTTP3 bool
+	// Hints are addresses of the proxy, optional.
+	Hints []net.IP
+}
+
+// Stage is the middleware answering the queries of designated resolvers,
+// for the chain of a proxy.
+func (d *DDR) Stage(next Handler) Handler {
+	return func(q *Query) {
+		name := strings.ToLower(q.Name)
+		if name != resolverArpa && name != "_dns."+dns.Fqdn(strings.ToLower(d.Name)) {
+			next(q)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(q.Req)
+		resp.Authoritative = true
+		if q.Req.Question[0].Qtype == dns.TypeSVCB {
+			resp.Answer = d.records(q.Req.Question[0].Name)
+		}
+		q.W.WriteMsg(resp)
+	}
+}
+
+// records returns the SVCB records of the endpoints, by order of
+// preference.
+func (d *DDR) records(owner string) []dns.RR {
+	var rrs []dns.RR
+	add := func(params ...dns.SVCBKeyValue) {
+		var v4, v6 []net.IP
+		for _, ip := range d.Hints {
+			if ip.To4() != nil {
+				v4 = append(v4, ip)
+			} else {
+				v6 = append(v6, ip)
+			}
+		}
+		if v4 != nil {
+			params = append(params, &dns.SVCBIPv4Hint{Hint: v4})
+		}
+		if v6 != nil {
+			params = append(params, &dns.SVCBIPv6Hint{Hint: v6})
+		}
+		rrs = append(rrs, &dns.SVCB{
+			Hdr:      dns.RR_Header{Name: owner, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: ddrTTL},
+			Priority: uint16(len(rrs) + 1),
+			Target:   dns.Fqdn(d.Name),
+			Value:    params,
+		})
+	}
+	if d.DoHPort != 0 {
+		alpn := []string{"h2"}
+		if d.HTTP3 {
+			alpn = append(alpn, "h3")
+		}
+		add(&dns.SVCBAlpn{Alpn: alpn}, &dns.SVCBPort{Port: uint16(d.DoHPort)},
+			&dns.SVCBDoHPath{Template: d.DoHPath + "{?dns}"})
+	}
+	if d.TLSPort != 0 {
+		add(&dns.SVCBAlpn{Alpn: []string{"dot"}}, &dns.SVCBPort{Port: uint16(d.TLSPort)})
+	}
+	return rrs
+}
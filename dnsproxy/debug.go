@@ -0,0 +1,70 @@
+package dnsproxy
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// debugRule is a rule of the queries to log the decisions of.
+type debugRule struct {
+	*Rule
+	spec string
+}
+
+// DebugRules returns the rules of the queries whose decisions are logged,
+// as set with SetDebugRules.
+func (p *Proxy) DebugRules() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var specs []string
+	for _, r := range p.debug {
+		specs = append(specs, r.spec)
+	}
+	return specs
+}
+
+// SetDebugRules replaces the rules (see ParseRule) of the queries whose
+// decisions are logged, in addition to all of them if Debug is set.
+func (p *Proxy) SetDebugRules(specs []string) error {
+	var rules []debugRule
+	for _, s := range specs {
+		r, err := ParseRule(s)
+		if err != nil {
+			return fmt.Errorf("invalid rule %q: %v", s, err)
+		}
+		rules = append(rules, debugRule{Rule: r, spec: s})
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.debug = rules
+	return nil
+}
+
+// debugf logs a decision about a query, if Debug is set or the query
+// matches a debug rule, or adds it to the steps of a query traced.
+func (p *Proxy) debugf(q *Query, format string, v ...interface{}) {
+	if q.trace != nil {
+		q.trace.stepf(format, v...)
+		return
+	}
+	if !p.Debug && !p.debugged(q) {
+		return
+	}
+	var qtype string
+	if len(q.Req.Question) > 0 {
+		qtype = dns.TypeToString[q.Req.Question[0].Qtype]
+	}
+	p.logf("debug: [%s] %s %s from %s: %s", q.TraceID, displayName(q.Name), qtype, q.Client, fmt.Sprintf(format, v...))
+}
+
+func (p *Proxy) debugged(q *Query) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.debug {
+		if r.MatchQuery(q) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package dnsproxy
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Detection is a query flagged by a Detector.
+type Detection struct {
+	Time   time.Time
+	Client net.IP
+	Name   string
+	Zone   string
+	Reason string
+}
+
+// A Detector flags queries which look like DNS tunneling, used to exfiltrate
+// data, or like names generated by malware (DGA): very long or random
+// labels, many unique subdomains of a zone or many TXT and NULL queries from
+// a client. Zones are approximated as the last two labels of names. Create
+// one with NewDetector and insert its Stage.
+type Detector struct {
+	// MaxLabelLen is the length of the longest label allowed.
+	MaxLabelLen int
+	// MaxEntropy is the Shannon entropy in bits per character allowed for
+	// labels of at least MinEntropyLen characters.
+	MaxEntropy    float64
+	MinEntropyLen int
+	// MaxSubdomains is the number of unique names allowed per zone and
+	// Window.
+	MaxSubdomains int
+	// MaxTXT is the number of TXT and NULL queries allowed per client and
+	// Window.
+	MaxTXT int
+	Window time.Duration
+	// Block refuses the queries flagged, which are otherwise passed on.
+	Block bool
+	// Alert is called with the first detection of a reason for each client
+	// and zone per Window, if not nil.
+	Alert func(*Detection)
+
+	mu      sync.Mutex
+	start   time.Time                      // of the current window
+	names   map[string]map[string]struct{} // unique names by zone
+	txt     map[string]int                 // TXT and NULL queries by client
+	alerted map[string]bool
+}
+
+// NewDetector returns a detector with default thresholds.
+func NewDetector() *Detector {
+	return &Detector{
+		MaxLabelLen:   52,
+		MaxEntropy:    4,
+		MinEntropyLen: 24,
+		MaxSubdomains: 500,
+		MaxTXT:        200,
+		Window:        time.Minute,
+	}
+}
+
+// Stage is the middleware flagging queries, for the chain of a proxy.
+func (d *Detector) Stage(next Handler) Handler {
+	return func(q *Query) {
+		if !q.DryRun && d.check(q) != nil && d.Block {
+			reply(q.W, q.Req, dns.RcodeRefused)
+			return
+		}
+		next(q)
+	}
+}
+
+// check returns the detection of a query, nil if it looks fine.
+func (d *Detector) check(q *Query) *Detection {
+	name := strings.ToLower(q.Name)
+	labels := dns.SplitDomainName(name)
+	zone := name
+	if len(labels) > 2 {
+		zone = strings.Join(labels[len(labels)-2:], ".") + "."
+	}
+	det := &Detection{Time: q.Time, Client: q.Client, Name: name, Zone: zone}
+	for _, l := range labels {
+		switch {
+		case len(l) > d.MaxLabelLen:
+			det.Reason = "long label"
+		case len(l) >= d.MinEntropyLen && entropy(l) > d.MaxEntropy:
+			det.Reason = "random label"
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if q.Time.Sub(d.start) >= d.Window || d.names == nil {
+		d.start = q.Time
+		d.names = make(map[string]map[string]struct{})
+		d.txt = make(map[string]int)
+		d.alerted = make(map[string]bool)
+	}
+	if det.Reason == "" && len(labels) > 2 {
+		names := d.names[zone]
+		if names == nil {
+			names = make(map[string]struct{})
+			d.names[zone] = names
+		}
+		// Names beyond the limit need not be remembered.
+		if len(names) <= d.MaxSubdomains {
+			names[name] = struct{}{}
+		}
+		if len(names) > d.MaxSubdomains {
+			det.Reason = "many subdomains"
+		}
+	}
+	if qtype := q.Req.Question[0].Qtype; det.Reason == "" && (qtype == dns.TypeTXT || qtype == dns.TypeNULL) {
+		client := q.Client.String()
+		if d.txt[client]++; d.txt[client] > d.MaxTXT {
+			det.Reason = "many TXT queries"
+		}
+	}
+	if det.Reason == "" {
+		return nil
+	}
+	key := det.Client.String() + " " + zone + " " + det.Reason
+	if d.Alert != nil && !d.alerted[key] {
+		d.alerted[key] = true
+		go d.Alert(det)
+	}
+	return det
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	var h float64
+	for _, c := range counts {
+		p := float64(c) / float64(len(s))
+		h -= p * math.Log2(p)
+	}
+	return h
+}
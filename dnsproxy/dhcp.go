@@ -0,0 +1,95 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ParseDHCPLease returns the name servers (DHCP option 6) of the latest
+// lease of a lease file, as upstream addresses on port 53: of dhclient
+// (option domain-name-servers) or of systemd-networkd and NetworkManager
+// (DNS=).
+func ParseDHCPLease(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var servers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		var list []string
+		switch {
+		case strings.HasPrefix(line, "DNS="):
+			list = strings.Fields(strings.TrimPrefix(line, "DNS="))
+		case strings.HasPrefix(line, "option domain-name-servers "):
+			line = strings.TrimSuffix(strings.TrimPrefix(line, "option domain-name-servers "), ";")
+			list = strings.Split(line, ",")
+		default:
+			continue
+		}
+		// dhclient appends leases, the latest last.
+		servers = servers[:0]
+		for _, ip := range list {
+			ip = strings.TrimSpace(ip)
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("%s: invalid name server %q", path, ip)
+			}
+			servers = append(servers, net.JoinHostPort(ip, "53"))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s: no name server", path)
+	}
+	return servers, nil
+}
+
+// LoadDHCPLeases sets the default upstreams to the name servers of the
+// latest leases of DHCP lease files, e.g. of each interface. Files which
+// cannot be read, e.g. of an interface not connected, are skipped, but the
+// defaults are kept if no name server is left.
+func (p *Proxy) LoadDHCPLeases(paths []string) error {
+	var upstreams []string
+	seen := make(map[string]bool)
+	var first error
+	for _, path := range paths {
+		servers, err := ParseDHCPLease(path)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		for _, s := range servers {
+			if !seen[s] && !p.isSelf("udp", s) {
+				seen[s] = true
+				upstreams = append(upstreams, s)
+			}
+		}
+	}
+	if len(upstreams) == 0 {
+		if first != nil {
+			return first
+		}
+		return fmt.Errorf("%s: no name server but the proxy itself", strings.Join(paths, ", "))
+	}
+	p.SetDefault(upstreams)
+	return nil
+}
+
+// WatchDHCPLeases loads DHCP lease files again with LoadDHCPLeases when
+// they are modified, e.g. on a new network, checking every interval until
+// stop is closed. Errors are logged, and the previous defaults kept.
+func (p *Proxy) WatchDHCPLeases(paths []string, interval time.Duration, stop <-chan struct{}) {
+	p.watchFiles(paths, interval, stop, func() error {
+		return p.LoadDHCPLeases(paths)
+	})
+}
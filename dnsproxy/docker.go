@@ -0,0 +1,213 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Docker answers A and AAAA queries for the names of running containers
+// under Domain, from the addresses of their networks. Containers are known
+// by their name, their compose service and their network aliases, e.g.
+// web.docker. for a container named web with Domain "docker.".
+type Docker struct {
+	// Socket is the path of the unix socket of the Docker API.
+	Socket string
+	// Domain under which containers are named.
+	Domain string
+	// TTL of the answers.
+	TTL uint32
+	// ErrorLog logs errors while watching.
+	// If nil, the standard logger is used.
+	ErrorLog *log.Logger
+
+	mu    sync.RWMutex
+	hosts map[string][]net.IP // fully qualified lower case name to addresses
+}
+
+// NewDocker returns a Docker naming containers under domain, from the
+// default Docker socket.
+func NewDocker(domain string) *Docker {
+	return &Docker{Socket: "/var/run/docker.sock", Domain: dns.Fqdn(strings.ToLower(domain)), TTL: 5}
+}
+
+// Stage is the middleware answering queries under the domain, for the
+// chain of a proxy. Other queries, and queries already routed by a policy,
+// are passed on.
+func (d *Docker) Stage(next Handler) Handler {
+	return func(q *Query) {
+		name := strings.ToLower(q.Name)
+		if q.Upstream != "" || !dns.IsSubDomain(d.Domain, name) {
+			next(q)
+			return
+		}
+		d.mu.RLock()
+		ips, ok := d.hosts[name]
+		d.mu.RUnlock()
+		m := new(dns.Msg)
+		m.SetReply(q.Req)
+		m.Authoritative = true
+		if !ok {
+			m.Rcode = dns.RcodeNameError
+			q.W.WriteMsg(m)
+			return
+		}
+		qtype := q.Req.Question[0].Qtype
+		for _, ip := range ips {
+			hdr := dns.RR_Header{Name: q.Req.Question[0].Name, Class: dns.ClassINET, Ttl: d.TTL}
+			switch ip4 := ip.To4(); {
+			case ip4 != nil && qtype == dns.TypeA:
+				hdr.Rrtype = dns.TypeA
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+			case ip4 == nil && qtype == dns.TypeAAAA:
+				hdr.Rrtype = dns.TypeAAAA
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		q.W.WriteMsg(m)
+	}
+}
+
+// Watch keeps the names up to date with the events of the Docker API
+// until stop is closed. Errors are retried after a delay, keeping the
+// last known names.
+func (d *Docker) Watch(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", d.Socket)
+		},
+	}}
+	for {
+		if err := d.watch(ctx, client); err != nil && ctx.Err() == nil {
+			d.logf("docker: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// watch follows events, refreshing the names at first and on every
+// container or network event, until the stream of events ends.
+func (d *Docker) watch(ctx context.Context, client *http.Client) error {
+	filters, err := json.Marshal(map[string][]string{"type": {"container", "network"}})
+	if err != nil {
+		return err
+	}
+	resp, err := d.get(ctx, client, "/events?"+url.Values{"filters": {string(filters)}}.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Events are only streamed once subscribed, so refreshing afterwards
+	// does not miss any change.
+	if err := d.refresh(ctx, client); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event json.RawMessage
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		if err := d.refresh(ctx, client); err != nil {
+			return err
+		}
+	}
+}
+
+// refresh lists the running containers and replaces the names.
+func (d *Docker) refresh(ctx context.Context, client *http.Client) error {
+	resp, err := d.get(ctx, client, "/containers/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var containers []struct {
+		Names           []string
+		Labels          map[string]string
+		NetworkSettings struct {
+			Networks map[string]struct {
+				Aliases           []string
+				IPAddress         string
+				GlobalIPv6Address string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+	hosts := make(map[string][]net.IP)
+	for _, c := range containers {
+		var ips []net.IP
+		names := append([]string(nil), c.Names...)
+		if s := c.Labels["com.docker.compose.service"]; s != "" {
+			names = append(names, s)
+		}
+		for _, n := range c.NetworkSettings.Networks {
+			for _, s := range []string{n.IPAddress, n.GlobalIPv6Address} {
+				if ip := net.ParseIP(s); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+			names = append(names, n.Aliases...)
+		}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimPrefix(name, "/"))
+			if _, ok := dns.IsDomainName(name); !ok || name == "" {
+				continue
+			}
+			fqdn := dns.Fqdn(name) + d.Domain
+			hosts[fqdn] = append(hosts[fqdn], ips...)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hosts = hosts
+	return nil
+}
+
+func (d *Docker) get(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (d *Docker) logf(format string, v ...interface{}) {
+	if d.ErrorLog != nil {
+		d.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,145 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohTimeout bounds a query to a DNS over HTTPS upstream.
+const dohTimeout = 5 * time.Second
+
+// dohJSONScheme is the scheme of the URLs of DNS over HTTPS upstreams only
+// serving the JSON API of Google and Cloudflare, e.g.
+// json://dns.google/resolve for https://dns.google/resolve.
+const dohJSONScheme = "json"
+
+// isDoH reports whether an upstream is a DNS over HTTPS URL, of the JSON
+// API or not.
+func isDoH(upstream string) bool {
+	return strings.HasPrefix(upstream, "https://") || strings.HasPrefix(upstream, dohJSONScheme+"://")
+}
+
+// validDoH reports whether s is a valid DNS over HTTPS URL.
+func validDoH(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == dohJSONScheme) && u.Host != ""
+}
+
+// exchangeDoH sends req to a DNS over HTTPS upstream (RFC 8484).
+func (p *Proxy) exchangeDoH(q *Query, req *dns.Msg) (*dns.Msg, error) {
+	if strings.HasPrefix(q.Upstream, dohJSONScheme+"://") {
+		return p.exchangeDoHJSON(q, req)
+	}
+	// The ID is zero for the sake of HTTP caches.
+	m := req.Copy()
+	m.Id = 0
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dohTimeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, "POST", q.Upstream, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", dohMediaType)
+	hreq.Header.Set("Accept", dohMediaType)
+	client, err := p.dohClient(q)
+	if err != nil {
+		return nil, err
+	}
+	hresp, err := client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", q.Upstream, hresp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	// Check the ID here since it is not the one of req.
+	if resp.Id != m.Id {
+		return nil, fmt.Errorf("%w: id %d, want %d", errMismatch, resp.Id, m.Id)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// ValidDoHProxy reports whether s is a valid URL of a proxy for DoHProxy:
+// http://, https:// or socks5://, with a host.
+func ValidDoHProxy(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return true
+	}
+	return false
+}
+
+// dohClient returns the HTTP client for the DoH upstream of a query,
+// going through the SOCKS5 proxy of its route or of the proxy if any,
+// else the DoHProxy of the proxy, else the proxy of the environment, and
+// from its source address. Clients are kept to reuse their connections,
+// each upstream with TLSPins having its own.
+func (p *Proxy) dohClient(q *Query) (*http.Client, error) {
+	via := p.DoHProxy
+	if s := p.socks5(q); s != "" {
+		via = "socks5://" + s
+	}
+	key := via
+	if ip := p.sourceIP(q); ip != nil {
+		key += " from " + ip.String()
+	}
+	var host string
+	if u, err := url.Parse(q.Upstream); err == nil {
+		host = u.Hostname()
+	}
+	pinned := len(p.TLSPins[strings.ToLower(host)]) > 0
+	if pinned {
+		key += " to " + host
+	}
+	p.dohMu.Lock()
+	defer p.dohMu.Unlock()
+	if c, ok := p.dohClients[key]; ok {
+		return c, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	d := p.netDialer(q, "tcp")
+	d.Resolver = p.resolver()
+	t.DialContext = d.DialContext
+	if pinned {
+		t.TLSClientConfig = p.upstreamTLSConfig(host)
+	}
+	if via != "" {
+		u, err := url.Parse(via)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	c := &http.Client{Transport: t}
+	if p.dohClients == nil {
+		p.dohClients = make(map[string]*http.Client)
+	}
+	p.dohClients[key] = c
+	return c, nil
+}
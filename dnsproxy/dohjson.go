@@ -0,0 +1,225 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsJSONMediaType is the media type of the JSON API of Google and
+// Cloudflare.
+const dnsJSONMediaType = "application/dns-json"
+
+// dnsJSON is a response of the JSON API of Google and Cloudflare.
+type dnsJSON struct {
+	Status     int               `json:"Status"`
+	TC         bool              `json:"TC"`
+	RD         bool              `json:"RD"`
+	RA         bool              `json:"RA"`
+	AD         bool              `json:"AD"`
+	CD         bool              `json:"CD"`
+	Question   []dnsJSONQuestion `json:"Question"`
+	Answer     []dnsJSONRR       `json:"Answer,omitempty"`
+	Authority  []dnsJSONRR       `json:"Authority,omitempty"`
+	Additional []dnsJSONRR       `json:"Additional,omitempty"`
+	Comment    string            `json:"Comment,omitempty"`
+}
+
+type dnsJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dnsJSONRR is a record, its data in presentation format.
+type dnsJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonRRs returns records as in the JSON API, without the OPT record.
+func jsonRRs(rrs []dns.RR) []dnsJSONRR {
+	var list []dnsJSONRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		list = append(list, dnsJSONRR{Name: h.Name, Type: h.Rrtype, TTL: h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String())})
+	}
+	return list
+}
+
+// parseQType parses the type of a query of the JSON API, by name or number,
+// A if empty.
+func parseQType(s string) (uint16, bool) {
+	if s == "" {
+		return dns.TypeA, true
+	}
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(n), true
+	}
+	t, ok := dns.StringToType[strings.ToUpper(s)]
+	return t, ok
+}
+
+// answerJSON answers a query of the JSON API of Google and Cloudflare,
+// name=example.com&type=AAAA, with &do=1 to ask for DNSSEC records and
+// &cd=1 to disable validation, through the chain of the proxy as over DoH.
+func (p *Proxy) answerJSON(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	name := v.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	qtype, ok := parseQType(v.Get("type"))
+	if !ok {
+		http.Error(w, "invalid type", http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = jsonFlag(v.Get("cd"))
+	if jsonFlag(v.Get("do")) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	rw := p.serveHTTPQuery(r, req)
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusBadGateway)
+		return
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rw.msg); err != nil {
+		http.Error(w, "invalid response", http.StatusBadGateway)
+		return
+	}
+	j := &dnsJSON{
+		Status:     resp.Rcode,
+		TC:         resp.Truncated,
+		RD:         resp.RecursionDesired,
+		RA:         resp.RecursionAvailable,
+		AD:         resp.AuthenticatedData,
+		CD:         resp.CheckingDisabled,
+		Answer:     jsonRRs(resp.Answer),
+		Authority:  jsonRRs(resp.Ns),
+		Additional: jsonRRs(resp.Extra),
+	}
+	for _, q := range resp.Question {
+		j.Question = append(j.Question, dnsJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	w.Header().Set("Content-Type", dnsJSONMediaType)
+	if ttl, ok := cacheTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	json.NewEncoder(w).Encode(j)
+}
+
+// jsonFlag reports whether a flag of the JSON API is set: 1 or true.
+func jsonFlag(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
+
+// exchangeDoHJSON sends req to a DNS over HTTPS upstream only serving the
+// JSON API, translating it to a GET request and the JSON response back.
+func (p *Proxy) exchangeDoHJSON(q *Query, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, errors.New("JSON API upstreams take one question")
+	}
+	u, err := url.Parse("https" + strings.TrimPrefix(q.Upstream, dohJSONScheme))
+	if err != nil {
+		return nil, err
+	}
+	question := req.Question[0]
+	v := u.Query()
+	v.Set("name", question.Name)
+	v.Set("type", strconv.Itoa(int(question.Qtype)))
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		v.Set("do", "1")
+	}
+	if req.CheckingDisabled {
+		v.Set("cd", "1")
+	}
+	u.RawQuery = v.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), dohTimeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Accept", dnsJSONMediaType)
+	client, err := p.dohClient(q)
+	if err != nil {
+		return nil, err
+	}
+	hresp, err := client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", q.Upstream, hresp.Status)
+	}
+	var j dnsJSON
+	if err := json.NewDecoder(io.LimitReader(hresp.Body, dns.MaxMsgSize*4)).Decode(&j); err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(req, j.Status)
+	resp.Truncated, resp.RecursionAvailable = j.TC, j.RA
+	resp.AuthenticatedData, resp.CheckingDisabled = j.AD, j.CD
+	for _, section := range []struct {
+		rrs  []dnsJSONRR
+		dest *[]dns.RR
+	}{{j.Answer, &resp.Answer}, {j.Authority, &resp.Ns}, {j.Additional, &resp.Extra}} {
+		for _, r := range section.rrs {
+			rr, err := jsonRR(r)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid record: %v", q.Upstream, err)
+			}
+			if rr != nil {
+				*section.dest = append(*section.dest, rr)
+			}
+		}
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return resp, nil
+}
+
+// jsonRR returns the record of the JSON API. The text of TXT and SPF
+// records is unquoted by some servers, e.g. Google, which would be split on
+// spaces and cut at a semicolon (comment) as a zone file record: such text
+// is taken as is, in strings of 255 bytes.
+func jsonRR(r dnsJSONRR) (dns.RR, error) {
+	hdr := dns.RR_Header{Name: dns.Fqdn(r.Name), Rrtype: r.Type, Class: dns.ClassINET, Ttl: r.TTL}
+	if (r.Type == dns.TypeTXT || r.Type == dns.TypeSPF) && !strings.HasPrefix(r.Data, `"`) {
+		var txt []string
+		for s := r.Data; ; s = s[255:] {
+			if len(s) <= 255 {
+				txt = append(txt, s)
+				break
+			}
+			txt = append(txt, s[:255])
+		}
+		if r.Type == dns.TypeSPF {
+			return &dns.SPF{Hdr: hdr, Txt: txt}, nil
+		}
+		return &dns.TXT{Hdr: hdr, Txt: txt}, nil
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, r.TTL, dns.Type(r.Type), r.Data))
+}
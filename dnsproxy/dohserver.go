@@ -0,0 +1,329 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of DNS messages over HTTPS.
+const dohMediaType = "application/dns-message"
+
+// maxDoHMessage is the maximum size of a DNS message over HTTPS.
+const maxDoHMessage = 65535
+
+// DoHHandler returns an HTTP handler answering DNS over HTTPS queries
+// (RFC 8484) sent with GET or POST through the chain of the proxy, whatever
+// their path: mount it on the paths to serve, e.g. /dns-query. Queries are
+// forwarded as if they came over TCP from the HTTP client. Responses can be
+// cached by HTTP caches for their lowest TTL. GET requests with a name
+// parameter rather than dns are answered in JSON (application/dns-json) as
+// by the APIs of Google (/resolve) and Cloudflare, for scripts.
+func (p *Proxy) DoHHandler() http.Handler {
+	return http.HandlerFunc(p.serveDoH)
+}
+
+func (p *Proxy) serveDoH(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("dns") == "" && r.URL.Query().Get("name") != "" {
+			p.answerJSON(w, r)
+			return
+		}
+		// The query is the dns parameter, in unpadded base64url.
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(query) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		p.answerDoH(w, r, query)
+		return
+	case "POST":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != dohMediaType {
+		http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDoHMessage+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxDoHMessage {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	p.answerDoH(w, r, body)
+}
+
+// answerDoH answers a packed query of an HTTP request.
+func (p *Proxy) answerDoH(w http.ResponseWriter, r *http.Request, query []byte) {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	rw := p.serveHTTPQuery(r, req)
+	if rw.msg == nil {
+		// Dropped, e.g. by a fault or a policy zone.
+		http.Error(w, "no response", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rw.msg); err == nil {
+		if ttl, ok := cacheTTL(resp); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl/time.Second)))
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	w.Write(rw.msg)
+}
+
+// serveHTTPQuery answers a query of an HTTP request through the chain of the
+// proxy, as if it came over TCP from the HTTP client, and returns the
+// writer of its response.
+func (p *Proxy) serveHTTPQuery(r *http.Request, req *dns.Msg) *dohResponseWriter {
+	rw := &dohResponseWriter{remote: tcpAddr(r.RemoteAddr), tls: r.TLS, http3: r.ProtoMajor == 3}
+	rw.identity, _ = r.Context().Value(identityKey{}).(string)
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.local = a
+	}
+	p.ServeDNS(rw, req)
+	p.stats.listenerBytes(rw.transport(), req.Len(), len(rw.msg))
+	return rw
+}
+
+// tcpAddr returns the TCP address of a host:port, or nil if invalid.
+func tcpAddr(hostport string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: n}
+}
+
+// dohResponseWriter is the dns.ResponseWriter of a DNS over HTTPS query,
+// keeping the response to write it in the HTTP response.
+type dohResponseWriter struct {
+	local    net.Addr
+	remote   *net.TCPAddr
+	tls      *tls.ConnectionState // nil over plain HTTP
+	identity string               // authenticated user, if any
+	http3    bool
+	msg      []byte // packed response, nil until written
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	if w.local == nil {
+		return &net.TCPAddr{}
+	}
+	return w.local
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	if w.remote == nil {
+		return &net.TCPAddr{}
+	}
+	return w.remote
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.msg = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// transport returns the transport of the query, ListenerDoH or ListenerDoH3.
+func (w *dohResponseWriter) transport() string {
+	if w.http3 {
+		return ListenerDoH3
+	}
+	return ListenerDoH
+}
+
+// ConnectionState implements dns.ConnectionStater.
+func (w *dohResponseWriter) ConnectionState() *tls.ConnectionState { return w.tls }
+
+// Identity returns the user authenticated, which becomes the Identity of
+// the query.
+func (w *dohResponseWriter) Identity() string { return w.identity }
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// identityKey is the key of the user authenticated in the context of a
+// request.
+type identityKey struct{}
+
+// withIdentity returns a request of the user authenticated.
+func withIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// BasicAuth returns a handler requiring the credentials of one of users
+// (name to password) with HTTP basic authentication before calling h, e.g.
+// to restrict the DoH path of a tenant to its clients. The name becomes
+// the Identity of the queries.
+func BasicAuth(h http.Handler, users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		want, known := users[user]
+		if !ok || !known || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dns"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, withIdentity(r, user))
+	})
+}
+
+// TokenAuth returns a handler requiring one of tokens (token to identity)
+// before calling h, sent as a bearer token (Authorization header) or as
+// the rest of the path after prefix, e.g. /dns-query/TOKEN for clients
+// which cannot set headers. The identity of the token becomes the
+// Identity of the queries.
+func TokenAuth(h http.Handler, tokens map[string]string, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			token = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		}
+		var identity string
+		for t, id := range tokens {
+			// Compare all tokens in constant time, not to leak them.
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				identity = id
+			}
+		}
+		if token == "" || identity == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dns"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, withIdentity(r, identity))
+	})
+}
+
+// LoadTokens reads the tokens of TokenAuth from a file of lines of an
+// identity and its token, separated by spaces. Empty lines and lines
+// starting with # are ignored.
+func LoadTokens(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected identity and token", path, n+1)
+		}
+		if _, ok := tokens[f[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, n+1)
+		}
+		tokens[f[1]] = f[0]
+	}
+	return tokens, nil
+}
+
+// CheckDoHPaths returns an error if the paths of a DoH server are invalid
+// or served twice: path, /resolve, path/ if tokens can be sent in it, and
+// those of the tenants.
+func CheckDoHPaths(path string, tokens bool, tenants []*Tenant) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	used := map[string]string{path: "the DoH path", "/resolve": "the JSON API"}
+	if tokens && !strings.HasSuffix(path, "/") {
+		used[path+"/"] = "the DoH path (tokens in the path)"
+	}
+	for _, t := range tenants {
+		if t.DoHPath == "" {
+			continue
+		}
+		if by, ok := used[t.DoHPath]; ok {
+			return fmt.Errorf("tenant %s: doh-path %q already served by %s", t.Name, t.DoHPath, by)
+		}
+		used[t.DoHPath] = "tenant " + t.Name
+	}
+	return nil
+}
+
+// DoHMux returns the handler of a DoH server: the proxy on path and on
+// /resolve (the JSON API), restricted to users (name to password) or to
+// tokens (see TokenAuth) if not empty, and the tenants on their DoHPath,
+// with their proxies of StartTenants.
+func (p *Proxy) DoHMux(path string, users, tokens map[string]string, tenants []*Tenant, proxies []*Proxy) (http.Handler, error) {
+	if len(users) > 0 && len(tokens) > 0 {
+		return nil, errors.New("users and tokens cannot be used together")
+	}
+	if err := CheckDoHPaths(path, len(tokens) > 0, tenants); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	h := p.DoHHandler()
+	if len(users) > 0 {
+		h = BasicAuth(h, users)
+	}
+	resolve := h
+	if len(tokens) > 0 {
+		resolve = TokenAuth(h, tokens, "/resolve")
+		h = TokenAuth(h, tokens, path)
+		if !strings.HasSuffix(path, "/") {
+			// Tokens can also be sent in the path.
+			mux.Handle(path+"/", h)
+		}
+	}
+	mux.Handle(path, h)
+	if path != "/resolve" {
+		// The JSON API, also on the DoH path, where Google serves it.
+		mux.Handle("/resolve", resolve)
+	}
+	for i, t := range tenants {
+		if t.DoHPath == "" {
+			continue
+		}
+		h := proxies[i].DoHHandler()
+		if len(t.DoHUsers) > 0 {
+			h = BasicAuth(h, t.DoHUsers)
+		}
+		mux.Handle(t.DoHPath, h)
+	}
+	return mux, nil
+}
@@ -0,0 +1,120 @@
+package dnsproxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseEDNSOptions parses a + separated list of EDNS options of the form
+// code:hex, e.g. 65001:c0ffee, the value possibly empty.
+func parseEDNSOptions(s string) ([]*dns.EDNS0_LOCAL, error) {
+	var opts []*dns.EDNS0_LOCAL
+	for _, o := range strings.Split(s, "+") {
+		kv := strings.SplitN(o, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid EDNS option %q, must be code:hex", o)
+		}
+		code, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EDNS option code %q", kv[0])
+		}
+		data, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid EDNS option value %q, must be hex", kv[1])
+		}
+		opts = append(opts, &dns.EDNS0_LOCAL{Code: uint16(code), Data: data})
+	}
+	return opts, nil
+}
+
+// parseEDNSCodes parses a + separated list of EDNS option codes.
+func parseEDNSCodes(s string) ([]uint16, error) {
+	var codes []uint16
+	for _, c := range strings.Split(s, "+") {
+		code, err := strconv.ParseUint(c, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EDNS option code %q", c)
+		}
+		codes = append(codes, uint16(code))
+	}
+	return codes, nil
+}
+
+// routeEDNS returns a copy of req without the EDNS options stripped by a
+// route and with the ones it adds, replacing those of the same code, or req
+// itself if the route has none.
+func routeEDNS(r *Route, req *dns.Msg) *dns.Msg {
+	if r == nil || len(r.EDNS) == 0 && len(r.StripEDNS) == 0 {
+		return req
+	}
+	req = req.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		if len(r.EDNS) == 0 {
+			return req
+		}
+		// Responses must still fit the client without EDNS.
+		req.SetEdns0(dns.MinMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if !containsCode(r.StripEDNS, o.Option()) && !containsOption(r.EDNS, o.Option()) {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+	for _, o := range r.EDNS {
+		opt.Option = append(opt.Option, o)
+	}
+	return req
+}
+
+// unrouteEDNS removes from a response the EDNS options a route added to its
+// query, should the upstream echo them, and the OPT record unless the query
+// of the client had one.
+func unrouteEDNS(r *Route, resp *dns.Msg, edns bool) {
+	if r == nil || len(r.EDNS) == 0 {
+		return
+	}
+	for i, rr := range resp.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		if !edns {
+			resp.Extra = append(resp.Extra[:i], resp.Extra[i+1:]...)
+			return
+		}
+		kept := opt.Option[:0]
+		for _, o := range opt.Option {
+			if !containsOption(r.EDNS, o.Option()) {
+				kept = append(kept, o)
+			}
+		}
+		opt.Option = kept
+		return
+	}
+}
+
+func containsCode(codes []uint16, code uint16) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOption(opts []*dns.EDNS0_LOCAL, code uint16) bool {
+	for _, o := range opts {
+		if o.Code == code {
+			return true
+		}
+	}
+	return false
+}
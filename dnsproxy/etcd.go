@@ -0,0 +1,218 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Etcd loads routes from the keys under a prefix of an etcd v3 cluster,
+// through its JSON gateway. Each value is a route as parsed by ParseRoute,
+// keys only serve to identify routes, e.g.
+//
+//	/dns-reverse-proxy/routes/corp = .corp.=10.0.0.53:53;clients=10.0.0.0/8
+type Etcd struct {
+	// Endpoint is the URL of an etcd member, e.g. "http://127.0.0.1:2379".
+	Endpoint string
+	// Prefix of the keys holding routes.
+	Prefix string
+	// Client to make requests with, http.DefaultClient if nil.
+	Client *http.Client
+	// ErrorLog logs invalid routes and errors while watching.
+	// If nil, the standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// Routes returns the routes stored under the prefix.
+// An invalid route fails the whole table.
+func (e *Etcd) Routes(ctx context.Context) ([]*Route, error) {
+	routes, _, err := e.load(ctx)
+	return routes, err
+}
+
+// load returns the routes stored under the prefix and the revision of the
+// cluster they were read at, which is also set when a route is invalid.
+func (e *Etcd) load(ctx context.Context) ([]*Route, int64, error) {
+	var resp struct {
+		Header struct {
+			Revision string
+		}
+		Kvs []struct {
+			Key, Value []byte
+		}
+	}
+	err := e.call(ctx, "/v3/kv/range", map[string]interface{}{
+		"key":       []byte(e.Prefix),
+		"range_end": prefixEnd(e.Prefix),
+	}, &resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	rev, err := strconv.ParseInt(resp.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd: invalid revision: %v", err)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0
+	})
+	var routes []*Route
+	for _, kv := range resp.Kvs {
+		r, err := ParseRoute(strings.TrimSpace(string(kv.Value)))
+		if err == nil && r.ConsulService != "" {
+			err = errors.New("consul upstreams are not supported from etcd")
+		}
+		if err != nil {
+			return nil, rev, fmt.Errorf("etcd: key %s: %v", kv.Key, err)
+		}
+		routes = append(routes, r)
+	}
+	return routes, rev, nil
+}
+
+// Watch calls apply with the whole route table each time a key under the
+// prefix changes, until stop is closed. Tables with an invalid route are
+// not applied, so the last valid one stays in place. Errors are retried
+// after a delay.
+func (e *Etcd) Watch(apply func([]*Route), stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var rev int64
+	for {
+		routes, next, err := e.load(ctx)
+		switch {
+		case err != nil:
+			e.logf("%v", err)
+		case next != rev:
+			apply(routes)
+		}
+		if next != 0 {
+			rev = next
+		}
+		if rev != 0 {
+			if err := e.wait(ctx, rev); err != nil && ctx.Err() == nil {
+				e.logf("etcd: watch: %v", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// wait blocks until a key under the prefix changes after revision rev.
+func (e *Etcd) wait(ctx context.Context, rev int64) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(e.Prefix),
+			"range_end":      prefixEnd(e.Prefix),
+			"start_revision": strconv.FormatInt(rev+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.post(ctx, "/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The watch streams one JSON object per response, the first one only
+	// confirms its creation.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled bool
+				Events   []json.RawMessage
+			}
+			Error *struct {
+				Message string
+			}
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != nil:
+			return errors.New(msg.Error.Message)
+		case msg.Result.Canceled:
+			return errors.New("canceled")
+		case len(msg.Result.Events) > 0:
+			return nil
+		}
+	}
+}
+
+func (e *Etcd) call(ctx context.Context, path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := e.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return fmt.Errorf("etcd: %v", err)
+	}
+	return nil
+}
+
+func (e *Etcd) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(e.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (e *Etcd) logf(format string, v ...interface{}) {
+	if e.ErrorLog != nil {
+		e.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,353 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout bounds connecting to an upstream, TLS handshake included.
+const dialTimeout = 5 * time.Second
+
+// upstreamSchemes maps the prefixes of upstream addresses to networks.
+var upstreamSchemes = map[string]string{"tcp://": "tcp", "tls://": "tcp-tls"}
+
+// ValidUpstream reports whether s is a valid upstream address: host:port,
+// queried with the transport the client used, tcp://host:port for TCP
+// only, tls://host:port for DNS over TLS, an https:// URL for DNS over
+// HTTPS, a json:// URL for the JSON API of Google and Cloudflare over
+// HTTPS, or Recursive.
+func ValidUpstream(s string) bool {
+	if s == Recursive {
+		return true
+	}
+	if isDoH(s) {
+		return validDoH(s)
+	}
+	_, addr := parseUpstream(s)
+	return ValidHostPort(addr)
+}
+
+// parseUpstream returns the network ("" to follow the client, "tcp" or
+// "tcp-tls") and the host:port of an upstream.
+func parseUpstream(s string) (network, addr string) {
+	for scheme, network := range upstreamSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return network, strings.TrimPrefix(s, scheme)
+		}
+	}
+	return "", s
+}
+
+// Exchange sends req to an upstream as the proxy would for a query
+// matching no route, over UDP unless the upstream says otherwise, and
+// returns its response.
+func (p *Proxy) Exchange(upstream string, req *dns.Msg) (*dns.Msg, error) {
+	q := &Query{Req: req, Upstream: upstream, Time: time.Now()}
+	if len(req.Question) > 0 {
+		q.Name = req.Question[0].Name
+	}
+	return p.exchange(q, req)
+}
+
+// exchangeRetries is how many times a query is sent again when the
+// response of the upstream does not match it.
+const exchangeRetries = 2
+
+// errMismatch is the error of a response which does not match its query.
+var errMismatch = errors.New("response does not match query")
+
+// exchange sends req to the upstream of a query and returns its response,
+// retrying when the response does not match req.
+func (p *Proxy) exchange(q *Query, req *dns.Msg) (*dns.Msg, error) {
+	for i := 0; ; i++ {
+		resp, err := p.exchangeOnce(q, req)
+		if err == dns.ErrId {
+			err = fmt.Errorf("%w: id", errMismatch)
+		}
+		if err == nil {
+			err = checkResponse(req, resp)
+		}
+		if err == nil || !errors.Is(err, errMismatch) || i == exchangeRetries {
+			return resp, err
+		}
+		p.logf("%s: %v, retrying", q.Upstream, err)
+	}
+}
+
+// checkResponse returns an error wrapping errMismatch unless resp is a
+// response to req: same ID, QR bit set and same question.
+func checkResponse(req, resp *dns.Msg) error {
+	switch {
+	case resp.Id != req.Id:
+		return fmt.Errorf("%w: id %d, want %d", errMismatch, resp.Id, req.Id)
+	case !resp.Response:
+		return fmt.Errorf("%w: not a response", errMismatch)
+	case len(resp.Question) != len(req.Question):
+		return fmt.Errorf("%w: %d questions, want %d", errMismatch, len(resp.Question), len(req.Question))
+	}
+	for i, q := range req.Question {
+		r := resp.Question[i]
+		if !strings.EqualFold(r.Name, q.Name) || r.Qtype != q.Qtype || r.Qclass != q.Qclass {
+			return fmt.Errorf("%w: question %s, want %s", errMismatch, r.String(), q.String())
+		}
+	}
+	return nil
+}
+
+// exchangeOnce sends req to the upstream of a query and returns its
+// response, unchecked.
+func (p *Proxy) exchangeOnce(q *Query, req *dns.Msg) (*dns.Msg, error) {
+	if q.Upstream == Recursive {
+		return p.exchangeRecursive(q, req)
+	}
+	if isDoH(q.Upstream) {
+		return p.exchangeDoH(q, req)
+	}
+	network, addr := parseUpstream(q.Upstream)
+	if network == "" {
+		network = "udp"
+		if overTCP(q) || p.socks5(q) != "" {
+			network = "tcp"
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && net.ParseIP(host) == nil && p.socks5(q) == "" {
+		return p.exchangeHost(q, network, host, port, req)
+	}
+	return p.exchangeAddr(q, network, addr, host, req)
+}
+
+// exchangeAddr sends req over network to the address of an upstream,
+// verifying the certificate of serverName over TLS, and returns its
+// response, unchecked.
+func (p *Proxy) exchangeAddr(q *Query, network, addr, serverName string, req *dns.Msg) (*dns.Msg, error) {
+	if p.socks5(q) == "" && p.isSelf(network, addr) {
+		return nil, errLoop
+	}
+	if p.UpstreamKeepalive && network != "udp" {
+		return p.exchangeReused(q, network, addr, serverName, req)
+	}
+	conn, err := p.dial(q, network, addr, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := &dns.Client{Net: network}
+	resp, _, err := c.ExchangeWithConn(req, conn)
+	return resp, err
+}
+
+// overTCP reports whether the client of a query sent it over TCP, false
+// for queries of the proxy itself.
+func overTCP(q *Query) bool {
+	if q.W == nil {
+		return false
+	}
+	_, ok := q.W.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
+// transfer proxies a zone transfer, which clients must make over TCP and
+// neither DNS over HTTPS upstreams nor Recursive can serve, within MaxTransfers, TransferRate
+// and MaxTransferSize.
+func (p *Proxy) transfer(q *Query) {
+	if !overTCP(q) {
+		p.deny(q)
+		return
+	}
+	if isDoH(q.Upstream) || q.Upstream == Recursive {
+		dns.HandleFailed(q.W, q.Req)
+		return
+	}
+	var client string
+	if q.Client != nil {
+		client = q.Client.String()
+	}
+	if !p.startTransfer() {
+		p.debugf(q, "refused, %d transfers in progress", p.MaxTransfers)
+		p.stats.transfer(client, 0, transferRejected)
+		reply(q.W, q.Req, dns.RcodeRefused)
+		return
+	}
+	defer p.endTransfer()
+	network, addr := parseUpstream(q.Upstream)
+	if network == "" {
+		network = "tcp"
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	conn, err := p.dial(q, network, addr, host)
+	if err != nil {
+		dns.HandleFailed(q.W, q.Req)
+		return
+	}
+	defer conn.Close()
+	t := &dns.Transfer{Conn: conn}
+	c, err := t.In(q.Req, addr)
+	if err != nil {
+		dns.HandleFailed(q.W, q.Req)
+		return
+	}
+	// On failure, closing the connection ends the transfer in, which must
+	// still be drained.
+	defer func() {
+		conn.Close()
+		for range c {
+		}
+	}()
+	start := time.Now()
+	var size int64
+	for e := range c {
+		if e.Error != nil {
+			if size == 0 {
+				dns.HandleFailed(q.W, q.Req)
+			}
+			p.stats.transfer(client, size, transferFailed)
+			return
+		}
+		for _, rr := range e.RR {
+			size += int64(dns.Len(rr))
+		}
+		if p.MaxTransferSize > 0 && size > p.MaxTransferSize {
+			p.logf("aborted transfer of %s to %s: more than %d bytes", q.Name, client, p.MaxTransferSize)
+			p.stats.transfer(client, size, transferAborted)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q.Req)
+		m.Authoritative = true
+		m.Answer = e.RR
+		if err := q.W.WriteMsg(m); err != nil {
+			p.stats.transfer(client, size, transferFailed)
+			return
+		}
+		q.W.TsigTimersOnly(true)
+		if p.TransferRate > 0 {
+			if d := time.Duration(size*int64(time.Second)/p.TransferRate) - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+	p.stats.transfer(client, size, transferDone)
+}
+
+// startTransfer reports whether a transfer can start, counting it, within
+// MaxTransfers. Finished transfers must call endTransfer.
+func (p *Proxy) startTransfer() bool {
+	p.transferMu.Lock()
+	defer p.transferMu.Unlock()
+	if p.MaxTransfers > 0 && p.transfers >= p.MaxTransfers {
+		return false
+	}
+	p.transfers++
+	return true
+}
+
+func (p *Proxy) endTransfer() {
+	p.transferMu.Lock()
+	defer p.transferMu.Unlock()
+	p.transfers--
+}
+
+// dial connects to an upstream for a query over network "udp", "tcp" or
+// "tcp-tls", through the SOCKS5 proxy of its route or of the proxy if any.
+// Over TLS, the certificate must be valid for serverName.
+func (p *Proxy) dial(q *Query, network, addr, serverName string) (*dns.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	transport := network
+	if network == "tcp-tls" {
+		transport = "tcp"
+	}
+	var d proxy.ContextDialer = p.netDialer(q, transport)
+	if s := p.socks5(q); s != "" {
+		var err error
+		if d, err = socks5Dialer(s, p.netDialer(q, "tcp")); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.DialContext(ctx, transport, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp-tls" {
+		tc := tls.Client(conn, p.upstreamTLSConfig(serverName))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// netDialer returns a dialer for network "udp" or "tcp" from the source
+// address of the route of a query or else of the proxy, if any, and the
+// interface of the proxy, if any.
+func (p *Proxy) netDialer(q *Query, network string) *net.Dialer {
+	d := &net.Dialer{}
+	if ip := p.sourceIP(q); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if p.Interface != "" {
+		d.Control = bindToDevice(p.Interface)
+	}
+	return d
+}
+
+// sourceIP returns the local address to send a query from, nil for any.
+func (p *Proxy) sourceIP(q *Query) net.IP {
+	if q.Route != nil && q.Route.Source != nil {
+		return q.Route.Source
+	}
+	return p.SourceIP
+}
+
+// socks5 returns the SOCKS5 proxy to reach the upstream of a query through,
+// empty for none.
+func (p *Proxy) socks5(q *Query) string {
+	if q.Route != nil && q.Route.SOCKS5 != "" {
+		if q.Route.SOCKS5 == "direct" {
+			return ""
+		}
+		return q.Route.SOCKS5
+	}
+	return p.SOCKS5
+}
+
+// socks5Dialer returns a dialer through the SOCKS5 proxy s, of the form
+// [user:password@]host:port, connecting to it with forward.
+func socks5Dialer(s string, forward proxy.Dialer) (proxy.ContextDialer, error) {
+	var auth *proxy.Auth
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user, password, _ := strings.Cut(s[:i], ":")
+		auth = &proxy.Auth{User: user, Password: password}
+		s = s[i+1:]
+	}
+	if !ValidHostPort(s) {
+		return nil, fmt.Errorf("invalid socks5 host:port %q", s)
+	}
+	d, err := proxy.SOCKS5("tcp", s, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer), nil
+}
+
+// ValidSOCKS5 reports whether s is a valid SOCKS5 proxy address of the
+// form [user:password@]host:port.
+func ValidSOCKS5(s string) bool {
+	_, err := socks5Dialer(s, &net.Dialer{})
+	return err == nil
+}
@@ -0,0 +1,115 @@
+package dnsproxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// eyeballsDelay is how long an exchange with an address of an upstream has
+// to succeed before one with its next address starts, the Connection
+// Attempt Delay of Happy Eyeballs (RFC 8305).
+const eyeballsDelay = 250 * time.Millisecond
+
+// familyMemory is how long the address family which answered first for a
+// host is tried first.
+const familyMemory = 10 * time.Minute
+
+// familyChoice is the address family which answered first for a host.
+type familyChoice struct {
+	ipv4    bool
+	expires time.Time
+}
+
+// exchangeHost sends req over network to an upstream given by host name,
+// racing its addresses with Happy Eyeballs (RFC 8305) so that a broken
+// IPv6 path costs eyeballsDelay rather than a timeout: addresses are tried
+// alternating families, from the family which last answered first for the
+// host, else IPv6, each after the previous one failed or had eyeballsDelay
+// to answer. The first response wins.
+func (p *Proxy) exchangeHost(q *Query, network, host, port string, req *dns.Msg) (*dns.Msg, error) {
+	ips, err := p.lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	ips = p.eyeballsOrder(host, ips)
+	type result struct {
+		resp *dns.Msg
+		err  error
+		ip   net.IP
+	}
+	results := make(chan result, len(ips))
+	started := 0
+	var wait <-chan time.Time
+	start := func() {
+		ip, m := ips[started], req.Copy()
+		started++
+		go func() {
+			resp, err := p.exchangeAddr(q, network, net.JoinHostPort(ip.String(), port), host, m)
+			results <- result{resp, err, ip}
+		}()
+		wait = nil
+		if started < len(ips) {
+			wait = time.After(eyeballsDelay)
+		}
+	}
+	start()
+	for done := 0; done < len(ips); {
+		select {
+		case <-wait:
+			start()
+		case r := <-results:
+			done++
+			if r.err == nil {
+				p.rememberFamily(host, r.ip)
+				return r.resp, nil
+			}
+			err = r.err
+			if started < len(ips) {
+				start()
+			}
+		}
+	}
+	return nil, err
+}
+
+// eyeballsOrder returns the addresses of a host alternating families, from
+// the family which last answered first for it, else IPv6.
+func (p *Proxy) eyeballsOrder(host string, ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	p.familyMu.Lock()
+	if c, ok := p.families[host]; ok && c.ipv4 && time.Now().Before(c.expires) {
+		first, second = v4, v6
+	}
+	p.familyMu.Unlock()
+	var ordered []net.IP
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// rememberFamily records the family of the address which answered first
+// for a host.
+func (p *Proxy) rememberFamily(host string, ip net.IP) {
+	p.familyMu.Lock()
+	defer p.familyMu.Unlock()
+	if p.families == nil {
+		p.families = make(map[string]familyChoice)
+	}
+	p.families[host] = familyChoice{ipv4: ip.To4() != nil, expires: time.Now().Add(familyMemory)}
+}
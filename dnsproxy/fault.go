@@ -0,0 +1,121 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Fault is injected in the queries matched by its rule, for clients to
+// test how they handle failures of their resolver: Percent of the queries
+// are delayed by Delay, then get Action.
+type Fault struct {
+	Rule
+	// Action is "servfail" to answer SERVFAIL, "truncate" to answer an
+	// empty truncated response, "drop" not to answer, or "delay" to pass
+	// the query on after the delay.
+	Action  string
+	Delay   time.Duration
+	Percent float64
+
+	spec string // as parsed
+}
+
+// faultActions are the valid actions of faults.
+var faultActions = map[string]bool{"servfail": true, "truncate": true, "drop": true, "delay": true}
+
+// String returns the fault as parsed.
+func (f *Fault) String() string { return f.spec }
+
+// ParseFault parses a fault of the form domain=action[;option=value...],
+// with the same options as ParseRule, delay=duration (e.g. 500ms) and
+// percent=N of the matching queries, 100 by default.
+func ParseFault(s string) (*Fault, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return nil, errors.New("must be domain=action")
+	}
+	opts := strings.Split(kv[1], ";")
+	if !faultActions[opts[0]] {
+		return nil, fmt.Errorf("invalid action %q, must be servfail, truncate, drop or delay", opts[0])
+	}
+	f := &Fault{Rule: *NewRule(kv[0]), Action: opts[0], Percent: 100, spec: s}
+	var rest []string
+	for _, opt := range opts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		var err error
+		switch {
+		case len(kv) == 2 && kv[0] == "delay":
+			if f.Delay, err = time.ParseDuration(kv[1]); err != nil || f.Delay < 0 {
+				return nil, fmt.Errorf("invalid delay %q", kv[1])
+			}
+		case len(kv) == 2 && kv[0] == "percent":
+			if f.Percent, err = strconv.ParseFloat(kv[1], 64); err != nil || f.Percent < 0 || f.Percent > 100 {
+				return nil, fmt.Errorf("invalid percent %q", kv[1])
+			}
+		default:
+			rest = append(rest, opt)
+		}
+	}
+	if err := f.setOptions(rest); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Faults returns the faults injected.
+func (p *Proxy) Faults() []*Fault {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Fault(nil), p.faults...)
+}
+
+// SetFaults replaces the faults, which are only injected if FaultInjection
+// is set.
+func (p *Proxy) SetFaults(faults []*Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = append([]*Fault(nil), faults...)
+}
+
+// faultStage injects the first fault matching a query, if any.
+func (p *Proxy) faultStage(next Handler) Handler {
+	return func(q *Query) {
+		if !p.FaultInjection {
+			next(q)
+			return
+		}
+		var fault *Fault
+		for _, f := range p.Faults() {
+			if f.MatchQuery(q) {
+				fault = f
+				break
+			}
+		}
+		if fault == nil || rand.Float64()*100 >= fault.Percent {
+			next(q)
+			return
+		}
+		p.debugf(q, "injected fault %s", fault)
+		if !q.DryRun {
+			time.Sleep(fault.Delay)
+		}
+		switch fault.Action {
+		case "servfail":
+			reply(q.W, q.Req, dns.RcodeServerFailure)
+		case "truncate":
+			m := new(dns.Msg)
+			m.SetReply(q.Req)
+			m.Truncated = true
+			q.W.WriteMsg(m)
+		case "drop":
+		default:
+			next(q)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package dnsproxy
+
+import "github.com/miekg/dns"
+
+// Policies of the AD bit of responses, see Proxy.ADPolicy.
+const (
+	// ADPass passes the AD bit of upstreams on to the clients asking for
+	// it, with the AD or DO bit in their queries (RFC 6840).
+	ADPass = "pass"
+	// ADClear clears the AD bit of all responses, for clients not to trust
+	// upstreams whose validation they cannot check.
+	ADClear = "clear"
+)
+
+// flagsStage sets the flags of the responses to queries: RA, since the
+// proxy resolves any name through its upstreams, AD as set by ADPolicy,
+// and TC when they are truncated to what clients over UDP can receive,
+// 512 bytes or the size of their EDNS buffer, whatever the size of the
+// responses of upstreams over TCP. Responses are compressed, and have the
+// edns-tcp-keepalive option for clients asking for it over TCP. Forwarded
+// responses have their AA bit cleared by forward.
+func (p *Proxy) flagsStage(next Handler) Handler {
+	return func(q *Query) {
+		w := &flagsWriter{ResponseWriter: q.W, clearAD: p.ADPolicy == ADClear || !q.Req.AuthenticatedData}
+		opt := q.Req.IsEdns0()
+		if p.TraceEDE && opt != nil {
+			w.traceID, w.opt = q.TraceID, opt
+		}
+		if opt != nil && opt.Do() && p.ADPolicy != ADClear {
+			w.clearAD = false
+		}
+		if overTCP(q) && keepaliveOption(q.Req) != nil {
+			w.p, w.keepalive = p, opt
+		}
+		if !overTCP(q) {
+			w.size = dns.MinMsgSize
+			if opt != nil && int(opt.UDPSize()) > w.size {
+				w.size = int(opt.UDPSize())
+			}
+		}
+		q.W = w
+		next(q)
+	}
+}
+
+// flagsWriter sets the flags of the responses to a query.
+type flagsWriter struct {
+	dns.ResponseWriter
+	clearAD bool
+	size    int      // the client can receive, 0 for any over TCP
+	traceID string   // to add to error responses, see TraceEDE
+	opt     *dns.OPT // of the query
+
+	p         *Proxy
+	keepalive *dns.OPT // of the query, if it asks for edns-tcp-keepalive
+}
+
+func (w *flagsWriter) WriteMsg(m *dns.Msg) error {
+	m.RecursionAvailable = true
+	if w.clearAD {
+		m.AuthenticatedData = false
+	}
+	if w.traceID != "" && m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		addTraceEDE(m, w.opt, w.traceID)
+	}
+	removeKeepalive(m)
+	if w.keepalive != nil {
+		w.p.addKeepalive(m, w.keepalive)
+	}
+	m.Compress = true
+	if w.size > 0 {
+		m.Truncate(w.size)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// addTraceEDE adds an extended error (RFC 8914) with the trace ID of a
+// query as extra text to its response, with an OPT record like the one of
+// the query if it has none.
+func addTraceEDE(m *dns.Msg, opt *dns.OPT, traceID string) {
+	ropt := m.IsEdns0()
+	if ropt == nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		ropt = m.IsEdns0()
+	}
+	ropt.Option = append(ropt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther,
+		ExtraText: "trace " + traceID})
+}
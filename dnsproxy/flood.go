@@ -0,0 +1,258 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Actions of a FloodGuard.
+const (
+	FloodNXDomain  = "nxdomain"  // answer NXDOMAIN with the SOA of the zone
+	FloodRateLimit = "ratelimit" // forward Rate queries per second, SERVFAIL
+)
+
+// maxKnownNames bounds the names a FloodGuard remembers as answered.
+const maxKnownNames = 100000
+
+// A FloodGuard mitigates random subdomain attacks ("water torture") against
+// a zone, which flood its authoritative servers, and the upstreams on the
+// way, with queries for names which do not exist and cannot be cached.
+// When the queries of a zone which missed the cache in a Window are at
+// least MinQueries, mostly answered NXDOMAIN (MinNXRatio) and for
+// different names (MinUniqueRatio of MinQueries), its queries are mitigated
+// for Hold as set by Action, again as long as MinQueries keep coming.
+// Names of the zone already answered are still forwarded. Zones are the
+// owners of the SOA of negative responses, else approximated as the last
+// two labels of names. Create one with NewFloodGuard and add its Stage at
+// the end of the chain (Use), after the cache.
+type FloodGuard struct {
+	Window         time.Duration
+	MinQueries     int
+	MinNXRatio     float64
+	MinUniqueRatio float64
+	Hold           time.Duration
+	// Action is FloodNXDomain to answer the queries of a zone with
+	// NXDOMAIN and its SOA, one synthesized if none was seen, or
+	// FloodRateLimit to forward Rate of them per second and answer the
+	// others SERVFAIL.
+	Action string
+	Rate   int
+	// Alert is called with an EventFlood when a zone is mitigated, if not
+	// nil.
+	Alert func(*Event)
+
+	mu        sync.Mutex
+	start     time.Time             // of the current window
+	zones     map[string]*floodZone // by zone in the current window
+	mitigated map[string]*floodMitigation
+	known     map[string]bool // names answered
+}
+
+// floodZone counts the queries of a zone in a window.
+type floodZone struct {
+	queries, nx int
+	names       map[string]bool
+	soa         *dns.SOA // of the last negative response
+}
+
+// floodMitigation is a zone mitigated.
+type floodMitigation struct {
+	until  time.Time
+	soa    *dns.SOA
+	hits   int       // queries since mitigated or renewed
+	second time.Time // of the queries forwarded at Rate
+	sent   int
+}
+
+// NewFloodGuard returns a flood guard with default thresholds, answering
+// NXDOMAIN.
+func NewFloodGuard() *FloodGuard {
+	return &FloodGuard{
+		Window:         time.Minute,
+		MinQueries:     1000,
+		MinNXRatio:     0.8,
+		MinUniqueRatio: 0.8,
+		Hold:           5 * time.Minute,
+		Action:         FloodNXDomain,
+		Rate:           10,
+	}
+}
+
+// Stage is the middleware mitigating floods, for the chain of a proxy.
+func (g *FloodGuard) Stage(next Handler) Handler {
+	return func(q *Query) {
+		if q.DryRun {
+			next(q)
+			return
+		}
+		name := strings.ToLower(q.Name)
+		zone, soa, rcode := g.mitigate(name, q.Time)
+		switch {
+		case rcode == dns.RcodeNameError:
+			m := new(dns.Msg)
+			m.SetRcode(q.Req, dns.RcodeNameError)
+			m.Ns = []dns.RR{dns.Copy(soa)}
+			q.Verdict = "flood"
+			q.W.WriteMsg(m)
+			return
+		case rcode == dns.RcodeServerFailure:
+			q.Verdict = "flood"
+			reply(q.W, q.Req, dns.RcodeServerFailure)
+			return
+		case zone != "":
+			// Forwarded at Rate, not counted again.
+			next(q)
+			return
+		}
+		q.W = &floodWriter{ResponseWriter: q.W, g: g, name: name, now: q.Time}
+		next(q)
+	}
+}
+
+// mitigate returns the zone mitigated a name is in, if any, with the SOA
+// and the rcode to answer it, success to forward it.
+func (g *FloodGuard) mitigate(name string, now time.Time) (string, *dns.SOA, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.mitigated) == 0 || g.known[name] {
+		return "", nil, dns.RcodeSuccess
+	}
+	for zone, m := range g.mitigated {
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		if now.After(m.until) {
+			if m.hits < g.MinQueries {
+				delete(g.mitigated, zone)
+				return "", nil, dns.RcodeSuccess
+			}
+			m.until, m.hits = now.Add(g.Hold), 0
+		}
+		m.hits++
+		if g.Action != FloodRateLimit {
+			return zone, m.soa, dns.RcodeNameError
+		}
+		if now.Sub(m.second) >= time.Second {
+			m.second, m.sent = now, 0
+		}
+		if m.sent >= g.Rate {
+			return zone, nil, dns.RcodeServerFailure
+		}
+		m.sent++
+		return zone, nil, dns.RcodeSuccess
+	}
+	return "", nil, dns.RcodeSuccess
+}
+
+// observe counts the response to a query for name, mitigating its zone if
+// it is flooded. The zone is the one of the SOA of the response if under
+// the registrable domain of the name, else that domain: a flood of random
+// domains, answered with the SOA of their TLD, never mitigates a TLD or
+// another public suffix.
+func (g *FloodGuard) observe(name string, m *dns.Msg, now time.Time) {
+	var soa *dns.SOA
+	for _, rr := range m.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	zone := floodZoneOf(name)
+	if zone == "" {
+		return
+	}
+	if soa != nil {
+		owner := strings.ToLower(soa.Hdr.Name)
+		if dns.IsSubDomain(zone, owner) && dns.IsSubDomain(owner, name) {
+			zone = owner
+		} else {
+			soa = nil
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.start) >= g.Window || g.zones == nil {
+		g.start = now
+		g.zones = make(map[string]*floodZone)
+	}
+	if g.known == nil || len(g.known) >= maxKnownNames {
+		g.known = make(map[string]bool)
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0 {
+		g.known[name] = true
+	}
+	z := g.zones[zone]
+	if z == nil {
+		z = &floodZone{names: make(map[string]bool)}
+		g.zones[zone] = z
+	}
+	z.queries++
+	if m.Rcode == dns.RcodeNameError {
+		z.nx++
+		if soa != nil {
+			z.soa = soa
+		}
+	}
+	// Names beyond the threshold need not be remembered.
+	if len(z.names) < g.MinQueries {
+		z.names[name] = true
+	}
+	if z.queries < g.MinQueries || g.mitigated[zone] != nil ||
+		float64(z.nx) < g.MinNXRatio*float64(z.queries) ||
+		float64(len(z.names)) < g.MinUniqueRatio*float64(g.MinQueries) {
+		return
+	}
+	if g.mitigated == nil {
+		g.mitigated = make(map[string]*floodMitigation)
+	}
+	g.mitigated[zone] = &floodMitigation{until: now.Add(g.Hold), soa: negativeSOA(zone, z.soa)}
+	if g.Alert != nil {
+		go g.Alert(&Event{Time: now, Kind: EventFlood,
+			Message: fmt.Sprintf("mitigating random subdomains of %s (%s): %d queries in %v, %d%% NXDOMAIN",
+				zone, g.Action, z.queries, now.Sub(g.start).Round(time.Second), 100*z.nx/z.queries)})
+	}
+}
+
+// floodZoneOf returns the registrable domain of a name, a public suffix
+// (e.g. com. or co.uk.) and the label below, empty if the name is a public
+// suffix.
+func floodZoneOf(name string) string {
+	d, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return ""
+	}
+	return d + "."
+}
+
+// negativeSOA returns the SOA of a zone for NXDOMAIN responses, with the
+// negative TTL (RFC 2308), synthesized if soa is nil.
+func negativeSOA(zone string, soa *dns.SOA) *dns.SOA {
+	if soa == nil {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns: "ns.invalid.", Mbox: "hostmaster.invalid.", Serial: 1,
+			Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 60}
+	}
+	s := dns.Copy(soa).(*dns.SOA)
+	if s.Minttl < s.Hdr.Ttl {
+		s.Hdr.Ttl = s.Minttl
+	}
+	return s
+}
+
+// floodWriter counts the response to a query.
+type floodWriter struct {
+	dns.ResponseWriter
+	g    *FloodGuard
+	name string
+	now  time.Time
+}
+
+func (w *floodWriter) WriteMsg(m *dns.Msg) error {
+	w.g.observe(w.name, m, w.now)
+	return w.ResponseWriter.WriteMsg(m)
+}
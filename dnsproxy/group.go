@@ -0,0 +1,125 @@
+package dnsproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// A Group is a named set of clients, e.g. the devices of kids or an IoT
+// network, to which rules (blocks, routes, quotas...) are restricted with
+// the option group=name.
+type Group struct {
+	Name    string
+	Clients []*net.IPNet
+	// Certs are the names of the certificates of clients over TLS or
+	// HTTPS in the group: the common name of the subject, or one of the
+	// DNS names or email addresses of the certificate.
+	Certs []string
+	// CAs are the common names of the authorities whose clients over TLS
+	// or HTTPS are in the group, whatever their address.
+	CAs []string
+	// Identities are the users authenticated by the DoH server in the
+	// group.
+	Identities []string
+}
+
+// ParseGroup parses a group of the form name=member[+member...], where
+// each member is a CIDR or a single IP, cert:name for the client
+// certificate of a name, ca:name for the certificates issued by the
+// authority of a common name, or id:name for a user of the DoH server.
+func ParseGroup(s string) (*Group, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return nil, errors.New("must be name=cidr+...")
+	}
+	g := &Group{Name: kv[0]}
+	for _, c := range strings.Split(kv[1], "+") {
+		if name := strings.TrimPrefix(c, "cert:"); name != c {
+			g.Certs = append(g.Certs, name)
+			continue
+		}
+		if name := strings.TrimPrefix(c, "ca:"); name != c {
+			g.CAs = append(g.CAs, name)
+			continue
+		}
+		if name := strings.TrimPrefix(c, "id:"); name != c {
+			g.Identities = append(g.Identities, name)
+			continue
+		}
+		n, err := ParseNet(c)
+		if err != nil {
+			return nil, err
+		}
+		g.Clients = append(g.Clients, n)
+	}
+	return g, nil
+}
+
+// Groups returns the groups of clients.
+func (p *Proxy) Groups() []*Group {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Group(nil), p.groups...)
+}
+
+// SetGroups replaces the groups of clients. A client is in the first group
+// containing it, if any.
+func (p *Proxy) SetGroups(groups []*Group) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.groups = append([]*Group(nil), groups...)
+}
+
+// group returns the name of the group of the client of a query, empty if
+// none.
+func (p *Proxy) group(q *Query) string {
+	for _, g := range p.Groups() {
+		if g.contains(q) {
+			return g.Name
+		}
+	}
+	return ""
+}
+
+// contains reports whether the client of a query is in the group.
+func (g *Group) contains(q *Query) bool {
+	if q.Identity != "" && contains(g.Identities, q.Identity) {
+		return true
+	}
+	if q.Client != nil {
+		for _, n := range g.Clients {
+			if n.Contains(q.Client) {
+				return true
+			}
+		}
+	}
+	// Certificates are only trusted once verified, not as sent by the
+	// client.
+	if q.TLS == nil || len(q.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	leaf := q.TLS.VerifiedChains[0][0]
+	names := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	for _, name := range append(names, leaf.EmailAddresses...) {
+		if contains(g.Certs, name) {
+			return true
+		}
+	}
+	for _, chain := range q.TLS.VerifiedChains {
+		for _, c := range chain[1:] {
+			if contains(g.CAs, c.Subject.CommonName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupStage sets the group of the client of a query.
+func (p *Proxy) groupStage(next Handler) Handler {
+	return func(q *Query) {
+		q.Group = p.group(q)
+		next(q)
+	}
+}
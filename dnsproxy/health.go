@@ -0,0 +1,112 @@
+package dnsproxy
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Kinds of events of WatchHealth.
+const (
+	EventReady   = "ready"
+	EventUnready = "unready"
+)
+
+// CheckHealth queries the default upstreams and the upstreams of routes,
+// all at once, for the NS records of the root, and reports whether any of
+// them answered, whatever the rcode, so that the proxy can still answer
+// queries.
+func (p *Proxy) CheckHealth() bool {
+	p.mu.RLock()
+	defaults := append([]string(nil), p.Default...)
+	p.mu.RUnlock()
+	var probes []*Query
+	for _, u := range defaults {
+		probes = append(probes, &Query{Upstream: u})
+	}
+	for _, r := range p.Routes() {
+		if r.Upstreams == nil {
+			continue
+		}
+		for _, u := range r.Upstreams.Addrs() {
+			probes = append(probes, &Query{Upstream: u, Route: r})
+		}
+	}
+	healthy := make(chan bool, len(probes))
+	var wg sync.WaitGroup
+	for _, q := range probes {
+		q.Req = new(dns.Msg)
+		q.Req.SetQuestion(".", dns.TypeNS)
+		q.Name, q.Time = ".", time.Now()
+		wg.Add(1)
+		go func(q *Query) {
+			defer wg.Done()
+			_, err := p.exchange(q, q.Req)
+			healthy <- err == nil
+		}(q)
+	}
+	wg.Wait()
+	close(healthy)
+	for ok := range healthy {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready reports whether the last check of WatchHealth found a healthy
+// upstream, true until then.
+func (p *Proxy) Ready() bool {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	return !p.unready
+}
+
+// WatchHealth checks the upstreams with CheckHealth every interval until
+// stop is closed, sending an event when the proxy becomes unready, all its
+// upstreams failing, and ready again. If file is not empty, it is created
+// while ready and removed while unready, for keepalived or a BGP daemon to
+// withdraw the address of the proxy.
+func (p *Proxy) WatchHealth(interval time.Duration, file string, stop <-chan struct{}) {
+	set := func(ready bool) {
+		if file == "" {
+			return
+		}
+		if ready {
+			if err := os.WriteFile(file, nil, 0644); err != nil {
+				p.logf("cannot create health file: %v", err)
+			}
+		} else if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			p.logf("cannot remove health file: %v", err)
+		}
+	}
+	set(p.Ready())
+	if file != "" {
+		defer os.Remove(file)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ready := p.CheckHealth()
+		p.healthMu.Lock()
+		changed := ready == p.unready
+		p.unready = !ready
+		p.healthMu.Unlock()
+		if changed {
+			set(ready)
+			if ready {
+				p.alert(EventReady, "an upstream answers again, ready")
+			} else {
+				p.alert(EventUnready, "no upstream answers, unready")
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // database/sql driver
+)
+
+// A History keeps the recent queries of a QueryLog, whose Out it is, in an
+// embedded SQLite database, so that they can be searched without any
+// external infrastructure, e.g. what a device looked up yesterday. Queries
+// are written to the database in the background, not to slow down the
+// proxy: those beyond a queue of historyQueue writes are dropped, and
+// logged. Create one with OpenHistory.
+type History struct {
+	// Retention is how long queries are kept, forever if zero, and
+	// MaxEntries how many of them at most, no limit if zero.
+	Retention  time.Duration
+	MaxEntries int
+
+	db    *sql.DB
+	queue chan []byte
+	done  chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+}
+
+// historyQueue is the number of writes queued for a History at most.
+const historyQueue = 4096
+
+// historyExpire is how often the queries beyond the retention or the
+// maximum number are deleted from a History.
+const historyExpire = time.Minute
+
+// historySchema creates the table of the queries of a History, with the
+// whole entry in JSON and the columns searched on.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS queries (
+	id       INTEGER PRIMARY KEY,
+	time     INTEGER NOT NULL,
+	client   TEXT NOT NULL,
+	trace_id TEXT NOT NULL,
+	entry    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queries_time ON queries (time);
+CREATE INDEX IF NOT EXISTS queries_client ON queries (client, time);
+CREATE INDEX IF NOT EXISTS queries_trace_id ON queries (trace_id);
+`
+
+// A HistoryFilter selects the queries of a history.
+type HistoryFilter struct {
+	// Client, if not empty, is the client as logged.
+	Client string
+	// Name, if not empty, is a pattern of the names (see path.Match), e.g.
+	// "*.example.com.", matched without case.
+	Name string
+	// TraceID, if not empty, is the trace ID of the query.
+	TraceID string
+	// Since and Until, if not zero, bound the time of the queries.
+	Since, Until time.Time
+	// Limit, if not zero, is the number of queries returned at most, the
+	// most recent ones.
+	Limit int
+}
+
+// OpenHistory opens the history of a SQLite database file, created if it
+// does not exist, keeping 30 days and a hundred thousand queries at most.
+func OpenHistory(name string) (*History, error) {
+	// The write-ahead log lets searches read while queries are written.
+	db, err := sql.Open("sqlite3", "file:"+name+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := os.Chmod(name, 0600); err != nil {
+		db.Close()
+		return nil, err
+	}
+	h := &History{Retention: 30 * 24 * time.Hour, MaxEntries: 100000, db: db,
+		queue: make(chan []byte, historyQueue), done: make(chan struct{})}
+	go h.run()
+	return h, nil
+}
+
+// Write queues the JSON lines of query log entries to be added to the
+// history, or drops them if the queue is full.
+func (h *History) Write(b []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	select {
+	case h.queue <- append([]byte(nil), b...):
+	default:
+		h.dropped++
+	}
+	return len(b), nil
+}
+
+// run inserts the queued lines in the database, and deletes the queries
+// beyond the retention or the maximum number every historyExpire, until
+// the queue is closed.
+func (h *History) run() {
+	defer close(h.done)
+	var expired time.Time
+	for b := range h.queue {
+		if err := h.insert(b); err != nil {
+			log.Printf("history: cannot write: %v", err)
+		}
+		h.mu.Lock()
+		dropped := h.dropped
+		h.dropped = 0
+		h.mu.Unlock()
+		if dropped > 0 {
+			log.Printf("history: dropped %d writes, queue full", dropped)
+		}
+		if now := time.Now(); now.Sub(expired) > historyExpire {
+			if err := h.expire(now); err != nil {
+				log.Printf("history: cannot expire: %v", err)
+			}
+			expired = now
+		}
+	}
+}
+
+// insert adds the queries of JSON lines to the database.
+func (h *History) insert(b []byte) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO queries (time, client, trace_id, entry) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		e := new(QueryLogEntry)
+		if len(line) == 0 || json.Unmarshal(line, e) != nil {
+			continue
+		}
+		if _, err := stmt.Exec(e.Time.UnixNano(), e.Client, e.TraceID, string(line)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// expire deletes the queries beyond the retention or the maximum number.
+func (h *History) expire(now time.Time) error {
+	if h.Retention > 0 {
+		if _, err := h.db.Exec("DELETE FROM queries WHERE time < ?", now.Add(-h.Retention).UnixNano()); err != nil {
+			return err
+		}
+	}
+	if h.MaxEntries > 0 {
+		// Queries are numbered in the order they are inserted.
+		if _, err := h.db.Exec("DELETE FROM queries WHERE id <= (SELECT MAX(id) FROM queries) - ?", h.MaxEntries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the queries matching a filter, the most recent first.
+func (h *History) Search(f HistoryFilter) ([]*QueryLogEntry, error) {
+	query := "SELECT entry FROM queries WHERE 1"
+	var args []interface{}
+	if h.Retention > 0 && (f.Since.IsZero() || time.Since(f.Since) > h.Retention) {
+		f.Since = time.Now().Add(-h.Retention)
+	}
+	if !f.Since.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		query += " AND time <= ?"
+		args = append(args, f.Until.UnixNano())
+	}
+	if f.Client != "" {
+		query += " AND client = ?"
+		args = append(args, f.Client)
+	}
+	if f.TraceID != "" {
+		query += " AND trace_id = ?"
+		args = append(args, f.TraceID)
+	}
+	rows, err := h.db.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	name := strings.ToLower(f.Name)
+	found := []*QueryLogEntry{}
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		e := new(QueryLogEntry)
+		if json.Unmarshal(b, e) != nil {
+			continue
+		}
+		if name != "" {
+			if ok, _ := path.Match(name, strings.ToLower(e.Name)); !ok {
+				continue
+			}
+		}
+		found = append(found, e)
+		if f.Limit > 0 && len(found) == f.Limit {
+			break
+		}
+	}
+	return found, rows.Err()
+}
+
+// Close writes the queries still queued and closes the database of the
+// history.
+func (h *History) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return os.ErrClosed
+	}
+	h.closed = true
+	close(h.queue)
+	h.mu.Unlock()
+	<-h.done
+	return h.db.Close()
+}
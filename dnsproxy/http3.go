@@ -0,0 +1,22 @@
+//go:build http3
+
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3 reports whether ServeHTTP3 is supported, which needs
+// building with the http3 tag.
+const HTTP3 = true
+
+// ServeHTTP3 serves h over HTTP/3 on a UDP socket with the certificates
+// of config, e.g. the DoHHandler of a proxy.
+func ServeHTTP3(pc net.PacketConn, config *tls.Config, h http.Handler) error {
+	s := &http3.Server{TLSConfig: http3.ConfigureTLSConfig(config), Handler: h}
+	return s.Serve(pc)
+}
@@ -0,0 +1,20 @@
+//go:build !http3
+
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// HTTP3 reports whether ServeHTTP3 is supported, which needs
+// building with the http3 tag.
+const HTTP3 = false
+
+// ServeHTTP3 serves h over HTTP/3, which is only supported when built with
+// the http3 tag.
+func ServeHTTP3(pc net.PacketConn, config *tls.Config, h http.Handler) error {
+	return errors.New("http3 is not supported, build with -tags http3")
+}
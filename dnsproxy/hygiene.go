@@ -0,0 +1,57 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// hygienic returns the rcode of a query rejected by Hygiene and why, -1 if
+// it is valid.
+func (p *Proxy) hygienic(q *Query) (rcode int, why string) {
+	if len(q.Req.Question) != 1 {
+		return dns.RcodeFormatError, "several questions"
+	}
+	if bad := badName(q.Name); bad != "" {
+		return dns.RcodeFormatError, bad
+	}
+	if len(p.HygieneClasses) > 0 {
+		class := q.Req.Question[0].Qclass
+		for _, c := range p.HygieneClasses {
+			if c == class {
+				return -1, ""
+			}
+		}
+		return dns.RcodeRefused, "class " + dns.ClassToString[class]
+	}
+	return -1, ""
+}
+
+// badName returns why a query name is invalid, empty if it is valid.
+func badName(name string) string {
+	if name == "." {
+		return ""
+	}
+	if len(name) > 254 || !strings.HasSuffix(name, ".") {
+		return "invalid name"
+	}
+	for i, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		switch {
+		case label == "":
+			return "empty label"
+		case len(label) > 63:
+			return "label too long"
+		case label == "*":
+			if i > 0 {
+				return "wildcard label not first"
+			}
+			continue
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return "illegal character in label"
+			}
+		}
+	}
+	return ""
+}
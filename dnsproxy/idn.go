@@ -0,0 +1,83 @@
+package dnsproxy
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// UnicodeName returns a name with its A-labels (xn--...) as U-labels, e.g.
+// "xn--bcher-kva.example." as "bücher.example.", or the name itself if it
+// has none or they are invalid.
+func UnicodeName(name string) string {
+	if !strings.Contains(strings.ToLower(name), "xn--") {
+		return name
+	}
+	u, err := idna.ToUnicode(strings.ToLower(name))
+	if err != nil {
+		return name
+	}
+	return u
+}
+
+// displayName returns a name followed by its U-labels, if it has A-labels,
+// for operators to read.
+func displayName(name string) string {
+	if u := UnicodeName(name); u != name {
+		return name + " (" + u + ")"
+	}
+	return name
+}
+
+// idnScripts are the sets of scripts a label can mix and not be deemed
+// mixed-script, as in Japanese, Chinese and Korean names (the highly
+// restrictive level of UTS #39).
+var idnScripts = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// MixedScript reports whether a label of a name, as U-labels, has letters of
+// several scripts, e.g. a Cyrillic а among Latin letters, as do the
+// homoglyphs of names used for phishing.
+func MixedScript(name string) bool {
+	for _, label := range strings.Split(UnicodeName(name), ".") {
+		scripts := make(map[string]bool)
+		for _, r := range label {
+			if r < unicode.MaxASCII {
+				if unicode.IsLetter(r) {
+					scripts["Latin"] = true
+				}
+				continue
+			}
+			for s, t := range unicode.Scripts {
+				if s != "Common" && s != "Inherited" && unicode.Is(t, r) {
+					scripts[s] = true
+					break
+				}
+			}
+		}
+		if len(scripts) > 1 && !allowedScripts(scripts) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedScripts reports whether scripts are all within a set of idnScripts.
+func allowedScripts(scripts map[string]bool) bool {
+	for _, set := range idnScripts {
+		n := 0
+		for _, s := range set {
+			if scripts[s] {
+				n++
+			}
+		}
+		if n == len(scripts) {
+			return true
+		}
+	}
+	return false
+}
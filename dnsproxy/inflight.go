@@ -0,0 +1,35 @@
+package dnsproxy
+
+import "time"
+
+// acquire takes one of the MaxInFlight slots of the exchanges with
+// upstreams, waiting up to InFlightWait for one to be released, and reports
+// whether it got one. Slots must be given back with release.
+func (p *Proxy) acquire() bool {
+	if p.inflight == nil {
+		return true
+	}
+	select {
+	case p.inflight <- struct{}{}:
+		return true
+	default:
+	}
+	if p.InFlightWait <= 0 {
+		return false
+	}
+	t := time.NewTimer(p.InFlightWait)
+	defer t.Stop()
+	select {
+	case p.inflight <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// release gives back a slot taken by acquire.
+func (p *Proxy) release() {
+	if p.inflight != nil {
+		<-p.inflight
+	}
+}
@@ -0,0 +1,214 @@
+package dnsproxy
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultIdleTimeout is how long the connections of clients are kept open
+// without a query if IdleTimeout is 0, as by dns.Server.
+const defaultIdleTimeout = 8 * time.Second
+
+// upstreamIdleTimeout is how long connections to upstreams are kept idle
+// when their responses do not say, and maxUpstreamIdle the longest they are
+// whatever they say.
+const (
+	upstreamIdleTimeout = 2 * time.Second
+	maxUpstreamIdle     = 2 * time.Minute
+)
+
+// maxIdleConns bounds the idle connections kept to each upstream.
+const maxIdleConns = 8
+
+// idleTimeout returns how long the connections of clients are kept open
+// without a query.
+func (p *Proxy) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+// keepaliveOption returns the edns-tcp-keepalive option of a message, nil
+// if it has none.
+func keepaliveOption(m *dns.Msg) *dns.EDNS0_TCP_KEEPALIVE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return k
+		}
+	}
+	return nil
+}
+
+// removeKeepalive removes the edns-tcp-keepalive option from a message,
+// which only concerns the connection it came over.
+func removeKeepalive(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
+// addKeepalive adds the edns-tcp-keepalive option with the idle timeout of
+// the proxy to the response to a client asking for it over TCP.
+func (p *Proxy) addKeepalive(m *dns.Msg, opt *dns.OPT) {
+	ropt := m.IsEdns0()
+	if ropt == nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		ropt = m.IsEdns0()
+	}
+	timeout := p.idleTimeout() / (100 * time.Millisecond)
+	if timeout > 0xffff {
+		timeout = 0xffff
+	}
+	ropt.Option = append(ropt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(timeout)})
+}
+
+// withoutKeepalive returns a copy of the query req of a client without its
+// edns-tcp-keepalive option, or req itself if it has none.
+func withoutKeepalive(req *dns.Msg) *dns.Msg {
+	if keepaliveOption(req) == nil {
+		return req
+	}
+	req = req.Copy()
+	removeKeepalive(req)
+	return req
+}
+
+// idleConn is a connection to an upstream kept for later queries.
+type idleConn struct {
+	conn    *dns.Conn
+	expires time.Time
+}
+
+// connKey returns the key of the idle connections to an upstream which
+// can carry a query: those dialed the same way.
+func (p *Proxy) connKey(q *Query, network, addr, serverName string) string {
+	key := network + " " + addr + " " + serverName + " " + p.socks5(q)
+	if ip := p.sourceIP(q); ip != nil {
+		key += " " + ip.String()
+	}
+	return key
+}
+
+// idle returns an idle connection of key, nil if none.
+func (p *Proxy) idle(key string) *dns.Conn {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	now := time.Now()
+	for conns := p.conns[key]; len(conns) > 0; conns = p.conns[key] {
+		c := conns[len(conns)-1]
+		p.conns[key] = conns[:len(conns)-1]
+		if now.Before(c.expires) {
+			return c.conn
+		}
+		c.conn.Close()
+	}
+	return nil
+}
+
+// keep keeps a connection of key idle until the upstream closes it, or
+// closes it if enough are.
+func (p *Proxy) keep(key string, conn *dns.Conn, idle time.Duration) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[string][]*idleConn)
+	}
+	if len(p.conns[key]) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	p.conns[key] = append(p.conns[key], &idleConn{conn: conn, expires: time.Now().Add(idle)})
+}
+
+// closeIdle closes the idle connections to upstreams.
+func (p *Proxy) closeIdle() {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+	p.conns = nil
+}
+
+// exchangeReused sends req over network "tcp" or "tcp-tls" to the address
+// of an upstream on an idle connection, or a new one if none is or the
+// idle one failed, asking to keep it open with the edns-tcp-keepalive
+// option, and returns its response, unchecked. The connection is kept
+// for as long as the upstream answers.
+func (p *Proxy) exchangeReused(q *Query, network, addr, serverName string, req *dns.Msg) (*dns.Msg, error) {
+	key := p.connKey(q, network, addr, serverName)
+	edns := req.IsEdns0() != nil
+	req = req.Copy()
+	if !edns {
+		// Responses must still fit the client without EDNS.
+		req.SetEdns0(dns.MinMsgSize, false)
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	c := &dns.Client{Net: network}
+	var resp *dns.Msg
+	var conn *dns.Conn
+	var err error
+	if conn = p.idle(key); conn != nil {
+		p.stats.upstreamConn(q.Upstream, true)
+		if resp, _, err = c.ExchangeWithConn(req, conn); err != nil {
+			// The upstream may have closed it meanwhile.
+			p.debugf(q, "idle connection to %s failed: %v, dialing", q.Upstream, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn == nil {
+		if conn, err = p.dial(q, network, addr, serverName); err != nil {
+			return nil, err
+		}
+		p.stats.upstreamConn(q.Upstream, false)
+		if resp, _, err = c.ExchangeWithConn(req, conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	idle := upstreamIdleTimeout
+	if k := keepaliveOption(resp); k != nil {
+		idle = time.Duration(k.Timeout) * 100 * time.Millisecond
+		removeKeepalive(resp)
+	}
+	if idle > maxUpstreamIdle {
+		idle = maxUpstreamIdle
+	}
+	if idle > 0 && resp.Id == req.Id {
+		p.keep(key, conn, idle)
+	} else {
+		conn.Close()
+	}
+	if !edns {
+		removeOPT(resp)
+	}
+	return resp, nil
+}
+
+// removeOPT removes the OPT record of a message.
+func removeOPT(m *dns.Msg) {
+	for i, rr := range m.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			m.Extra = append(m.Extra[:i], m.Extra[i+1:]...)
+			return
+		}
+	}
+}
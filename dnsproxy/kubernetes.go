@@ -0,0 +1,286 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccount is where Kubernetes mounts the credentials of a pod.
+const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes reads the configuration of a proxy from a ConfigMap, through
+// the Kubernetes API. The ConfigMap holds any of the keys:
+//
+//	routes   routes as parsed by ParseRoute
+//	blocks   block rules as parsed by ParseRule
+//	default  default upstreams
+//	policy   a policy, as in a policy file
+//
+// Lists have one entry per line or are comma separated, lines starting
+// with # are ignored.
+type Kubernetes struct {
+	// Server is the URL of the API server.
+	Server string
+	// Namespace and Name of the ConfigMap.
+	Namespace, Name string
+	// TokenFile holds the bearer token, re-read for each request since
+	// tokens are rotated. No token is sent if empty.
+	TokenFile string
+	// Client to make requests with, http.DefaultClient if nil.
+	Client *http.Client
+	// ErrorLog logs invalid configurations and errors while watching.
+	// If nil, the standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// InCluster returns a Kubernetes watching the ConfigMap name in the
+// namespace of the pod it runs in, with the credentials of its service
+// account.
+func InCluster(name string) (*Kubernetes, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes: not running in a cluster")
+	}
+	ns, err := os.ReadFile(serviceAccount + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	ca, err := os.ReadFile(serviceAccount + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes: no certificate in ca.crt")
+	}
+	return &Kubernetes{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(ns)),
+		Name:      name,
+		TokenFile: serviceAccount + "/token",
+		Client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+	}, nil
+}
+
+// A KubeConfig is the configuration read from a ConfigMap.
+// Fields are nil for keys the ConfigMap does not have.
+type KubeConfig struct {
+	Routes  []*Route
+	Blocks  []*Rule
+	Default []string
+	Policy  Policy
+}
+
+type configMap struct {
+	Metadata struct {
+		ResourceVersion string
+	}
+	Data map[string]string
+}
+
+// parseKubeConfig parses the data of a ConfigMap. An invalid entry fails
+// the whole configuration.
+func parseKubeConfig(data map[string]string) (*KubeConfig, error) {
+	c := &KubeConfig{}
+	if s, ok := data["routes"]; ok {
+		c.Routes = []*Route{}
+		for _, e := range splitList(s) {
+			r, err := ParseRoute(e)
+			if err == nil && r.ConsulService != "" {
+				err = errors.New("consul upstreams are not supported from kubernetes")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %v", e, err)
+			}
+			c.Routes = append(c.Routes, r)
+		}
+	}
+	if s, ok := data["blocks"]; ok {
+		c.Blocks = []*Rule{}
+		for _, e := range splitList(s) {
+			b, err := ParseRule(e)
+			if err != nil {
+				return nil, fmt.Errorf("block %q: %v", e, err)
+			}
+			c.Blocks = append(c.Blocks, b)
+		}
+	}
+	if s, ok := data["default"]; ok {
+		c.Default = []string{}
+		for _, e := range splitList(s) {
+			if !ValidUpstream(e) {
+				return nil, fmt.Errorf("default: invalid upstream %q", e)
+			}
+			c.Default = append(c.Default, e)
+		}
+	}
+	if s, ok := data["policy"]; ok {
+		policy, err := ParsePolicy(s)
+		if err != nil {
+			return nil, err
+		}
+		if policy == nil {
+			policy = Policy{}
+		}
+		c.Policy = policy
+	}
+	return c, nil
+}
+
+// splitList splits a list on lines and commas, skipping comments.
+func splitList(s string) []string {
+	var list []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, e := range strings.Split(line, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				list = append(list, e)
+			}
+		}
+	}
+	return list
+}
+
+// Watch calls apply with the configuration of the ConfigMap and again each
+// time it is modified, until stop is closed. Invalid configurations are
+// not applied, and neither is the removal of the ConfigMap, so the last
+// valid one stays in place. Errors are retried after a delay.
+func (k *Kubernetes) Watch(apply func(*KubeConfig), stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		if err := k.watch(ctx, apply); err != nil && ctx.Err() == nil {
+			k.logf("kubernetes: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// watch gets the ConfigMap then follows its changes until the watch ends.
+func (k *Kubernetes) watch(ctx context.Context, apply func(*KubeConfig)) error {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", url.PathEscape(k.Namespace))
+	resp, err := k.get(ctx, path+"/"+url.PathEscape(k.Name), nil)
+	if err != nil {
+		return err
+	}
+	var cm configMap
+	err = json.NewDecoder(resp.Body).Decode(&cm)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	k.apply(&cm, apply)
+
+	resp, err = k.get(ctx, path, url.Values{
+		"watch":           {"1"},
+		"fieldSelector":   {"metadata.name=" + k.Name},
+		"resourceVersion": {cm.Metadata.ResourceVersion},
+		"timeoutSeconds":  {"300"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string
+			Object json.RawMessage
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil // watch timed out, start over
+			}
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var cm configMap
+			if err := json.Unmarshal(event.Object, &cm); err != nil {
+				return err
+			}
+			k.apply(&cm, apply)
+		case "DELETED":
+			k.logf("kubernetes: configmap %s/%s deleted, keeping configuration", k.Namespace, k.Name)
+		case "ERROR":
+			// Typically the resource version is too old, start over.
+			return fmt.Errorf("watch: %s", event.Object)
+		}
+	}
+}
+
+func (k *Kubernetes) apply(cm *configMap, apply func(*KubeConfig)) {
+	c, err := parseKubeConfig(cm.Data)
+	if err != nil {
+		k.logf("kubernetes: configmap %s/%s: %v", k.Namespace, k.Name, err)
+		return
+	}
+	apply(c)
+}
+
+func (k *Kubernetes) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimSuffix(k.Server, "/") + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.TokenFile != "" {
+		token, err := os.ReadFile(k.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (k *Kubernetes) logf(format string, v ...interface{}) {
+	if k.ErrorLog != nil {
+		k.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,180 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transports of the listeners of a proxy, by which Stats.Listeners are
+// counted.
+const (
+	ListenerUDP  = "udp"
+	ListenerTCP  = "tcp"
+	ListenerDoT  = "dot"  // DNS over TLS
+	ListenerDoH  = "doh"  // DNS over HTTPS, or HTTP/2 without TLS
+	ListenerDoH3 = "doh3" // DNS over HTTPS over HTTP/3
+)
+
+// transport returns the transport a query came over.
+func transport(q *Query) string {
+	if w, ok := q.W.(*dohResponseWriter); ok {
+		return w.transport()
+	}
+	switch {
+	case q.TLS != nil:
+		return ListenerDoT
+	case overTCP(q):
+		return ListenerTCP
+	}
+	return ListenerUDP
+}
+
+// countBytes counts the bytes of the messages read and written by a
+// server of a transport.
+func (p *Proxy) countBytes(s *dns.Server, transport string) {
+	s.DecorateReader = func(r dns.Reader) dns.Reader {
+		return &countingReader{Reader: r, p: p, transport: transport}
+	}
+	s.DecorateWriter = func(w dns.Writer) dns.Writer {
+		return &countingWriter{Writer: w, p: p, transport: transport}
+	}
+}
+
+// countingReader counts the bytes of the queries a server reads.
+type countingReader struct {
+	dns.Reader
+	p         *Proxy
+	transport string
+}
+
+func (r *countingReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, err := r.Reader.ReadTCP(conn, timeout)
+	r.p.stats.listenerBytes(r.transport, len(b), 0)
+	return b, err
+}
+
+func (r *countingReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	b, s, err := r.Reader.ReadUDP(conn, timeout)
+	r.p.stats.listenerBytes(r.transport, len(b), 0)
+	return b, s, err
+}
+
+// ReadPacketConn implements dns.PacketConnReader, for the sockets other
+// than *net.UDPConn, e.g. of the PROXY protocol.
+func (r *countingReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	b, addr, err := r.Reader.(dns.PacketConnReader).ReadPacketConn(conn, timeout)
+	r.p.stats.listenerBytes(r.transport, len(b), 0)
+	return b, addr, err
+}
+
+// countingWriter counts the bytes of the responses a server writes.
+type countingWriter struct {
+	dns.Writer
+	p         *Proxy
+	transport string
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if err == nil {
+		// n has the length of the message over TCP.
+		w.p.stats.listenerBytes(w.transport, 0, len(b))
+	}
+	return n, err
+}
+
+// CountConns returns a listener of a transport, e.g. the TCP listener of
+// ListenerDoH, counting its connections in the stats of the proxy.
+func (p *Proxy) CountConns(l net.Listener, transport string) net.Listener {
+	return &countingListener{Listener: l, p: p, transport: transport}
+}
+
+// countingListener counts the connections it accepts, and those still
+// open.
+type countingListener struct {
+	net.Listener
+	p         *Proxy
+	transport string
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	l.p.stats.listenerConn(l.transport, true)
+	return &countedConn{Conn: c, p: l.p, transport: l.transport}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	p         *Proxy
+	transport string
+	once      sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.p.stats.listenerConn(c.transport, false) })
+	return c.Conn.Close()
+}
+
+// handshakeListener counts the failed handshakes of the connections of a
+// TLS listener.
+type handshakeListener struct {
+	net.Listener
+	p         *Proxy
+	transport string
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	return &handshakeConn{Conn: c.(*tls.Conn), p: l.p, transport: l.transport}, nil
+}
+
+// handshakeConn is a TLS connection, with its ConnectionState for the
+// server, which makes the handshake on first read.
+type handshakeConn struct {
+	*tls.Conn
+	p         *Proxy
+	transport string
+	once      sync.Once
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		if err := c.Conn.Handshake(); err != nil {
+			c.p.stats.handshakeFailure(c.transport)
+		}
+	})
+	return c.Conn.Read(b)
+}
+
+// HTTPErrorLog returns a logger for the ErrorLog of the http.Server of a
+// transport, e.g. ListenerDoH, which counts the failed TLS handshakes it
+// logs in the stats of the proxy and logs all as the proxy does.
+func (p *Proxy) HTTPErrorLog(transport string) *log.Logger {
+	return log.New(&httpErrorWriter{p: p, transport: transport}, "", 0)
+}
+
+type httpErrorWriter struct {
+	p         *Proxy
+	transport string
+}
+
+func (w *httpErrorWriter) Write(b []byte) (int, error) {
+	line := strings.TrimSuffix(string(b), "\n")
+	if strings.Contains(line, "TLS handshake error") {
+		w.p.stats.handshakeFailure(w.transport)
+	}
+	w.p.logf("%s", line)
+	return len(b), nil
+}
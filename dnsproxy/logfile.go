@@ -0,0 +1,116 @@
+package dnsproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is the format of the time appended to rotated log files.
+const rotatedSuffix = "20060102-150405"
+
+// A LogFile is a file appended to which is rotated periodically, the
+// rotated files being deleted past a retention window. Create one with
+// OpenLogFile.
+type LogFile struct {
+	// Rotate is the interval after which the file is renamed to
+	// path.YYYYMMDD-HHMMSS and a new one started, never if zero.
+	Rotate time.Duration
+	// Retention is how long rotated files are kept, forever if zero.
+	Retention time.Duration
+
+	path   string
+	mu     sync.Mutex
+	f      *os.File
+	opened time.Time
+}
+
+// OpenLogFile returns the log file at path, created if needed, rotated
+// daily and kept forever.
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{Rotate: 24 * time.Hour, path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file, which starts its rotation interval.
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.f, l.opened = f, time.Now()
+	return nil
+}
+
+// Write implements io.Writer, rotating the file first if it is time.
+func (l *LogFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	if l.Rotate > 0 && time.Since(l.opened) >= l.Rotate {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	return l.f.Write(b)
+}
+
+// rotate renames the current file, opens a new one and deletes the rotated
+// files past retention.
+func (l *LogFile) rotate() error {
+	l.f.Close()
+	l.f = nil
+	if err := os.Rename(l.path, l.path+"."+time.Now().Format(rotatedSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.expire()
+	return nil
+}
+
+// expire deletes the rotated files older than the retention window,
+// according to the time in their name.
+func (l *LogFile) expire() {
+	if l.Retention <= 0 {
+		return
+	}
+	rotated, _ := filepath.Glob(l.path + ".*")
+	for _, name := range rotated {
+		t, err := time.ParseInLocation(rotatedSuffix, strings.TrimPrefix(name, l.path+"."), time.Local)
+		if err != nil {
+			continue
+		}
+		if time.Since(t) > l.Retention {
+			os.Remove(name)
+		}
+	}
+}
+
+// Expire deletes the rotated files past retention, which is otherwise
+// only done on rotation.
+func (l *LogFile) Expire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire()
+}
+
+// Close closes the file.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
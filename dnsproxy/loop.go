@@ -0,0 +1,160 @@
+package dnsproxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loopOption is the EDNS option code, from the local use range (RFC 6891),
+// which carries the ID of the proxy in the queries it forwards with
+// LoopDetect.
+const loopOption = 65431
+
+// localAddrsTTL is how long the addresses of the interfaces are cached.
+const localAddrsTTL = time.Minute
+
+// errLoop is the error of a query to an upstream which is the proxy itself.
+var errLoop = errors.New("forwarding loop: upstream is the proxy itself")
+
+// newLoopID returns a random ID for the proxy to recognize its own queries.
+func newLoopID() []byte {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return id
+}
+
+// isSelf reports whether addr, an IP and port, is an address the proxy
+// listens to over network: its address, or any local address if it listens
+// to all of them.
+func (p *Proxy) isSelf(network, addr string) bool {
+	listen := p.Address
+	if network == "tcp-tls" {
+		listen = p.TLSAddress
+	}
+	lhost, lport, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != lport {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if lip := net.ParseIP(lhost); lip != nil && !lip.IsUnspecified() {
+		return ip.Equal(lip)
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, local := range p.localAddrs() {
+		if ip.Equal(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// selfUpstream reports whether an upstream, but DNS over HTTPS ones, has
+// an address of the proxy itself.
+func (p *Proxy) selfUpstream(upstream string) bool {
+	if isDoH(upstream) {
+		return false
+	}
+	network, addr := parseUpstream(upstream)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = p.lookupHost(host); err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if p.isSelf(network, net.JoinHostPort(ip.String(), port)) {
+			return true
+		}
+	}
+	return false
+}
+
+// localAddrs returns the addresses of the interfaces, cached for
+// localAddrsTTL.
+func (p *Proxy) localAddrs() []net.IP {
+	p.loopMu.Lock()
+	defer p.loopMu.Unlock()
+	if time.Since(p.localAddrsTime) < localAddrsTTL {
+		return p.localIPs
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return p.localIPs
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips = append(ips, n.IP)
+		}
+	}
+	p.localIPs, p.localAddrsTime = ips, time.Now()
+	return ips
+}
+
+// looped reports whether a query carries the loop option of the proxy,
+// that is the proxy forwarded it before.
+func (p *Proxy) looped(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == loopOption && string(l.Data) == string(p.loopID) {
+			return true
+		}
+	}
+	return false
+}
+
+// markLoop returns a copy of req carrying the loop option of the proxy.
+func (p *Proxy) markLoop(req *dns.Msg) *dns.Msg {
+	req = req.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		// Responses must still fit the client without EDNS.
+		req.SetEdns0(dns.MinMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: loopOption, Data: p.loopID})
+	return req
+}
+
+// unmarkLoop removes the loop option from a response, should the upstream
+// echo it, and the OPT record unless the query had one.
+func unmarkLoop(resp *dns.Msg, edns bool) {
+	for i, rr := range resp.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		if !edns {
+			resp.Extra = append(resp.Extra[:i], resp.Extra[i+1:]...)
+			return
+		}
+		kept := opt.Option[:0]
+		for _, o := range opt.Option {
+			if o.Option() != loopOption {
+				kept = append(kept, o)
+			}
+		}
+		opt.Option = kept
+		return
+	}
+}
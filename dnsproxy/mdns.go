@@ -0,0 +1,120 @@
+package dnsproxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsGroup is the IPv4 multicast address of mDNS.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNS resolves .local names with multicast DNS on a network segment, for
+// clients which cannot reach it themselves. Queries are sent as one-shot
+// legacy unicast queries (RFC 6762 section 5.1), so responders answer to
+// the proxy directly.
+type MDNS struct {
+	// Interface to send queries on, the system default if nil.
+	Interface *net.Interface
+	// Timeout waiting for an answer.
+	Timeout time.Duration
+}
+
+// NewMDNS returns an MDNS sending queries on the interface with the given
+// name, or the system default if empty.
+func NewMDNS(iface string) (*MDNS, error) {
+	m := &MDNS{Timeout: time.Second}
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+		m.Interface = ifi
+	}
+	return m, nil
+}
+
+// Stage is the middleware resolving .local names, for the chain of a
+// proxy. Names nobody answers for get NXDOMAIN instead of being forwarded
+// to upstreams which could only fail. Other queries, and queries already
+// routed by a policy, are passed on.
+func (m *MDNS) Stage(next Handler) Handler {
+	return func(q *Query) {
+		if q.Upstream != "" || !dns.IsSubDomain("local.", strings.ToLower(q.Name)) {
+			next(q)
+			return
+		}
+		if q.DryRun {
+			q.trace.stepf("would resolve over mDNS")
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(q.Req)
+		answers, err := m.Exchange(q.Req.Question[0])
+		if err != nil {
+			dns.HandleFailed(q.W, q.Req)
+			return
+		}
+		if answers == nil {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Answer = answers
+		q.W.WriteMsg(resp)
+	}
+}
+
+// Exchange sends an mDNS query for a question and returns the answers of
+// the first responder, or nil if none answers in time.
+func (m *MDNS) Exchange(question dns.Question) ([]dns.RR, error) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if m.Interface != nil {
+		if err := ipv4.NewPacketConn(c).SetMulticastInterface(m.Interface); err != nil {
+			return nil, err
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(question.Name, question.Qtype)
+	req.RecursionDesired = false
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.WriteTo(buf, mdnsGroup); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(m.Timeout))
+	b := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		resp := new(dns.Msg)
+		if resp.Unpack(b[:n]) != nil || resp.Id != req.Id || !resp.Response {
+			continue
+		}
+		var answers []dns.RR
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, question.Name) {
+				continue
+			}
+			// Clear the cache-flush bit, which is meaningless in unicast.
+			h.Class &^= 1 << 15
+			answers = append(answers, rr)
+		}
+		if len(answers) > 0 {
+			return answers, nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsTimeout bounds connecting to a NATS server and each batch published.
+const natsTimeout = 10 * time.Second
+
+// NATS is a Sink publishing lines as messages to a subject of a NATS server,
+// with the core protocol over TCP, without TLS. The connection is kept
+// across batches and opened again after an error.
+type NATS struct {
+	Addr    string // host:port
+	Subject string
+	// User and Password, or Token, authenticate to the server, if set.
+	User, Password string
+	Token          string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Send publishes lines, each in a message, and waits for the server to have
+// processed them.
+func (n *NATS) Send(lines [][]byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	err := n.publish(lines)
+	if err != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	return err
+}
+
+// connect connects and authenticates to the server, with mu held.
+func (n *NATS) connect() error {
+	conn, err := net.DialTimeout("tcp", n.Addr, natsTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected %q", strings.TrimSpace(line))
+	}
+	if info.TLSRequired {
+		conn.Close()
+		return errors.New("nats: server requires TLS")
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "lang": "go", "name": "dns-reverse-proxy"}
+	if n.User != "" {
+		opts["user"], opts["pass"] = n.User, n.Password
+	}
+	if n.Token != "" {
+		opts["auth_token"] = n.Token
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn, n.r = conn, r
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		n.conn = nil
+		return err
+	}
+	if err := n.pong(); err != nil {
+		conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// publish sends lines, then a PING whose PONG tells they were processed.
+func (n *NATS) publish(lines [][]byte) error {
+	n.conn.SetDeadline(time.Now().Add(natsTimeout))
+	w := bufio.NewWriter(n.conn)
+	for _, line := range lines {
+		fmt.Fprintf(w, "PUB %s %d\r\n", n.Subject, len(line))
+		w.Write(line)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return n.pong()
+}
+
+// pong waits for a PONG, answering the PINGs of the server meanwhile.
+func (n *NATS) pong() error {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
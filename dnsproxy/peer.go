@@ -0,0 +1,254 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A Config is the configuration of a proxy shared with its peer: its
+// routes as parsed (those discovered, e.g. from Consul, are left out), its
+// block rules, type blocks and default upstreams.
+type Config struct {
+	Routes     []string `json:"routes"`
+	Blocks     []string `json:"blocks"`
+	TypeBlocks []string `json:"type_blocks"`
+	Default    []string `json:"default"`
+}
+
+// Config returns the configuration of the proxy to share with a peer.
+func (p *Proxy) Config() *Config {
+	c := &Config{Routes: []string{}, Blocks: []string{}, TypeBlocks: []string{}}
+	for _, r := range p.Routes() {
+		if r.spec != "" && r.catalog == "" {
+			c.Routes = append(c.Routes, r.spec)
+		}
+	}
+	for _, b := range p.Blocks() {
+		c.Blocks = append(c.Blocks, b.String())
+	}
+	for _, b := range p.TypeBlocks() {
+		c.TypeBlocks = append(c.TypeBlocks, b.String())
+	}
+	p.mu.RLock()
+	c.Default = append([]string{}, p.Default...)
+	p.mu.RUnlock()
+	return c
+}
+
+// SetConfig replaces the configuration of the proxy with the one of a
+// peer, keeping the routes discovered, at once (see Update). Only the lists
+// which changed are replaced, so that the state of the upstreams of the
+// others is kept. It returns whether any did.
+func (p *Proxy) SetConfig(c *Config) (bool, error) {
+	var routes []*Route
+	for _, s := range c.Routes {
+		r, err := ParseRoute(s)
+		if err != nil {
+			return false, fmt.Errorf("invalid route %q: %v", s, err)
+		}
+		routes = append(routes, r)
+	}
+	var blocks []*Rule
+	for _, s := range c.Blocks {
+		b, err := ParseRule(s)
+		if err != nil {
+			return false, fmt.Errorf("invalid block %q: %v", s, err)
+		}
+		blocks = append(blocks, b)
+	}
+	var typeBlocks []*TypeBlock
+	for _, s := range c.TypeBlocks {
+		b, err := ParseTypeBlock(s)
+		if err != nil {
+			return false, fmt.Errorf("invalid type block %q: %v", s, err)
+		}
+		typeBlocks = append(typeBlocks, b)
+	}
+	if len(c.Default) == 0 {
+		return false, fmt.Errorf("no default upstream")
+	}
+	old := p.Config()
+	changed := false
+	p.Update(func(s *Snapshot) {
+		if !sameStrings(old.Routes, c.Routes) {
+			for _, r := range s.Routes {
+				if r.spec == "" {
+					routes = append(routes, r)
+				}
+			}
+			s.Routes = routes
+			changed = true
+		}
+		if !sameStrings(old.Blocks, c.Blocks) {
+			s.Blocks = blocks
+			changed = true
+		}
+		if !sameStrings(old.TypeBlocks, c.TypeBlocks) {
+			s.TypeBlocks = typeBlocks
+			changed = true
+		}
+		if !sameStrings(old.Default, c.Default) {
+			s.Default = append([]string(nil), c.Default...)
+			changed = true
+		}
+	})
+	return changed, nil
+}
+
+// sameStrings reports whether two lists have the same strings in the same
+// order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A cacheSaver is a Cache which can be saved and loaded, as MemoryCache.
+type cacheSaver interface {
+	Save(w io.Writer) error
+	Load(r io.Reader) (int, error)
+}
+
+// A Peer keeps a proxy in sync with the other proxy of an active/standby
+// pair, e.g. sharing an address with VRRP (keepalived): it copies the
+// Config of the peer, through its administration API, every Interval and
+// its cache every CacheInterval if set, so that the standby
+// answers the same, from a warm cache, once the address moves to it. The
+// active proxy needs no Peer: changes are made to it, the standby follows.
+// Both proxies signal their health to VRRP with WatchHealth or /ready.
+type Peer struct {
+	Proxy *Proxy
+	// URL of the administration API of the peer, e.g. http://10.0.0.2:8053.
+	URL      string
+	Interval time.Duration
+	// CacheInterval is how often the cache of the peer is copied, 0 for
+	// never. Only a MemoryCache can be copied, a RedisCache is shared.
+	CacheInterval time.Duration
+	// Alert is called with an EventRefreshError when the peer cannot be
+	// synced, once until it can again, if not nil.
+	Alert func(*Event)
+	// Client to query the peer with, a client with a 10s timeout if nil.
+	Client *http.Client
+}
+
+// get gets a path of the administration API of the peer.
+func (s *Peer) get(path string) (*http.Response, error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(strings.TrimSuffix(s.URL, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Sync copies the configuration of the peer.
+func (s *Peer) Sync() error {
+	resp, err := s.get("/config")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var c Config
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return err
+	}
+	changed, err := s.Proxy.SetConfig(&c)
+	if err != nil {
+		return err
+	}
+	if changed {
+		s.Proxy.logf("dnsproxy: synced configuration of peer %s", s.URL)
+	}
+	return nil
+}
+
+// SyncCache adds the responses cached by the peer to the cache and returns
+// how many.
+func (s *Peer) SyncCache() (int, error) {
+	cache, ok := s.Proxy.Cache.(cacheSaver)
+	if !ok {
+		return 0, fmt.Errorf("cache cannot be copied")
+	}
+	resp, err := s.get("/cache/snapshot")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return cache.Load(resp.Body)
+}
+
+// Run syncs the configuration every Interval, and the cache every
+// CacheInterval, until stop is closed.
+func (s *Peer) Run(stop <-chan struct{}) {
+	var cache <-chan time.Time
+	if s.CacheInterval > 0 {
+		t := time.NewTicker(s.CacheInterval)
+		defer t.Stop()
+		cache = t.C
+		if _, err := s.SyncCache(); err != nil {
+			s.Proxy.logf("dnsproxy: cannot copy cache of peer %s: %v", s.URL, err)
+		}
+	}
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	failed := false
+	for {
+		err := s.Sync()
+		if err != nil && !failed && s.Alert != nil {
+			s.Alert(&Event{Time: time.Now(), Kind: EventRefreshError,
+				Message: fmt.Sprintf("cannot sync peer %s: %v", s.URL, err)})
+		}
+		failed = err != nil
+		for wait := true; wait; {
+			select {
+			case <-stop:
+				return
+			case <-cache:
+				if _, err := s.SyncCache(); err != nil {
+					s.Proxy.logf("dnsproxy: cannot copy cache of peer %s: %v", s.URL, err)
+				}
+			case <-t.C:
+				wait = false
+			}
+		}
+	}
+}
+
+func (p *Proxy) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, p.Config())
+}
+
+func (p *Proxy) adminCacheSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cache, ok := p.Cache.(cacheSaver)
+	if !ok {
+		http.Error(w, "no cache to copy", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	cache.Save(w)
+}
@@ -0,0 +1,74 @@
+package dnsproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParsePin parses the pin of a TLS identity: the SHA-256 hash of the
+// SubjectPublicKeyInfo of a certificate, in base64 as in DNS over TLS
+// profiles (RFC 7858), optionally prefixed "sha256/" or "pin-sha256=", or in
+// hex.
+func ParsePin(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "sha256/"), "pin-sha256=")
+	s = strings.Trim(s, `"`)
+	pin, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(pin) != sha256.Size {
+		pin, err = hex.DecodeString(s)
+	}
+	if err != nil || len(pin) != sha256.Size {
+		return nil, errors.New("pin must be a SHA-256 hash in base64 or hex")
+	}
+	return pin, nil
+}
+
+// spkiHash returns the pin of a certificate.
+func spkiHash(cert *x509.Certificate) []byte {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return h[:]
+}
+
+// upstreamTLSConfig returns the TLS configuration to connect to the
+// upstream server host. If it has TLSPins, a certificate of its verified
+// chain must match one of them, or only its own certificate with
+// TLSPinsOnly, which skips CA validation.
+func (p *Proxy) upstreamTLSConfig(host string) *tls.Config {
+	config := &tls.Config{ServerName: host}
+	var pins [][]byte
+	for _, s := range p.TLSPins[strings.ToLower(host)] {
+		if pin, err := ParsePin(s); err == nil {
+			pins = append(pins, pin)
+		}
+	}
+	if len(pins) == 0 {
+		return config
+	}
+	config.InsecureSkipVerify = p.TLSPinsOnly
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		certs := cs.PeerCertificates
+		if !p.TLSPinsOnly {
+			certs = nil
+			for _, chain := range cs.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+		} else if len(certs) > 0 {
+			certs = certs[:1]
+		}
+		for _, cert := range certs {
+			hash := spkiHash(cert)
+			for _, pin := range pins {
+				if string(hash) == string(pin) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no certificate of %s matches its pins", host)
+	}
+	return config
+}
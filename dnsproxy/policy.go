@@ -0,0 +1,404 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Policy is an ordered list of rules read from a file, one per line:
+//
+//	condition => action
+//
+// The condition is an expression in Go syntax over the variables qname
+// (lower case), uname (qname with U-labels, see UnicodeName), qtype,
+// client, group, identity (strings), hour, minute (ints), weekday
+// ("Mon"...) and mixed (a bool, see MixedScript), and the functions
+// suffix(s, suffix), match(s, regexp) and incidr(ip, cidr). The action is
+// one of forward("host:port"), block (NXDOMAIN), refuse (REFUSED),
+// rewrite("name") which routes the query as if it was for name, or
+// strip("ech,ipv6hint") which removes SvcParams from the SVCB and HTTPS
+// records of the response. The first rule whose condition is true applies.
+//
+// A query forwarded by a rule is not blocked by the block rules nor the
+// type blocks, which only apply to queries not yet given an upstream: a
+// forward rule also allows what they would block, e.g. a name of the LAN
+// under a blocked domain. Response policy zones still apply.
+//
+// Empty lines and lines starting with # are ignored.
+type Policy []*policyRule
+
+type policyRule struct {
+	cond   evalFunc
+	action verdict
+}
+
+type verdictKind int
+
+const (
+	verdictNone verdictKind = iota
+	verdictForward
+	verdictBlock
+	verdictRefuse
+	verdictRewrite
+	verdictStrip
+)
+
+func (k verdictKind) String() string {
+	return [...]string{"", "forward", "block", "refuse", "rewrite", "strip"}[k]
+}
+
+// verdict is the outcome of a policy for a query.
+type verdict struct {
+	kind verdictKind
+	arg  string        // forward address or rewritten name
+	keys []dns.SVCBKey // stripped
+}
+
+// policyEnv holds the variables a condition is evaluated against.
+type policyEnv struct {
+	qname, qtype, client, group, identity string
+	now                                   time.Time
+}
+
+func newPolicyEnv(q *Query) *policyEnv {
+	e := &policyEnv{
+		qname:    strings.ToLower(q.Req.Question[0].Name),
+		qtype:    dns.TypeToString[q.Req.Question[0].Qtype],
+		group:    q.Group,
+		identity: q.Identity,
+		now:      q.Time,
+	}
+	if q.Client != nil {
+		e.client = q.Client.String()
+	}
+	return e
+}
+
+// LoadPolicy reads a policy from a file.
+func LoadPolicy(path string) (Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPolicy(path, f)
+}
+
+// ParsePolicy parses a policy from its text, the content of a policy file.
+func ParsePolicy(text string) (Policy, error) {
+	return readPolicy("policy", strings.NewReader(text))
+}
+
+// readPolicy reads a policy, naming errors after the file name.
+func readPolicy(name string, in io.Reader) (Policy, error) {
+	var p Policy
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		p = append(p, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parsePolicyRule(line string) (*policyRule, error) {
+	i := strings.LastIndex(line, "=>")
+	if i < 0 {
+		return nil, fmt.Errorf("must be condition => action")
+	}
+	expr, err := parser.ParseExpr(line[:i])
+	if err != nil {
+		return nil, fmt.Errorf("condition: %v", err)
+	}
+	cond, kind, err := compileExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if kind != kindBool {
+		return nil, fmt.Errorf("condition must be a boolean, got %v", kind)
+	}
+	action, err := parseAction(strings.TrimSpace(line[i+2:]))
+	if err != nil {
+		return nil, err
+	}
+	return &policyRule{cond: cond, action: action}, nil
+}
+
+func parseAction(s string) (verdict, error) {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		return verdict{}, fmt.Errorf("action: %v", err)
+	}
+	switch e := expr.(type) {
+	case *ast.Ident:
+		switch e.Name {
+		case "block":
+			return verdict{kind: verdictBlock}, nil
+		case "refuse":
+			return verdict{kind: verdictRefuse}, nil
+		}
+	case *ast.CallExpr:
+		fun, ok := e.Fun.(*ast.Ident)
+		if !ok || len(e.Args) != 1 {
+			break
+		}
+		arg, err := stringLiteral(e.Args[0])
+		if err != nil {
+			return verdict{}, fmt.Errorf("action %s: %v", fun.Name, err)
+		}
+		switch fun.Name {
+		case "forward":
+			if !ValidUpstream(arg) {
+				return verdict{}, fmt.Errorf("action forward: invalid upstream %q", arg)
+			}
+			return verdict{kind: verdictForward, arg: arg}, nil
+		case "rewrite":
+			if _, ok := dns.IsDomainName(arg); !ok {
+				return verdict{}, fmt.Errorf("action rewrite: invalid name %q", arg)
+			}
+			return verdict{kind: verdictRewrite, arg: dns.Fqdn(strings.ToLower(arg))}, nil
+		case "strip":
+			keys, err := parseSVCBKeys(arg)
+			if err != nil {
+				return verdict{}, fmt.Errorf("action strip: %v", err)
+			}
+			return verdict{kind: verdictStrip, keys: keys}, nil
+		}
+	}
+	return verdict{}, fmt.Errorf("unknown action %q", s)
+}
+
+// eval returns the verdict of the first rule matching the query.
+func (p Policy) eval(env *policyEnv) verdict {
+	for _, r := range p {
+		if r.cond(env).(bool) {
+			return r.action
+		}
+	}
+	return verdict{}
+}
+
+type kind int
+
+const (
+	kindBool kind = iota
+	kindInt
+	kindString
+)
+
+func (k kind) String() string {
+	return [...]string{"bool", "int", "string"}[k]
+}
+
+type evalFunc func(*policyEnv) interface{}
+
+var policyVars = map[string]struct {
+	kind kind
+	get  evalFunc
+}{
+	"qname":    {kindString, func(e *policyEnv) interface{} { return e.qname }},
+	"uname":    {kindString, func(e *policyEnv) interface{} { return UnicodeName(e.qname) }},
+	"qtype":    {kindString, func(e *policyEnv) interface{} { return e.qtype }},
+	"client":   {kindString, func(e *policyEnv) interface{} { return e.client }},
+	"group":    {kindString, func(e *policyEnv) interface{} { return e.group }},
+	"identity": {kindString, func(e *policyEnv) interface{} { return e.identity }},
+	"hour":     {kindInt, func(e *policyEnv) interface{} { return e.now.Hour() }},
+	"minute":   {kindInt, func(e *policyEnv) interface{} { return e.now.Minute() }},
+	"weekday":  {kindString, func(e *policyEnv) interface{} { return e.now.Weekday().String()[:3] }},
+	"mixed":    {kindBool, func(e *policyEnv) interface{} { return MixedScript(e.qname) }},
+}
+
+// compileExpr type checks an expression and turns it into a closure.
+func compileExpr(expr ast.Expr) (evalFunc, kind, error) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return compileExpr(e.X)
+	case *ast.BasicLit:
+		switch e.Kind {
+		case token.INT:
+			n, err := strconv.Atoi(e.Value)
+			if err != nil {
+				return nil, 0, err
+			}
+			return func(*policyEnv) interface{} { return n }, kindInt, nil
+		case token.STRING:
+			s, err := strconv.Unquote(e.Value)
+			if err != nil {
+				return nil, 0, err
+			}
+			return func(*policyEnv) interface{} { return s }, kindString, nil
+		}
+	case *ast.Ident:
+		switch e.Name {
+		case "true", "false":
+			b := e.Name == "true"
+			return func(*policyEnv) interface{} { return b }, kindBool, nil
+		}
+		if v, ok := policyVars[e.Name]; ok {
+			return v.get, v.kind, nil
+		}
+		return nil, 0, fmt.Errorf("unknown variable %q", e.Name)
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT {
+			break
+		}
+		x, k, err := compileExpr(e.X)
+		if err != nil {
+			return nil, 0, err
+		}
+		if k != kindBool {
+			return nil, 0, fmt.Errorf("operator ! needs a bool, got %v", k)
+		}
+		return func(env *policyEnv) interface{} { return !x(env).(bool) }, kindBool, nil
+	case *ast.BinaryExpr:
+		return compileBinary(e)
+	case *ast.CallExpr:
+		return compileCall(e)
+	}
+	return nil, 0, fmt.Errorf("unsupported expression %T", expr)
+}
+
+func compileBinary(e *ast.BinaryExpr) (evalFunc, kind, error) {
+	x, kx, err := compileExpr(e.X)
+	if err != nil {
+		return nil, 0, err
+	}
+	y, ky, err := compileExpr(e.Y)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kx != ky {
+		return nil, 0, fmt.Errorf("mismatched types %v %s %v", kx, e.Op, ky)
+	}
+	switch e.Op {
+	case token.LAND, token.LOR:
+		if kx != kindBool {
+			return nil, 0, fmt.Errorf("operator %s needs bools, got %v", e.Op, kx)
+		}
+		if e.Op == token.LAND {
+			return func(env *policyEnv) interface{} { return x(env).(bool) && y(env).(bool) }, kindBool, nil
+		}
+		return func(env *policyEnv) interface{} { return x(env).(bool) || y(env).(bool) }, kindBool, nil
+	case token.EQL:
+		return func(env *policyEnv) interface{} { return x(env) == y(env) }, kindBool, nil
+	case token.NEQ:
+		return func(env *policyEnv) interface{} { return x(env) != y(env) }, kindBool, nil
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		if kx != kindInt {
+			return nil, 0, fmt.Errorf("operator %s needs ints, got %v", e.Op, kx)
+		}
+		op := e.Op
+		return func(env *policyEnv) interface{} {
+			a, b := x(env).(int), y(env).(int)
+			switch op {
+			case token.LSS:
+				return a < b
+			case token.LEQ:
+				return a <= b
+			case token.GTR:
+				return a > b
+			}
+			return a >= b
+		}, kindBool, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported operator %s", e.Op)
+}
+
+func compileCall(e *ast.CallExpr) (evalFunc, kind, error) {
+	fun, ok := e.Fun.(*ast.Ident)
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported call")
+	}
+	if len(e.Args) != 2 {
+		return nil, 0, fmt.Errorf("%s needs 2 arguments", fun.Name)
+	}
+	x, k, err := compileExpr(e.Args[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	if k != kindString {
+		return nil, 0, fmt.Errorf("%s needs a string, got %v", fun.Name, k)
+	}
+	// The second argument is a literal so it can be checked and compiled once.
+	arg, err := stringLiteral(e.Args[1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", fun.Name, err)
+	}
+	switch fun.Name {
+	case "suffix":
+		arg = strings.ToLower(arg)
+		return func(env *policyEnv) interface{} { return strings.HasSuffix(x(env).(string), arg) }, kindBool, nil
+	case "match":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("match: %v", err)
+		}
+		return func(env *policyEnv) interface{} { return re.MatchString(x(env).(string)) }, kindBool, nil
+	case "incidr":
+		n, err := ParseNet(arg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("incidr: %v", err)
+		}
+		return func(env *policyEnv) interface{} {
+			ip := net.ParseIP(x(env).(string))
+			return ip != nil && n.Contains(ip)
+		}, kindBool, nil
+	}
+	return nil, 0, fmt.Errorf("unknown function %q", fun.Name)
+}
+
+func stringLiteral(expr ast.Expr) (string, error) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", fmt.Errorf("argument must be a string literal")
+	}
+	return strconv.Unquote(lit.Value)
+}
+
+// rewriteWriter restores the original query name in responses to a query
+// that was rewritten by a policy.
+type rewriteWriter struct {
+	dns.ResponseWriter
+	from, to string // original and rewritten name
+}
+
+func (w *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	for i := range m.Question {
+		if strings.EqualFold(m.Question[i].Name, w.to) {
+			m.Question[i].Name = w.from
+		}
+	}
+	for _, rr := range m.Answer {
+		if !strings.EqualFold(rr.Header().Name, w.to) {
+			continue
+		}
+		// A target of "." stands for the owner, the rewritten name is
+		// where the endpoints are.
+		if s := svcbOf(rr); s != nil {
+			s.Target = svcbTarget(s)
+		}
+		rr.Header().Name = w.from
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
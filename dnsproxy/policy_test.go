@@ -0,0 +1,172 @@
+package dnsproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, tt := range []struct {
+		rule string
+		err  string
+	}{
+		{`qname == "example.com."`, "must be condition => action"},
+		{`qname == => block`, "condition: "},
+		{`hour => block`, "condition must be a boolean, got int"},
+		{`host == "example.com." => block`, `unknown variable "host"`},
+		{`hour == "21" => block`, "mismatched types int == string"},
+		{`qname < "m" => block`, "operator < needs ints, got string"},
+		{`1 && 2 => block`, "operator && needs bools, got int"},
+		{`!hour => block`, "operator ! needs a bool, got int"},
+		{`-hour < 0 => block`, "unsupported expression *ast.UnaryExpr"},
+		{`hour + 1 > 21 => block`, "unsupported operator +"},
+		{`suffix(qname) => block`, "suffix needs 2 arguments"},
+		{`suffix(hour, ".example.") => block`, "suffix needs a string, got int"},
+		{`suffix(qname, group) => block`, "suffix: argument must be a string literal"},
+		{`match(qname, "(") => block`, "match: "},
+		{`incidr(client, "10.0.0.0/33") => block`, "incidr: "},
+		{`lookup(qname, "x") => block`, `unknown function "lookup"`},
+		{`true => allow`, `unknown action "allow"`},
+		{`true => forward(upstream)`, "action forward: argument must be a string literal"},
+		{`true => forward("")`, `action forward: invalid upstream ""`},
+		{`true => rewrite("a..example.")`, `action rewrite: invalid name "a..example."`},
+		{`true => strip("bogus")`, `action strip: invalid SvcParam key "bogus"`},
+		{`true => strip("mandatory")`, `action strip: invalid SvcParam key "mandatory"`},
+	} {
+		_, err := ParsePolicy(tt.rule)
+		if err == nil {
+			t.Errorf("%s: no error", tt.rule)
+			continue
+		}
+		if want := "policy:1: " + tt.err; !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: got error %q; want %q", tt.rule, err, want)
+		}
+	}
+}
+
+func TestParsePolicyLines(t *testing.T) {
+	p, err := ParsePolicy("# comment\n\n  true => block  \n")
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+	if len(p) != 1 {
+		t.Fatalf("got %d rules; want 1", len(p))
+	}
+	_, err = ParsePolicy("# comment\ntrue => block\n\nfalse =>\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "policy:4: ") {
+		t.Errorf("got error %v; want one on line 4", err)
+	}
+}
+
+func TestPolicyConditions(t *testing.T) {
+	// A Thursday evening.
+	now := time.Date(2026, 10, 15, 21, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		cond  string
+		qname string // www.example.com. if empty
+		want  bool
+	}{
+		// Variables.
+		{`qname == "www.example.com."`, "", true},
+		{`qname == "example.com."`, "", false},
+		{`uname == "bücher.example."`, "xn--bcher-kva.example.", true},
+		{`uname == "www.example.com."`, "", true},
+		{`qtype == "AAAA"`, "", true},
+		{`qtype != "A"`, "", true},
+		{`client == "192.0.2.7"`, "", true},
+		{`group == "kids"`, "", true},
+		{`identity == "laptop"`, "", true},
+		{`hour == 21`, "", true},
+		{`minute == 30`, "", true},
+		{`weekday == "Thu"`, "", true},
+		{`mixed`, "", false},
+		{`mixed`, "xn--pple-43d.com.", true}, // Cyrillic а
+		// Functions.
+		{`suffix(qname, ".example.com.")`, "", true},
+		{`suffix(qname, ".EXAMPLE.com.")`, "", true},
+		{`suffix(qname, ".example.org.")`, "", false},
+		{`match(qname, "^www[.]")`, "", true},
+		{`match(qname, "^mail[.]")`, "", false},
+		{`incidr(client, "192.0.2.0/24")`, "", true},
+		{`incidr(client, "198.51.100.0/24")`, "", false},
+		{`incidr(qname, "192.0.2.0/24")`, "", false},
+		// Comparisons.
+		{`hour < 22`, "", true},
+		{`hour <= 21`, "", true},
+		{`hour > 21`, "", false},
+		{`hour >= 21`, "", true},
+		{`hour != 21`, "", false},
+		// Operator precedence: ! binds tighter than &&, which binds
+		// tighter than ||.
+		{`true || false && false`, "", true},
+		{`(true || false) && false`, "", false},
+		{`false && false || true`, "", true},
+		{`false && (false || true)`, "", false},
+		{`!false && false`, "", false},
+		{`!(false && false)`, "", true},
+		{`hour >= 18 && hour < 22 || weekday == "Sat"`, "", true},
+		{`group == "kids" && (hour < 7 || hour >= 21)`, "", true},
+	} {
+		p, err := ParsePolicy(tt.cond + " => block")
+		if err != nil {
+			t.Errorf("%s: %v", tt.cond, err)
+			continue
+		}
+		env := &policyEnv{qname: tt.qname, qtype: "AAAA", client: "192.0.2.7",
+			group: "kids", identity: "laptop", now: now}
+		if env.qname == "" {
+			env.qname = "www.example.com."
+		}
+		if got := p.eval(env).kind == verdictBlock; got != tt.want {
+			t.Errorf("%s for %s: got %v; want %v", tt.cond, env.qname, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyActions(t *testing.T) {
+	p, err := ParsePolicy(`
+qtype == "ANY" => refuse
+suffix(qname, ".ads.example.") => block
+qname == "printer.lan." => forward("192.168.1.1:53")
+qname == "intranet." => rewrite("Intranet.Example.com")
+qtype == "HTTPS" => strip("ech,ipv6hint")
+suffix(qname, ".lan.") => block
+`)
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+	for _, tt := range []struct {
+		qname, qtype string
+		want         verdict
+	}{
+		{"x.ads.example.", "ANY", verdict{kind: verdictRefuse}},
+		{"x.ads.example.", "A", verdict{kind: verdictBlock}},
+		{"printer.lan.", "A", verdict{kind: verdictForward, arg: "192.168.1.1:53"}},
+		{"intranet.", "A", verdict{kind: verdictRewrite, arg: "intranet.example.com."}},
+		{"www.example.com.", "HTTPS", verdict{kind: verdictStrip,
+			keys: []dns.SVCBKey{dns.SVCB_ECHCONFIG, dns.SVCB_IPV6HINT}}},
+		{"nas.lan.", "A", verdict{kind: verdictBlock}},
+		{"www.example.com.", "A", verdict{}},
+	} {
+		got := p.eval(&policyEnv{qname: tt.qname, qtype: tt.qtype})
+		if got.kind != tt.want.kind || got.arg != tt.want.arg || !equalKeys(got.keys, tt.want.keys) {
+			t.Errorf("%s %s: got %v %q %v; want %v %q %v", tt.qname, tt.qtype,
+				got.kind, got.arg, got.keys, tt.want.kind, tt.want.arg, tt.want.keys)
+		}
+	}
+}
+
+func equalKeys(a, b []dns.SVCBKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV2Sig starts PROXY protocol version 2 headers.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// trusted reports whether addr is within one of the networks.
+func trusted(nets []*net.IPNet, addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener accepts connections starting with a PROXY protocol header
+// from trusted load balancers, and plain connections from anyone else.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil || !trusted(l.trusted, c.RemoteAddr()) {
+		return c, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn is a connection from a load balancer, whose remote address is
+// the one of the client given by the PROXY protocol header. The header is
+// read on first use, so as not to block accepting connections.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		ip, port, err := readProxyHeader(c.r)
+		if err != nil {
+			c.err = fmt.Errorf("proxy protocol: %v", err)
+			return
+		}
+		if ip != nil {
+			c.remote = &net.TCPAddr{IP: ip, Port: port}
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header, version 1 or 2, and
+// returns the source address it gives, nil for a local connection (e.g.
+// health checks of the load balancer) or one of an unknown protocol.
+func readProxyHeader(r *bufio.Reader) (net.IP, int, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, 0, err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, 0, err
+		}
+		return parseProxyV2(hdr, body)
+	}
+	// Version 1 is a line of at most 107 bytes.
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, 0, errors.New("invalid header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, 0, errors.New("invalid header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, 0, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, errors.New("invalid header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, 0, errors.New("invalid source address")
+	}
+	return ip, port, nil
+}
+
+// parseProxyV2 parses the 16 bytes header and the addresses of a PROXY
+// protocol version 2 header.
+func parseProxyV2(hdr, body []byte) (net.IP, int, error) {
+	if hdr[12]>>4 != 2 {
+		return nil, 0, fmt.Errorf("unsupported version %d", hdr[12]>>4)
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL
+		return nil, 0, nil
+	case 1: // PROXY
+	default:
+		return nil, 0, fmt.Errorf("unsupported command %d", hdr[12]&0xf)
+	}
+	var size int
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default:
+		return nil, 0, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, 0, errors.New("short addresses")
+	}
+	ip := net.IP(append([]byte(nil), body[:size]...))
+	return ip, int(binary.BigEndian.Uint16(body[2*size:])), nil
+}
+
+// proxyPacketConn receives datagrams starting with a PROXY protocol
+// version 2 header from trusted load balancers, and plain datagrams from
+// anyone else. Responses to clients behind a load balancer are sent back
+// to the load balancer.
+type proxyPacketConn struct {
+	net.PacketConn
+	trusted []*net.IPNet
+}
+
+// proxiedAddr is the address of a client behind a load balancer.
+type proxiedAddr struct {
+	client *net.UDPAddr
+	via    net.Addr
+}
+
+func (a *proxiedAddr) Network() string { return "udp" }
+func (a *proxiedAddr) String() string  { return a.client.String() }
+
+func (c *proxyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !trusted(c.trusted, addr) {
+			return n, addr, err
+		}
+		if n < 16 || !bytes.Equal(b[:len(proxyV2Sig)], proxyV2Sig) {
+			continue
+		}
+		end := 16 + int(binary.BigEndian.Uint16(b[14:]))
+		if end > n {
+			continue
+		}
+		ip, port, err := parseProxyV2(b[:16], b[16:end])
+		if err != nil {
+			continue
+		}
+		n = copy(b, b[end:n])
+		if ip == nil {
+			return n, addr, nil
+		}
+		return n, &proxiedAddr{client: &net.UDPAddr{IP: ip, Port: port}, via: addr}, nil
+	}
+}
+
+func (c *proxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if a, ok := addr.(*proxiedAddr); ok {
+		addr = a.via
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,85 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a PROXY protocol version 2 header of a command and an
+// address family, followed by the addresses.
+func proxyV2(cmd, family byte, addrs []byte) string {
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+var (
+	// 192.0.2.7:5353 to 198.51.100.1:53.
+	proxyV2Addrs4 = []byte{192, 0, 2, 7, 198, 51, 100, 1, 0x14, 0xe9, 0, 53}
+	// [2001:db8::7]:5353 to [2001:db8::1]:53.
+	proxyV2Addrs6 = []byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x14, 0xe9, 0, 53}
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header string
+		ip     string // nil if empty
+		port   int
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.7 198.51.100.1 5353 53\r\n", "192.0.2.7", 5353, false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 5353 53\r\n", "2001:db8::7", 5353, false},
+		{"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", 0, false},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.7 198.51.100.1 5353 53\n", "", 0, true},
+		{"v1 not proxy", "GET / HTTP/1.1\r\n", "", 0, true},
+		{"v1 udp", "PROXY UDP4 192.0.2.7 198.51.100.1 5353 53\r\n", "", 0, true},
+		{"v1 missing port", "PROXY TCP4 192.0.2.7 198.51.100.1 5353\r\n", "", 0, true},
+		{"v1 invalid ip", "PROXY TCP4 192.0.2.256 198.51.100.1 5353 53\r\n", "", 0, true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.7 198.51.100.1 65536 53\r\n", "", 0, true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.7 198.51", "", 0, true},
+		{"v1 oversized", "PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n", "", 0, true},
+		{"v2 proxy tcp4", proxyV2(1, 0x11, proxyV2Addrs4), "192.0.2.7", 5353, false},
+		{"v2 proxy udp6", proxyV2(1, 0x22, proxyV2Addrs6), "2001:db8::7", 5353, false},
+		// Type-length-value fields may follow the addresses.
+		{"v2 proxy tlv", proxyV2(1, 0x11, append(append([]byte(nil), proxyV2Addrs4...), 4, 0, 1, 0)), "192.0.2.7", 5353, false},
+		{"v2 local", proxyV2(0, 0x00, nil), "", 0, false},
+		{"v2 local addresses", proxyV2(0, 0x11, proxyV2Addrs4), "", 0, false},
+		{"v2 unspec", proxyV2(1, 0x00, nil), "", 0, false},
+		{"v2 unix", proxyV2(1, 0x31, make([]byte, 216)), "", 0, false},
+		{"v2 command", proxyV2(2, 0x11, proxyV2Addrs4), "", 0, true},
+		{"v2 version", "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c" + string(proxyV2Addrs4), "", 0, true},
+		{"v2 short addresses", proxyV2(1, 0x21, proxyV2Addrs4), "", 0, true},
+		{"v2 truncated header", proxyV2(1, 0x11, proxyV2Addrs4)[:14], "", 0, true},
+		{"v2 truncated addresses", proxyV2(1, 0x11, proxyV2Addrs4)[:20], "", 0, true},
+		{"v2 oversized", proxyV2(1, 0x11, proxyV2Addrs4)[:14] + "\xff\xff" + string(proxyV2Addrs4), "", 0, true},
+		{"empty", "", "", 0, true},
+	} {
+		// The data following the header must be left to read.
+		r := bufio.NewReader(strings.NewReader(tt.header + "data"))
+		ip, port, err := readProxyHeader(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := ip.String(); (tt.ip == "" && ip != nil) || (tt.ip != "" && got != tt.ip) || port != tt.port {
+			t.Errorf("%s: got %v %d; want %q %d", tt.name, ip, port, tt.ip, tt.port)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "data" {
+			t.Errorf("%s: got data %q; want %q", tt.name, rest, "data")
+		}
+	}
+}
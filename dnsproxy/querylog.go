@@ -0,0 +1,172 @@
+package dnsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A QueryLogEntry is a query answered, as logged.
+type QueryLogEntry struct {
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"`
+	Group    string        `json:"group,omitempty"`
+	Identity string        `json:"identity,omitempty"`
+	TraceID  string        `json:"trace_id,omitempty"`
+	Name     string        `json:"name,omitempty"`    // lower case, empty if redacted
+	Unicode  string        `json:"unicode,omitempty"` // name with U-labels, if it has A-labels
+	Type     string        `json:"type"`
+	Rcode    string        `json:"rcode"`
+	Upstream string        `json:"upstream,omitempty"`
+	Verdict  string        `json:"verdict,omitempty"`
+	Duration time.Duration `json:"duration"`
+	// Sample is the number of queries the entry stands for, if sampled.
+	Sample int `json:"sample,omitempty"`
+}
+
+// A QueryLog writes the queries answered by a proxy to Out, one JSON object
+// per line, anonymized as configured. Create one with NewQueryLog and
+// insert its Stage.
+type QueryLog struct {
+	Out io.Writer
+	// TruncateClients keeps only the first ClientBits4 bits of IPv4
+	// clients and ClientBits6 of IPv6 clients.
+	TruncateClients bool
+	ClientBits4     int
+	ClientBits6     int
+	// HashKey, if not nil, replaces clients (truncated or not) with a
+	// keyed hash of them, so that the queries of a client can be told
+	// apart without knowing who it is.
+	HashKey []byte
+	// Redact, if not nil, leaves out the names matching it, e.g. of
+	// health or banking sites.
+	Redact *regexp.Regexp
+	// Sample, if more than one, logs only one query in Sample, chosen at
+	// random, for deployments too busy to log them all.
+	Sample int
+
+	mu sync.Mutex
+}
+
+// NewQueryLog returns a query log to out, truncating to /24 and /48 if
+// enabled.
+func NewQueryLog(out io.Writer) *QueryLog {
+	return &QueryLog{Out: out, ClientBits4: 24, ClientBits6: 48}
+}
+
+// Stage is the middleware logging queries once answered, for the chain of
+// a proxy.
+func (l *QueryLog) Stage(next Handler) Handler {
+	return func(q *Query) {
+		if q.DryRun || l.Sample > 1 && rand.Intn(l.Sample) != 0 {
+			next(q)
+			return
+		}
+		q.W = &queryLogWriter{ResponseWriter: q.W, log: l, q: q}
+		next(q)
+	}
+}
+
+// queryLogWriter logs the response to a query.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	log *QueryLog
+	q   *Query
+}
+
+func (w *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	e := newQueryLogEntry(w.q, m, w.log.client(w.q.Client))
+	if w.log.Sample > 1 {
+		e.Sample = w.log.Sample
+	}
+	w.log.Log(e)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// newQueryLogEntry returns the entry of the response to a query, with the
+// client as logged.
+func newQueryLogEntry(q *Query, m *dns.Msg, client string) *QueryLogEntry {
+	e := &QueryLogEntry{
+		Time:     q.Time,
+		Client:   client,
+		Group:    q.Group,
+		Identity: q.Identity,
+		TraceID:  q.TraceID,
+		Name:     strings.ToLower(q.Name),
+		Rcode:    dns.RcodeToString[m.Rcode],
+		Upstream: q.Upstream,
+		Verdict:  q.Verdict,
+		Duration: time.Since(q.Time),
+	}
+	if u := UnicodeName(e.Name); u != e.Name {
+		e.Unicode = u
+	}
+	if len(q.Req.Question) > 0 {
+		e.Type = dns.TypeToString[q.Req.Question[0].Qtype]
+	}
+	return e
+}
+
+// truncate returns a client truncated if TruncateClients.
+func (l *QueryLog) truncate(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if l.TruncateClients {
+		if len(ip) == net.IPv4len {
+			ip = ip.Mask(net.CIDRMask(l.ClientBits4, 32))
+		} else {
+			ip = ip.Mask(net.CIDRMask(l.ClientBits6, 128))
+		}
+	}
+	return ip
+}
+
+// client returns a client as logged.
+func (l *QueryLog) client(ip net.IP) string {
+	if ip = l.truncate(ip); ip == nil {
+		return ""
+	}
+	if l.HashKey == nil {
+		return ip.String()
+	}
+	mac := hmac.New(sha256.New, l.HashKey)
+	mac.Write(ip)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Log writes an entry, redacting its name if it matches Redact. Clients
+// must already be anonymized.
+func (l *QueryLog) Log(e *QueryLogEntry) {
+	b, err := json.Marshal(l.redact(e))
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Out.Write(append(b, '\n'))
+}
+
+// redact returns an entry, or a copy of it without its name if it matches
+// Redact.
+func (l *QueryLog) redact(e *QueryLogEntry) *QueryLogEntry {
+	if l.Redact == nil || !l.Redact.MatchString(e.Name) {
+		return e
+	}
+	c := *e
+	c.Name, c.Unicode = "", ""
+	return &c
+}
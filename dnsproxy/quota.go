@@ -0,0 +1,172 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Counters store counters which expire, such as the counters of quotas.
+// MemoryCache and RedisCache implement it, so counters survive restarts
+// with a saved MemoryCache and are shared by the proxies of a RedisCache.
+type Counters interface {
+	// Incr increments the counter of key, created to expire at expires if
+	// it did not exist, and returns its new value.
+	Incr(key string, expires time.Time) (int64, error)
+}
+
+// A Quota limits the queries matched by its rule to Limit per Period, for
+// each client or, if Shared, for all of them together. Queries beyond get
+// Action.
+type Quota struct {
+	Rule
+	Limit int64
+	// Period is an hour or a day, starting at midnight in local time.
+	Period time.Duration
+	Shared bool
+	// Action is "refuse" to answer REFUSED, "nxdomain" to answer
+	// NXDOMAIN, "servfail" to answer SERVFAIL or "drop" not to answer.
+	Action string
+
+	spec string // as parsed
+}
+
+// quotaActions are the valid actions of quotas.
+var quotaActions = map[string]bool{"refuse": true, "nxdomain": true, "servfail": true, "drop": true}
+
+// String returns the quota as parsed.
+func (qt *Quota) String() string { return qt.spec }
+
+// ParseQuota parses a quota of the form domain=limit/hour|day[;option=...],
+// with the same options as ParseRule, per=client (default) or per=all to
+// share the limit between the clients matched, and action=refuse
+// (default), nxdomain, servfail or drop.
+func ParseQuota(s string) (*Quota, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return nil, errors.New("must be domain=limit/period")
+	}
+	opts := strings.Split(kv[1], ";")
+	limit, period, ok := strings.Cut(opts[0], "/")
+	qt := &Quota{Rule: *NewRule(kv[0]), Action: "refuse", spec: s}
+	var err error
+	if qt.Limit, err = strconv.ParseInt(limit, 10, 64); !ok || err != nil || qt.Limit < 0 {
+		return nil, fmt.Errorf("invalid limit %q, must be limit/hour or limit/day", opts[0])
+	}
+	switch period {
+	case "hour":
+		qt.Period = time.Hour
+	case "day":
+		qt.Period = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("invalid period %q, must be hour or day", period)
+	}
+	var rest []string
+	for _, opt := range opts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		switch {
+		case len(kv) == 2 && kv[0] == "per":
+			if kv[1] != "client" && kv[1] != "all" {
+				return nil, fmt.Errorf("invalid per %q, must be client or all", kv[1])
+			}
+			qt.Shared = kv[1] == "all"
+		case len(kv) == 2 && kv[0] == "action":
+			if !quotaActions[kv[1]] {
+				return nil, fmt.Errorf("invalid action %q, must be refuse, nxdomain, servfail or drop", kv[1])
+			}
+			qt.Action = kv[1]
+		default:
+			rest = append(rest, opt)
+		}
+	}
+	if err := qt.setOptions(rest); err != nil {
+		return nil, err
+	}
+	return qt, nil
+}
+
+// isCounter reports whether a key of a cache is the one of a counter of a
+// quota rather than of a response.
+func isCounter(key string) bool {
+	return strings.HasPrefix(key, "quota ")
+}
+
+// window returns the start and end of the period of the quota at now.
+func (qt *Quota) window(now time.Time) (time.Time, time.Time) {
+	y, m, d := now.Date()
+	if qt.Period == time.Hour {
+		// In local time too, for zones offset by half an hour.
+		start := time.Date(y, m, d, now.Hour(), 0, 0, 0, now.Location())
+		return start, start.Add(time.Hour)
+	}
+	start := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// Quotas returns the quotas.
+func (p *Proxy) Quotas() []*Quota {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Quota(nil), p.quotas...)
+}
+
+// SetQuotas replaces the quotas. Every quota matching a query counts it.
+func (p *Proxy) SetQuotas(quotas []*Quota) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quotas = append([]*Quota(nil), quotas...)
+}
+
+// counters returns where the counters of quotas are kept: the cache if it
+// can, else memory.
+func (p *Proxy) counters() Counters {
+	if c, ok := p.Cache.(Counters); ok {
+		return c
+	}
+	return p.quotaCounters
+}
+
+// quotaStage applies the action of the first quota a query exceeds, if
+// any. Queries are let through when counters fail.
+func (p *Proxy) quotaStage(next Handler) Handler {
+	return func(q *Query) {
+		for _, qt := range p.Quotas() {
+			if !qt.MatchQuery(q) {
+				continue
+			}
+			who := "all"
+			if !qt.Shared {
+				who = q.Client.String()
+			}
+			if q.DryRun {
+				p.debugf(q, "counts against quota %s", qt)
+				continue
+			}
+			start, end := qt.window(q.Time)
+			key := fmt.Sprintf("quota %s %s %d", qt.spec, who, start.Unix())
+			n, err := p.counters().Incr(key, end)
+			if err != nil {
+				p.debugf(q, "quota %s: %v", qt, err)
+				continue
+			}
+			if n <= qt.Limit {
+				continue
+			}
+			p.debugf(q, "exceeded quota %s", qt)
+			switch qt.Action {
+			case "refuse":
+				reply(q.W, q.Req, dns.RcodeRefused)
+			case "nxdomain":
+				reply(q.W, q.Req, dns.RcodeNameError)
+			case "servfail":
+				reply(q.W, q.Req, dns.RcodeServerFailure)
+			}
+			return
+		}
+		next(q)
+	}
+}
@@ -0,0 +1,104 @@
+package dnsproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Actions of RebindProtection.
+const (
+	RebindStrip  = "strip"  // remove the private addresses from answers
+	RebindRefuse = "refuse" // answer REFUSED instead
+)
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), private
+// too but not to net.IP.IsPrivate.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// rebindIP reports whether an address of an answer from a public upstream
+// can only be internal: private, shared, loopback, link-local or
+// unspecified.
+func rebindIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// rebindProtected reports whether the responses to a query are protected
+// from DNS rebinding: those of public upstreams, the default ones or those
+// of the route for ., or of any upstream with RebindRouted, unless the name
+// is under one of RebindAllow.
+func (p *Proxy) rebindProtected(q *Query) bool {
+	if p.RebindProtection == "" || q.Upstream == "" {
+		return false
+	}
+	switch {
+	case p.RebindRouted:
+	case q.Route != nil:
+		if q.Route.Domain != "." {
+			return false
+		}
+	case !p.isDefault(q):
+		return false
+	}
+	name := strings.ToLower(q.Name)
+	for _, d := range p.RebindAllow {
+		if d = dns.Fqdn(strings.ToLower(strings.TrimPrefix(d, "."))); dns.IsSubDomain(d, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// rebindStage protects clients from DNS rebinding attacks, where a public
+// name answers the address of an internal device for a script of a web
+// page to reach it, see RebindProtection.
+func (p *Proxy) rebindStage(next Handler) Handler {
+	return func(q *Query) {
+		if !q.DryRun && p.rebindProtected(q) {
+			q.W = &rebindWriter{ResponseWriter: q.W, p: p, q: q}
+		}
+		next(q)
+	}
+}
+
+// rebindWriter strips the internal addresses from the responses to a
+// query, or refuses them.
+type rebindWriter struct {
+	dns.ResponseWriter
+	p *Proxy
+	q *Query
+}
+
+func (w *rebindWriter) WriteMsg(m *dns.Msg) error {
+	var answer []dns.RR
+	stripped := 0
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip != nil && rebindIP(ip) {
+			stripped++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	if stripped == 0 {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	w.q.Verdict = "rebind"
+	if w.p.RebindProtection == RebindRefuse {
+		w.p.debugf(w.q, "refused, %d internal addresses answered", stripped)
+		r := new(dns.Msg)
+		r.SetRcode(w.q.Req, dns.RcodeRefused)
+		return w.ResponseWriter.WriteMsg(r)
+	}
+	w.p.debugf(w.q, "stripped %d internal addresses", stripped)
+	m.Answer = answer
+	return w.ResponseWriter.WriteMsg(m)
+}
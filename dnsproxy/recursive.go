@@ -0,0 +1,415 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Recursive is the upstream which resolves queries iteratively from the
+// root servers, with the Recursor of the proxy, instead of forwarding them.
+const Recursive = "recursive"
+
+const (
+	// recursiveTimeout bounds each query to an authoritative server.
+	recursiveTimeout = 2 * time.Second
+	// maxRecursionDepth bounds the nested resolutions of the names of
+	// servers without glue and of CNAME targets.
+	maxRecursionDepth = 8
+	// maxCNAMEs bounds the aliases followed to answer a query.
+	maxCNAMEs = 8
+	// maxRecursiveQueries bounds the queries sent to resolve a query.
+	maxRecursiveQueries = 100
+	// maxDelegations bounds the delegations cached before starting over.
+	maxDelegations = 10000
+	// maxDelegationTTL bounds how long a delegation is cached.
+	maxDelegationTTL = 24 * time.Hour
+)
+
+// RootServers are the addresses of the root servers (root hints).
+var RootServers = []string{
+	"198.41.0.4:53", "[2001:503:ba3e::2:30]:53", // a.root-servers.net
+	"170.247.170.2:53", "[2801:1b8:10::b]:53", // b.root-servers.net
+	"192.33.4.12:53", "[2001:500:2::c]:53", // c.root-servers.net
+	"199.7.91.13:53", "[2001:500:2d::d]:53", // d.root-servers.net
+	"192.203.230.10:53", "[2001:500:a8::e]:53", // e.root-servers.net
+	"192.5.5.241:53", "[2001:500:2f::f]:53", // f.root-servers.net
+	"192.112.36.4:53", "[2001:500:12::d0d]:53", // g.root-servers.net
+	"198.97.190.53:53", "[2001:500:1::53]:53", // h.root-servers.net
+	"192.36.148.17:53", "[2001:7fe::53]:53", // i.root-servers.net
+	"192.58.128.30:53", "[2001:503:c27::2:30]:53", // j.root-servers.net
+	"193.0.14.129:53", "[2001:7fd::1]:53", // k.root-servers.net
+	"199.7.83.42:53", "[2001:500:9f::42]:53", // l.root-servers.net
+	"202.12.27.33:53", "[2001:dc3::35]:53", // m.root-servers.net
+}
+
+// LoadRootHints returns the addresses of the root servers of a root hints
+// file (named.root), the A and AAAA records of the servers of its NS
+// records for the root, e.g. of the roots of an air-gapped network.
+func LoadRootHints(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	servers := make(map[string]bool)
+	var addrs []dns.RR
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if rr.Hdr.Name == "." {
+				servers[strings.ToLower(rr.Ns)] = true
+			}
+		case *dns.A, *dns.AAAA:
+			addrs = append(addrs, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, rr := range addrs {
+		if servers[strings.ToLower(rr.Header().Name)] {
+			roots = append(roots, net.JoinHostPort(rrIP(rr).String(), "53"))
+		}
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("%s: no address of root servers", path)
+	}
+	return roots, nil
+}
+
+// A Recursor resolves queries iteratively, as a recursive resolver does:
+// from the root servers, it follows the delegations down to the servers of
+// the zone of the name, which it caches, and aliases. Names are minimized
+// (RFC 9156): servers are only sent the labels of the name one below their
+// zone, until the zone cut is found. Records out of the zone of the server
+// which sent them are dropped. Responses are not validated with DNSSEC.
+type Recursor struct {
+	// Roots are the addresses of the root servers, RootServers if empty.
+	Roots []string
+
+	mu    sync.Mutex
+	zones map[string]*delegation // by zone
+}
+
+// delegation is a zone and the addresses of its servers.
+type delegation struct {
+	zone    string
+	addrs   []string
+	expires time.Time
+}
+
+// NewRecursor returns a recursor from the root servers.
+func NewRecursor() *Recursor {
+	return &Recursor{zones: make(map[string]*delegation)}
+}
+
+// Resolve resolves a query and returns the response, with recursion
+// available.
+func (r *Recursor) Resolve(req *dns.Msg) (*dns.Msg, error) {
+	return r.resolve(req, func(string) *net.Dialer { return &net.Dialer{} })
+}
+
+// resolve resolves a query, sending queries with the dialers of dial for
+// networks "udp" and "tcp".
+func (r *Recursor) resolve(req *dns.Msg, dial func(network string) *net.Dialer) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, errors.New("recursive: query must have one question")
+	}
+	q := req.Question[0]
+	res := &resolution{r: r, dial: dial}
+	ans, err := res.lookup(strings.ToLower(q.Name), q.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Rcode = ans.Rcode
+	m.Answer, m.Ns = ans.Answer, ans.Ns
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+	}
+	return m, nil
+}
+
+// exchangeRecursive resolves the query of a proxy iteratively, truncated
+// to what the client can receive over UDP.
+func (p *Proxy) exchangeRecursive(q *Query, req *dns.Msg) (*dns.Msg, error) {
+	if p.Recursor == nil {
+		return nil, errors.New("recursive: no recursor")
+	}
+	resp, err := p.Recursor.resolve(req, func(network string) *net.Dialer {
+		return p.netDialer(q, network)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !overTCP(q) {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	return resp, nil
+}
+
+// closest returns the cached delegation closest to a name, else the roots.
+func (r *Recursor) closest(name string) *delegation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if d, ok := r.zones[name[i:]]; ok {
+			if time.Now().Before(d.expires) {
+				return d
+			}
+			delete(r.zones, name[i:])
+		}
+	}
+	roots := r.Roots
+	if len(roots) == 0 {
+		roots = RootServers
+	}
+	return &delegation{zone: ".", addrs: roots}
+}
+
+// store caches a delegation.
+func (r *Recursor) store(d *delegation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.zones == nil || len(r.zones) >= maxDelegations {
+		r.zones = make(map[string]*delegation)
+	}
+	r.zones[d.zone] = d
+}
+
+// resolution is the state of the resolution of a query.
+type resolution struct {
+	r       *Recursor
+	dial    func(network string) *net.Dialer
+	queries int
+}
+
+// lookup resolves a name, following the aliases of the answers.
+func (s *resolution) lookup(name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, errors.New("recursive: too deep")
+	}
+	var chain []dns.RR
+	for i := 0; ; i++ {
+		resp, err := s.iterate(name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, resp.Answer...)
+		resp.Answer = chain
+		target := aliasTarget(resp, name, qtype)
+		if target == "" || i == maxCNAMEs {
+			return resp, nil
+		}
+		name = target
+	}
+}
+
+// aliasTarget returns the name to resolve next when the answer for name is
+// an alias whose target it does not have, else "".
+func aliasTarget(resp *dns.Msg, name string, qtype uint16) string {
+	if resp.Rcode != dns.RcodeSuccess || qtype == dns.TypeCNAME {
+		return ""
+	}
+	target := name
+	for range resp.Answer {
+		next := ""
+		for _, rr := range resp.Answer {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return ""
+			}
+			if c, ok := rr.(*dns.CNAME); ok {
+				next = strings.ToLower(c.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if target == name {
+		return ""
+	}
+	return target
+}
+
+// iterate resolves a name from the closest delegation, down to the servers
+// of its zone, and returns their response.
+func (s *resolution) iterate(name string, qtype uint16, depth int) (*dns.Msg, error) {
+	d := s.r.closest(name)
+	total := dns.CountLabel(name)
+	labels := dns.CountLabel(d.zone) + 1
+	for {
+		qname, qt := name, qtype
+		minimized := labels < total
+		if minimized {
+			i, _ := dns.PrevLabel(name, labels)
+			qname, qt = name[i:], dns.TypeA
+		}
+		resp, err := s.query(d, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+		next, err := s.referral(resp, d.zone, qname, depth)
+		switch {
+		case err != nil:
+			return nil, err
+		case next != nil:
+			d = next
+			s.r.store(d)
+			labels = dns.CountLabel(d.zone) + 1
+		case !minimized:
+			return resp, nil
+		case resp.Rcode == dns.RcodeSuccess:
+			labels++ // no zone cut there
+		default:
+			labels = total // ask for the name itself
+		}
+	}
+}
+
+// referral returns the delegation of a referral response from the servers
+// of zone to a zone below, towards name, nil if it is not a referral. The
+// addresses of servers without glue are resolved.
+func (s *resolution) referral(resp *dns.Msg, zone, name string, depth int) (*delegation, error) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil, nil
+	}
+	var cut string
+	var servers []string
+	ttl := uint32(maxDelegationTTL / time.Second)
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		servers = append(servers, strings.ToLower(ns.Ns))
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+	}
+	if cut == "" {
+		return nil, nil
+	}
+	d := &delegation{zone: cut, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	for _, rr := range resp.Extra {
+		ip := rrIP(rr)
+		if ip == nil {
+			continue
+		}
+		for _, ns := range servers {
+			if strings.EqualFold(rr.Header().Name, ns) {
+				d.addrs = append(d.addrs, net.JoinHostPort(ip.String(), "53"))
+			}
+		}
+	}
+	for _, ns := range servers {
+		if len(d.addrs) > 0 {
+			break
+		}
+		if dns.IsSubDomain(cut, ns) {
+			continue // glue was needed
+		}
+		resp, err := s.lookup(ns, dns.TypeA, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if ip := rrIP(rr); ip != nil {
+				d.addrs = append(d.addrs, net.JoinHostPort(ip.String(), "53"))
+			}
+		}
+	}
+	if len(d.addrs) == 0 {
+		return nil, fmt.Errorf("recursive: no address for the servers of %s", cut)
+	}
+	return d, nil
+}
+
+// query sends a query to the servers of a delegation, in random order
+// until one answers, and returns its response without the records out of
+// its zone.
+func (s *resolution) query(d *delegation, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(1232, false)
+	err := fmt.Errorf("recursive: no server of %s answered", d.zone)
+	for _, i := range rand.Perm(len(d.addrs)) {
+		if s.queries++; s.queries > maxRecursiveQueries {
+			return nil, errors.New("recursive: too many queries")
+		}
+		resp, rerr := s.exchange(m, d.addrs[i])
+		if rerr == nil {
+			rerr = checkResponse(m, resp)
+		}
+		if rerr != nil {
+			err = fmt.Errorf("recursive: %s: %v", d.addrs[i], rerr)
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			err = fmt.Errorf("recursive: %s: %s", d.addrs[i], dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		resp.Answer = inZone(resp.Answer, d.zone)
+		resp.Ns = inZone(resp.Ns, d.zone)
+		resp.Extra = inZone(resp.Extra, d.zone)
+		return resp, nil
+	}
+	return nil, err
+}
+
+// exchange sends a query to a server over UDP, then TCP if truncated.
+func (s *resolution) exchange(m *dns.Msg, addr string) (*dns.Msg, error) {
+	resp, err := s.exchangeOver("udp", m, addr)
+	if err == nil && resp.Truncated {
+		resp, err = s.exchangeOver("tcp", m, addr)
+	}
+	return resp, err
+}
+
+func (s *resolution) exchangeOver(network string, m *dns.Msg, addr string) (*dns.Msg, error) {
+	d := s.dial(network)
+	d.Timeout = recursiveTimeout
+	c := &dns.Client{Net: network, Timeout: recursiveTimeout, Dialer: d}
+	resp, _, err := c.Exchange(m, addr)
+	return resp, err
+}
+
+// inZone returns the records of a zone, and OPT records.
+func inZone(rrs []dns.RR, zone string) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT || dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,406 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A RedisCache is a Cache in Redis, shared by all the proxies using the
+// same Redis. Errors are treated as cache misses so that queries are still
+// answered by upstreams when Redis is down. After 5 consecutive errors,
+// Redis is considered down and not tried again for a backoff, doubling
+// from a second to a minute while it stays down, so that queries do not
+// wait for its timeout: responses are cached in Fallback meanwhile. Create
+// one with NewRedisCache.
+type RedisCache struct {
+	// Addr is the host:port of Redis.
+	Addr string
+	// Password to authenticate with, if any.
+	Password string
+	// DB is the number of the database.
+	DB int
+	// Prefix of the keys, to share Redis with other uses.
+	Prefix string
+	// Timeout of each request, short since the cache should be faster
+	// than upstreams.
+	Timeout time.Duration
+	// Fallback is the cache used while Redis is down, if not nil.
+	Fallback *MemoryCache
+
+	pool chan *redisConn
+
+	mu        sync.Mutex
+	failures  int // consecutive
+	backoff   time.Duration
+	downUntil time.Time
+}
+
+// redisFallbackSize is the size of the Fallback of a new RedisCache.
+const redisFallbackSize = 10000
+
+// errRedisDown is the error of the requests not sent while Redis is down.
+var errRedisDown = errors.New("redis: down")
+
+// NewRedisCache returns a cache in the Redis at addr.
+func NewRedisCache(addr string) *RedisCache {
+	return &RedisCache{
+		Addr:     addr,
+		Prefix:   "dnsproxy:",
+		Timeout:  200 * time.Millisecond,
+		Fallback: NewMemoryCache(redisFallbackSize),
+		pool:     make(chan *redisConn, 16),
+	}
+}
+
+// Down reports whether Redis is considered down, the Fallback used instead.
+func (c *RedisCache) Down() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures >= downAfter
+}
+
+// available reports whether a request can be sent to Redis: unless it is
+// down, or once its backoff is over, for one request to try it again.
+func (c *RedisCache) available() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < downAfter {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.downUntil) {
+		return false
+	}
+	c.downUntil = now.Add(c.backoff)
+	return true
+}
+
+// failed counts a failed request, marking Redis down after downAfter.
+func (c *RedisCache) failed(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures++; c.failures < downAfter {
+		return
+	}
+	if c.failures == downAfter {
+		log.Printf("redis %s is down, caching in memory: %v", c.Addr, err)
+	}
+	if c.backoff = 2 * c.backoff; c.backoff < minSinkBackoff {
+		c.backoff = minSinkBackoff
+	} else if c.backoff > maxSinkBackoff {
+		c.backoff = maxSinkBackoff
+	}
+	c.downUntil = time.Now().Add(c.backoff)
+}
+
+// succeeded counts a successful request, Redis being up again.
+func (c *RedisCache) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures >= downAfter {
+		log.Printf("redis %s is up again", c.Addr)
+	}
+	c.failures, c.backoff = 0, 0
+}
+
+// Get implements Cache.
+func (c *RedisCache) Get(key string) *dns.Msg {
+	v, err := c.do("GET", c.Prefix+key)
+	if err == errRedisDown && c.Fallback != nil {
+		return c.Fallback.Get(key)
+	}
+	b, ok := v.([]byte)
+	if err != nil || !ok || len(b) < 8 {
+		return nil
+	}
+	// Values are the time they were stored followed by the response.
+	stored := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	m := new(dns.Msg)
+	if err := m.Unpack(b[8:]); err != nil {
+		return nil
+	}
+	return aged(m, time.Since(stored))
+}
+
+// Set implements Cache.
+func (c *RedisCache) Set(key string, m *dns.Msg, ttl time.Duration) {
+	buf, err := m.Pack()
+	if err != nil {
+		return
+	}
+	v := make([]byte, 8, 8+len(buf))
+	binary.BigEndian.PutUint64(v, uint64(time.Now().UnixNano()))
+	v = append(v, buf...)
+	_, err = c.do("SET", c.Prefix+key, string(v), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err == errRedisDown && c.Fallback != nil {
+		c.Fallback.Set(key, m, ttl)
+	}
+}
+
+// redisIncr is the script incrementing a counter and setting its expiry
+// when it is created, atomically so that it cannot be left without one.
+const redisIncr = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIREAT', KEYS[1], ARGV[1]) end
+return n`
+
+// Incr implements Counters.
+func (c *RedisCache) Incr(key string, expires time.Time) (int64, error) {
+	ms := strconv.FormatInt(expires.UnixNano()/int64(time.Millisecond), 10)
+	v, err := c.do("EVAL", redisIncr, "1", c.Prefix+key, ms)
+	if err == errRedisDown && c.Fallback != nil {
+		return c.Fallback.Incr(key, expires)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, errors.New("redis: invalid incr reply")
+	}
+	return n, nil
+}
+
+// Entries implements Cache.
+func (c *RedisCache) Entries(name string) (map[string]*dns.Msg, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	keys, err := c.scan(globEscape(c.Prefix+name+" ") + "*")
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*dns.Msg)
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, c.Prefix)
+		if m := c.Get(k); m != nil {
+			entries[k] = m
+		}
+	}
+	return entries, nil
+}
+
+// Flush implements Cache. Only the keys of the prefix are flushed, and
+// those of the Fallback.
+func (c *RedisCache) Flush(name string, subtree bool) (int, error) {
+	if c.Fallback != nil {
+		c.Fallback.Flush(name, subtree)
+	}
+	pattern := globEscape(c.Prefix) + "*"
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+		pattern = globEscape(c.Prefix+name+" ") + "*"
+		if subtree {
+			pattern = globEscape(c.Prefix) + "*" + globEscape(name+" ") + "*"
+		}
+	}
+	keys, err := c.scan(pattern)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		// The pattern of a subtree also matches longer names such as
+		// xexample.com. for example.com.
+		if !flushMatch(strings.TrimPrefix(k, c.Prefix), name, subtree) {
+			continue
+		}
+		v, err := c.do("DEL", k)
+		if err != nil {
+			return n, err
+		}
+		if d, ok := v.(int64); ok {
+			n += int(d)
+		}
+	}
+	return n, nil
+}
+
+// scan returns the keys matching a glob pattern.
+func (c *RedisCache) scan(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		v, err := c.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		reply, ok := v.([]interface{})
+		if !ok || len(reply) != 2 {
+			return nil, errors.New("redis: invalid scan reply")
+		}
+		next, _ := reply[0].([]byte)
+		batch, _ := reply[1].([]interface{})
+		for _, k := range batch {
+			if b, ok := k.([]byte); ok {
+				keys = append(keys, string(b))
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// globEscape escapes the special characters of Redis glob patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// do sends a command and returns its reply: a string, an int64, a []byte,
+// an []interface{} of replies or nil for a missing value, or errRedisDown
+// without sending it while Redis is down.
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	if !c.available() {
+		return nil, errRedisDown
+	}
+	conn, err := c.conn()
+	if err != nil {
+		c.failed(err)
+		return nil, err
+	}
+	v, err := conn.do(c.Timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is out of sync after a network error.
+			conn.Close()
+			c.failed(err)
+			return nil, err
+		}
+	}
+	c.succeeded()
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return v, err
+}
+
+// conn returns a connection of the pool or a new one, authenticated and
+// on the database.
+func (c *RedisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.Password != "" {
+		if _, err := conn.do(c.Timeout, "AUTH", c.Password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: auth: %v", err)
+		}
+	}
+	if c.DB != 0 {
+		if _, err := conn.do(c.Timeout, "SELECT", strconv.Itoa(c.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: select: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error replied by Redis, after which the connection can
+// still be used.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn is a connection speaking the Redis protocol (RESP).
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: invalid reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// An error replied for an element is returned once the whole
+		// array is read, for the connection to stay in sync.
+		var replyErr error
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = c.reply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				if replyErr == nil {
+					replyErr = err
+				}
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", kind)
+}
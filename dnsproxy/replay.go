@@ -0,0 +1,227 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Link types of pcap files which ReadCapture reads.
+const (
+	linkTypeEthernet = 1
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// A CapturedMsg is a DNS message read from a capture.
+type CapturedMsg struct {
+	Time     time.Time
+	Src, Dst *net.UDPAddr
+	Msg      *dns.Msg
+}
+
+// ReadCapture reads the DNS messages in UDP datagrams of a pcap file, such
+// as written by a Capture or tcpdump. Other packets are skipped.
+func ReadCapture(r io.Reader) ([]*CapturedMsg, error) {
+	var h [24]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	nano := false
+	switch magic := binary.LittleEndian.Uint32(h[:]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order, nano = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order, nano = binary.BigEndian, magic == 0x4d3cb2a1
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	linkType := order.Uint32(h[20:]) & 0xffff
+	// Packets are not allocated beyond the snapshot length, or 65535 bytes
+	// if larger (e.g. 262144 by tcpdump), so that a corrupted length does
+	// not exhaust memory.
+	snaplen := order.Uint32(h[16:])
+	if snaplen == 0 || snaplen > 65535 {
+		snaplen = 65535
+	}
+	var msgs []*CapturedMsg
+	for {
+		var rh [16]byte
+		if _, err := io.ReadFull(r, rh[:]); err == io.EOF {
+			return msgs, nil
+		} else if err != nil {
+			return msgs, err
+		}
+		frac := time.Duration(order.Uint32(rh[4:]))
+		if !nano {
+			frac *= time.Microsecond
+		}
+		t := time.Unix(int64(order.Uint32(rh[0:])), int64(frac))
+		caplen := order.Uint32(rh[8:])
+		if caplen > snaplen {
+			return msgs, fmt.Errorf("packet of %d bytes larger than snapshot length %d", caplen, snaplen)
+		}
+		pkt := make([]byte, caplen)
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return msgs, err
+		}
+		if m := parseCaptured(linkType, pkt); m != nil {
+			m.Time = t
+			msgs = append(msgs, m)
+		}
+	}
+}
+
+// parseCaptured returns the DNS message of a packet, nil if it is not a
+// complete UDP datagram with one.
+func parseCaptured(linkType uint32, pkt []byte) *CapturedMsg {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeEthernet:
+		if len(pkt) < 14 {
+			return nil
+		}
+		pkt = pkt[14:]
+	case linkTypeLinuxSLL:
+		if len(pkt) < 16 {
+			return nil
+		}
+		pkt = pkt[16:]
+	default:
+		return nil
+	}
+	if len(pkt) < 1 {
+		return nil
+	}
+	var src, dst net.IP
+	var udp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0xf) * 4
+		if len(pkt) < 20 || len(pkt) < ihl || pkt[9] != 17 {
+			return nil
+		}
+		src, dst, udp = net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[ihl:]
+	case 6:
+		// Extension headers are not supported.
+		if len(pkt) < 40 || pkt[6] != 17 {
+			return nil
+		}
+		src, dst, udp = net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[40:]
+	default:
+		return nil
+	}
+	if len(udp) < 8 {
+		return nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(udp[8:]); err != nil {
+		return nil
+	}
+	return &CapturedMsg{
+		Src: &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(udp[0:]))},
+		Dst: &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: int(binary.BigEndian.Uint16(udp[2:]))},
+		Msg: m,
+	}
+}
+
+// A ReplayResult is the outcome of replaying a query.
+type ReplayResult struct {
+	Query *CapturedMsg
+	Old   *dns.Msg // captured response, nil if none
+	New   *dns.Msg // nil if Err
+	Err   error
+	Diff  string // how New diverges from Old, empty if it does not
+}
+
+// maxReplayQueries bounds the queries in flight during a replay.
+const maxReplayQueries = 256
+
+// Replay sends the queries of a capture to upstream again, at speed times
+// their original pace or as fast as possible if zero, and calls report
+// with the result of each, one at a time.
+func (p *Proxy) Replay(msgs []*CapturedMsg, upstream string, speed float64, report func(*ReplayResult)) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		inFlight = make(chan struct{}, maxReplayQueries)
+		start    = time.Now()
+	)
+	// Responses are matched to queries by ID and addresses.
+	responses := make(map[string][]*dns.Msg)
+	for _, m := range msgs {
+		if m.Msg.Response {
+			k := replayKey(m.Msg.Id, m.Dst, m.Src)
+			responses[k] = append(responses[k], m.Msg)
+		}
+	}
+	for _, m := range msgs {
+		if m.Msg.Response || len(m.Msg.Question) == 0 {
+			continue
+		}
+		if speed > 0 {
+			offset := time.Duration(float64(m.Time.Sub(msgs[0].Time)) / speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		res := &ReplayResult{Query: m}
+		if k := replayKey(m.Msg.Id, m.Src, m.Dst); len(responses[k]) > 0 {
+			res.Old, responses[k] = responses[k][0], responses[k][1:]
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.New, res.Err = p.Exchange(upstream, res.Query.Msg.Copy())
+			<-inFlight
+			if res.Err == nil && res.Old != nil {
+				res.Diff = diverge(res.Old, res.New)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report(res)
+		}()
+	}
+	wg.Wait()
+}
+
+// replayKey returns the key matching a query from client to server with
+// its responses.
+func replayKey(id uint16, client, server *net.UDPAddr) string {
+	return fmt.Sprintf("%d %s %s", id, client, server)
+}
+
+// diverge describes how response b differs from a in rcode or answers,
+// ignoring TTLs and order, empty if it does not.
+func diverge(a, b *dns.Msg) string {
+	if a.Rcode != b.Rcode {
+		return fmt.Sprintf("rcode %s, was %s", dns.RcodeToString[b.Rcode], dns.RcodeToString[a.Rcode])
+	}
+	was, now := strings.Join(answerSet(a), "; "), strings.Join(answerSet(b), "; ")
+	if was != now {
+		return fmt.Sprintf("answers [%s], were [%s]", now, was)
+	}
+	return ""
+}
+
+// answerSet returns the answers of a response in presentation format
+// without TTL, sorted.
+func answerSet(m *dns.Msg) []string {
+	var s []string
+	for _, rr := range m.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		s = append(s, rr.String())
+	}
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,148 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A ClientReport sums up the queries of a client.
+type ClientReport struct {
+	Client     string      `json:"client"`
+	Queries    uint64      `json:"queries"`
+	Blocked    uint64      `json:"blocked"`
+	TopNames   []NameCount `json:"top_names"`
+	TopBlocked []NameCount `json:"top_blocked"`
+
+	names, blocked map[string]uint64
+}
+
+// A Report sums up the queries of each client over a period.
+type Report struct {
+	Since   time.Time       `json:"since"`
+	Until   time.Time       `json:"until"`
+	Clients []*ClientReport `json:"clients"` // most queries first
+}
+
+// Report returns the report of the queries of the history between since and
+// until, of all clients or only of client if not empty, with the n names
+// queried and blocked most by each. Queries are blocked if their Verdict is
+// block.
+func (h *History) Report(since, until time.Time, client string, n int) (*Report, error) {
+	entries, err := h.Search(HistoryFilter{Client: client, Since: since, Until: until})
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{Since: since, Until: until, Clients: []*ClientReport{}}
+	clients := make(map[string]*ClientReport)
+	for _, e := range entries {
+		c := clients[e.Client]
+		if c == nil {
+			c = &ClientReport{Client: e.Client, names: make(map[string]uint64), blocked: make(map[string]uint64)}
+			clients[e.Client] = c
+			r.Clients = append(r.Clients, c)
+		}
+		weight := uint64(1)
+		if e.Sample > 1 {
+			weight = uint64(e.Sample)
+		}
+		c.Queries += weight
+		c.names[e.Name] += weight
+		if e.Verdict == "block" {
+			c.Blocked += weight
+			c.blocked[e.Name] += weight
+		}
+	}
+	for _, c := range r.Clients {
+		c.TopNames, c.TopBlocked = top(c.names, n), top(c.blocked, n)
+	}
+	sort.Slice(r.Clients, func(i, j int) bool {
+		if r.Clients[i].Queries != r.Clients[j].Queries {
+			return r.Clients[i].Queries > r.Clients[j].Queries
+		}
+		return r.Clients[i].Client < r.Clients[j].Client
+	})
+	return r, nil
+}
+
+// SendReports sends the report of the queries of each client of the last
+// interval every interval, as an EventReport to alert and by email with m
+// if not nil.
+func (h *History) SendReports(interval time.Duration, alert func(*Event), m *Mailer) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for now := range t.C {
+		r, err := h.Report(now.Add(-interval), now, "", 10)
+		if err != nil {
+			log.Printf("cannot report: %v", err)
+			continue
+		}
+		alert(&Event{Time: now, Kind: EventReport, Report: r,
+			Message: fmt.Sprintf("queries of %d clients over the last %v", len(r.Clients), interval)})
+		if m != nil {
+			if err := m.Send(r); err != nil {
+				log.Printf("cannot mail report: %v", err)
+			}
+		}
+	}
+}
+
+// String returns the report as text, e.g. for an email.
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Queries from %s to %s\n", r.Since.Format(time.RFC1123), r.Until.Format(time.RFC1123))
+	for _, c := range r.Clients {
+		fmt.Fprintf(&b, "\n%s: %d queries, %d blocked\n", c.Client, c.Queries, c.Blocked)
+		for _, n := range c.TopNames {
+			fmt.Fprintf(&b, "  %8d  %s\n", n.Count, displayName(n.Name))
+		}
+		if len(c.TopBlocked) > 0 {
+			fmt.Fprintf(&b, "  blocked:\n")
+			for _, n := range c.TopBlocked {
+				fmt.Fprintf(&b, "  %8d  %s\n", n.Count, displayName(n.Name))
+			}
+		}
+	}
+	return b.String()
+}
+
+// A Mailer sends reports by email, over SMTP with STARTTLS if the server
+// supports it.
+type Mailer struct {
+	Addr string // host:port of the SMTP server
+	From string
+	To   []string
+	// Auth authenticates to the server, if not nil, e.g. smtp.PlainAuth.
+	Auth smtp.Auth
+}
+
+// NewMailer returns a mailer to the SMTP server at addr (host:port),
+// authenticating as user if not empty.
+func NewMailer(addr, from string, to []string, user, password string) (*Mailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mailer{Addr: addr, From: from, To: to}
+	if user != "" {
+		m.Auth = smtp.PlainAuth("", user, password, host)
+	}
+	return m, nil
+}
+
+// Send mails a report.
+func (m *Mailer) Send(r *Report) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: DNS activity report, %s\r\n", r.Until.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(r.String(), "\n", "\r\n"))
+	return smtp.SendMail(m.Addr, m.Auth, m.From, m.To, msg.Bytes())
+}
@@ -0,0 +1,98 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ParseResolvConf returns the name servers of a resolv.conf file, as
+// upstream addresses on port 53.
+func ParseResolvConf(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var servers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip, _ := splitZone(fields[1]); net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("%s: invalid name server %q", path, fields[1])
+		}
+		servers = append(servers, net.JoinHostPort(fields[1], "53"))
+	}
+	return servers, s.Err()
+}
+
+// LoadResolvConf sets the default upstreams to the name servers of a
+// resolv.conf file, but those which are the proxy itself, e.g. when the
+// proxy is the resolver of its host. The defaults are kept if none is left.
+func (p *Proxy) LoadResolvConf(path string) error {
+	servers, err := ParseResolvConf(path)
+	if err != nil {
+		return err
+	}
+	var upstreams []string
+	for _, s := range servers {
+		if !p.isSelf("udp", s) {
+			upstreams = append(upstreams, s)
+		}
+	}
+	if len(upstreams) == 0 {
+		return fmt.Errorf("%s: no name server but the proxy itself", path)
+	}
+	p.SetDefault(upstreams)
+	return nil
+}
+
+// WatchResolvConf loads a resolv.conf file again with LoadResolvConf when
+// it is modified, checking every interval until stop is closed. Errors are
+// logged, and the previous defaults kept.
+func (p *Proxy) WatchResolvConf(path string, interval time.Duration, stop <-chan struct{}) {
+	p.watchFiles([]string{path}, interval, stop, func() error {
+		return p.LoadResolvConf(path)
+	})
+}
+
+// watchFiles calls load when the latest of files is modified, checking every
+// interval until stop is closed, and logs its errors.
+func (p *Proxy) watchFiles(files []string, interval time.Duration, stop <-chan struct{}, load func() error) {
+	modTime := func() time.Time {
+		var t time.Time
+		for _, name := range files {
+			if fi, err := os.Stat(name); err == nil && fi.ModTime().After(t) {
+				t = fi.ModTime()
+			}
+		}
+		return t
+	}
+	modified := modTime()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		m := modTime()
+		if m.Equal(modified) {
+			continue
+		}
+		modified = m
+		names := strings.Join(files, ", ")
+		if err := load(); err != nil {
+			p.logf("cannot reload %s: %v", names, err)
+			continue
+		}
+		p.logf("reloaded default upstreams from %s", names)
+	}
+}
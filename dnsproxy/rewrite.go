@@ -0,0 +1,116 @@
+package dnsproxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A Rewrite replaces the suffix Domain of the names of the queries matched
+// by its rule with To before they are routed, e.g. .corp. with
+// .corp.example.com., and To with Domain again in the names of their
+// responses, so that clients need no search domains for them. Names already
+// ending in To are left alone.
+type Rewrite struct {
+	Rule
+	To string
+
+	spec string // as parsed
+}
+
+// String returns the rewrite as parsed.
+func (r *Rewrite) String() string { return r.spec }
+
+// ParseRewrite parses a rewrite of the form domain=to[;option=value...], with
+// the same options as ParseRule.
+func ParseRewrite(s string) (*Rewrite, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return nil, errors.New("must be domain=to")
+	}
+	opts := strings.Split(kv[1], ";")
+	if opts[0] == "" {
+		return nil, errors.New("empty name to rewrite to")
+	}
+	r := &Rewrite{Rule: *NewRule(kv[0]), To: strings.ToLower(dns.Fqdn(opts[0]))}
+	if err := r.setOptions(opts[1:]); err != nil {
+		return nil, err
+	}
+	r.spec = s
+	return r, nil
+}
+
+// Rewrites returns the rewrites.
+func (p *Proxy) Rewrites() []*Rewrite {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Rewrite(nil), p.rewrites...)
+}
+
+// SetRewrites replaces all rewrites, the first matching a query applying.
+func (p *Proxy) SetRewrites(rewrites []*Rewrite) {
+	rewrites = append([]*Rewrite(nil), rewrites...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rewrites = rewrites
+}
+
+// rewriteStage applies the first rewrite matching a query, for the next
+// stages to see the rewritten name.
+func (p *Proxy) rewriteStage(next Handler) Handler {
+	return func(q *Query) {
+		name := strings.ToLower(q.Name)
+		for _, r := range p.config(q).Rewrites {
+			if dns.IsSubDomain(strings.TrimPrefix(r.To, "."), name) ||
+				!strings.HasSuffix(name, r.Domain) || !r.match(name, q.Client, q.Group, q.Time) {
+				continue
+			}
+			to := q.Name[:len(q.Name)-len(r.Domain)] + r.To
+			p.debugf(q, "rewritten to %s by rule for %s", to, r.Domain)
+			q.W = &suffixWriter{ResponseWriter: q.W, from: q.Name[len(q.Name)-len(r.Domain):], to: r.To}
+			q.Req = q.Req.Copy()
+			q.Req.Question[0].Name, q.Name = to, to
+			break
+		}
+		next(q)
+	}
+}
+
+// suffixWriter restores the original suffix of the names in responses to a
+// query whose name was rewritten by a Rewrite: of the question, the owners
+// of records and the targets of aliases.
+type suffixWriter struct {
+	dns.ResponseWriter
+	from, to string // original and rewritten suffix
+}
+
+func (w *suffixWriter) WriteMsg(m *dns.Msg) error {
+	for i := range m.Question {
+		m.Question[i].Name = w.restore(m.Question[i].Name)
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			h.Name = w.restore(h.Name)
+			if c, ok := rr.(*dns.CNAME); ok {
+				c.Target = w.restore(c.Target)
+			}
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// restore returns name with the original suffix if it ends in the rewritten
+// one, on a label boundary.
+func (w *suffixWriter) restore(name string) string {
+	n := len(name) - len(w.to)
+	if n < 0 || !strings.EqualFold(name[n:], w.to) ||
+		n > 0 && !strings.HasPrefix(w.to, ".") && name[n-1] != '.' {
+		return name
+	}
+	return name[:n] + w.from
+}
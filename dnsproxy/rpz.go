@@ -0,0 +1,518 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rpzAction is the action of an RPZ rule.
+type rpzAction int
+
+const (
+	rpzNXDomain rpzAction = iota // CNAME .
+	rpzNoData                    // CNAME *.
+	rpzPassthru                  // CNAME rpz-passthru.
+	rpzDrop                      // CNAME rpz-drop.
+	rpzTCPOnly                   // CNAME rpz-tcp-only.
+	rpzLocal                     // other records, answered instead
+)
+
+// rpzRule is a trigger of an RPZ and its action.
+type rpzRule struct {
+	trigger string // owner name in the zone, for logs
+	action  rpzAction
+	data    []dns.RR // local data
+}
+
+// rpzNetRule is a rule triggered by addresses within a network.
+type rpzNetRule struct {
+	net  *net.IPNet
+	rule *rpzRule
+}
+
+// An RPZ is a Response Policy Zone, a zone whose records are rules on the
+// queries and responses of clients, as delivered by threat intelligence
+// feeds. Triggers are on the query name (name or *.name), the client IP
+// (rpz-client-ip), the addresses of answers (rpz-ip), and the names and
+// addresses of the name servers in the authority and additional sections
+// of responses (rpz-nsdname, rpz-nsip), which a forwarding proxy only
+// knows when upstreams include them. Actions are NXDOMAIN (CNAME .),
+// NODATA (CNAME *.), PASSTHRU (CNAME rpz-passthru.), DROP (CNAME
+// rpz-drop.), TCP-Only (CNAME rpz-tcp-only.) and Local Data (other
+// records). Create one with ParseRPZ, LoadRPZ or TransferRPZ.
+type RPZ struct {
+	// Origin is the name of the zone.
+	Origin string
+	// Refresh is the refresh interval of the SOA of the zone.
+	Refresh time.Duration
+
+	qnames   map[string]*rpzRule
+	nsdnames map[string]*rpzRule
+	clientIP []rpzNetRule
+	ip       []rpzNetRule
+	nsip     []rpzNetRule
+}
+
+// LoadRPZ reads an RPZ from a zone file.
+func LoadRPZ(origin, path string) (*RPZ, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRPZ(origin, path, f)
+}
+
+// ParseRPZ reads an RPZ in zone file format, naming errors after file.
+func ParseRPZ(origin, file string, r io.Reader) (*RPZ, error) {
+	origin = dns.Fqdn(strings.ToLower(origin))
+	zp := dns.NewZoneParser(r, origin, file)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return newRPZ(origin, rrs)
+}
+
+// TransferRPZ transfers an RPZ (AXFR) from a server (host:port).
+func TransferRPZ(origin, server string) (*RPZ, error) {
+	origin = dns.Fqdn(strings.ToLower(origin))
+	m := new(dns.Msg)
+	m.SetAxfr(origin)
+	t := &dns.Transfer{DialTimeout: dialTimeout}
+	envelopes, err := t.In(m, server)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return newRPZ(origin, rrs)
+}
+
+// newRPZ builds an RPZ from the records of its zone.
+func newRPZ(origin string, rrs []dns.RR) (*RPZ, error) {
+	z := &RPZ{
+		Origin:   origin,
+		qnames:   make(map[string]*rpzRule),
+		nsdnames: make(map[string]*rpzRule),
+	}
+	// Records of the same owner make a single rule.
+	rules := make(map[string]*rpzRule)
+	var owners []string
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			if owner == origin {
+				z.Refresh = time.Duration(rr.(*dns.SOA).Refresh) * time.Second
+			}
+			continue
+		case dns.TypeNS:
+			if owner == origin {
+				continue
+			}
+		}
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue
+		}
+		r, ok := rules[owner]
+		if !ok {
+			r = &rpzRule{trigger: owner, action: rpzLocal}
+			rules[owner] = r
+			owners = append(owners, owner)
+		}
+		r.data = append(r.data, rr)
+	}
+	for _, owner := range owners {
+		r := rules[owner]
+		if len(r.data) == 1 {
+			if cname, ok := r.data[0].(*dns.CNAME); ok {
+				switch strings.ToLower(cname.Target) {
+				case ".":
+					r.action = rpzNXDomain
+				case "*.":
+					r.action = rpzNoData
+				case "rpz-passthru.":
+					r.action = rpzPassthru
+				case "rpz-drop.":
+					r.action = rpzDrop
+				case "rpz-tcp-only.":
+					r.action = rpzTCPOnly
+				}
+			}
+		}
+		name := strings.TrimSuffix(owner, "."+origin)
+		var err error
+		switch {
+		case strings.HasSuffix(name, ".rpz-client-ip"):
+			err = z.addNet(&z.clientIP, strings.TrimSuffix(name, ".rpz-client-ip"), r)
+		case strings.HasSuffix(name, ".rpz-ip"):
+			err = z.addNet(&z.ip, strings.TrimSuffix(name, ".rpz-ip"), r)
+		case strings.HasSuffix(name, ".rpz-nsip"):
+			err = z.addNet(&z.nsip, strings.TrimSuffix(name, ".rpz-nsip"), r)
+		case strings.HasSuffix(name, ".rpz-nsdname"):
+			z.nsdnames[strings.TrimSuffix(name, ".rpz-nsdname")+"."] = r
+		default:
+			z.qnames[name+"."] = r
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", owner, err)
+		}
+	}
+	return z, nil
+}
+
+// addNet adds a rule triggered by a network written in reverse, e.g.
+// 24.0.2.0.192 for 192.0.2.0/24 or 48.zz.db8.2001 for 2001:db8::/48.
+func (z *RPZ) addNet(rules *[]rpzNetRule, name string, r *rpzRule) error {
+	labels := strings.Split(name, ".")
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil || len(labels) < 2 {
+		return errors.New("invalid network")
+	}
+	for i, j := 1, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	addr := labels[1:]
+	s := strings.Join(addr, ".")
+	if !rpzIPv4(addr) {
+		// zz stands for the :: of IPv6.
+		s = strings.Join(addr, ":")
+		switch {
+		case s == "zz":
+			s = "::"
+		case strings.HasPrefix(s, "zz:"):
+			s = ":" + s[2:]
+		case strings.HasSuffix(s, ":zz"):
+			s = s[:len(s)-2] + ":"
+		default:
+			s = strings.Replace(s, ":zz:", "::", 1)
+		}
+	}
+	n, err := ParseNet(fmt.Sprintf("%s/%d", s, bits))
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, rpzNetRule{net: n, rule: r})
+	return nil
+}
+
+// rpzIPv4 reports whether the labels of an address are those of an IPv4
+// address: 4 decimal numbers up to 255. Others, e.g. 2001.db8.1.zz, are of
+// IPv6.
+func rpzIPv4(labels []string) bool {
+	if len(labels) != 4 {
+		return false
+	}
+	for _, l := range labels {
+		if n, err := strconv.Atoi(l); err != nil || n < 0 || n > 255 || l[0] == '+' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchName returns the rule of a name, exact or else of the closest
+// wildcard, nil if none.
+func matchName(rules map[string]*rpzRule, name string) *rpzRule {
+	name = strings.ToLower(name)
+	if r, ok := rules[name]; ok {
+		return r
+	}
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if r, ok := rules["*."+name[i:]]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// matchNet returns the rule of the longest network containing ip, nil if
+// none.
+func matchNet(rules []rpzNetRule, ip net.IP) *rpzRule {
+	var best *rpzRule
+	bestBits := -1
+	for _, r := range rules {
+		if bits, _ := r.net.Mask.Size(); r.net.Contains(ip) && bits > bestBits {
+			best, bestBits = r.rule, bits
+		}
+	}
+	return best
+}
+
+// matchResponse returns the rule triggered by the addresses of the
+// answers of a response, else the names then the addresses of its name
+// servers, nil if none.
+func (z *RPZ) matchResponse(m *dns.Msg) *rpzRule {
+	for _, rr := range m.Answer {
+		if r := matchNet(z.ip, rrIP(rr)); r != nil {
+			return r
+		}
+	}
+	servers := make(map[string]bool)
+	for _, rr := range m.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			if r := matchName(z.nsdnames, ns.Ns); r != nil {
+				return r
+			}
+			servers[strings.ToLower(ns.Ns)] = true
+		}
+	}
+	for _, rr := range m.Extra {
+		if servers[strings.ToLower(rr.Header().Name)] {
+			if r := matchNet(z.nsip, rrIP(rr)); r != nil {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// rrIP returns the address of an A or AAAA record, nil for others.
+func rrIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// RPZones returns the response policy zones.
+func (p *Proxy) RPZones() []*RPZ {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*RPZ(nil), p.rpz...)
+}
+
+// SetRPZones replaces the response policy zones, the first zone with a
+// rule for a query applying.
+func (p *Proxy) SetRPZones(zones []*RPZ) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rpz = append([]*RPZ(nil), zones...)
+}
+
+// rpzSpec parses the spec of a response policy zone, zone=file or
+// zone=axfr://host:port, into its origin and file or server.
+func rpzSpec(s string) (origin, file, server string, err error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return "", "", "", fmt.Errorf("invalid rpz %q: must be zone=file or zone=axfr://host:port", s)
+	}
+	if !strings.HasPrefix(kv[1], "axfr://") {
+		return kv[0], kv[1], "", nil
+	}
+	server = strings.TrimPrefix(kv[1], "axfr://")
+	if !ValidHostPort(server) {
+		return "", "", "", fmt.Errorf("invalid rpz %q: must be zone=file or zone=axfr://host:port", s)
+	}
+	return kv[0], "", server, nil
+}
+
+// CheckRPZones returns an error if specs of LoadRPZones are invalid,
+// reading the zone files but transferring no zone.
+func CheckRPZones(specs []string) error {
+	for _, s := range specs {
+		origin, file, _, err := rpzSpec(s)
+		if err != nil {
+			return err
+		}
+		if file == "" {
+			continue
+		}
+		if _, err := LoadRPZ(origin, file); err != nil {
+			return fmt.Errorf("rpz %q: %v", s, err)
+		}
+	}
+	return nil
+}
+
+// LoadRPZones sets the response policy zones of specs, zone=file or
+// zone=axfr://host:port, and transfers the latter again at their refresh
+// interval, an hour if less than a minute, keeping the previous version
+// with an EventRefreshError on failure.
+func (p *Proxy) LoadRPZones(specs []string) error {
+	var mu sync.Mutex
+	zones := make([]*RPZ, len(specs))
+	for i, s := range specs {
+		origin, file, server, err := rpzSpec(s)
+		if err != nil {
+			return err
+		}
+		if file != "" {
+			if zones[i], err = LoadRPZ(origin, file); err != nil {
+				return fmt.Errorf("rpz %q: %v", s, err)
+			}
+			continue
+		}
+		z, err := TransferRPZ(origin, server)
+		if err != nil {
+			return fmt.Errorf("rpz %q: %v", s, err)
+		}
+		zones[i] = z
+		go func(i int, origin, server string, refresh time.Duration) {
+			for {
+				if refresh < time.Minute {
+					refresh = time.Hour
+				}
+				time.Sleep(refresh)
+				z, err := TransferRPZ(origin, server)
+				if err != nil {
+					p.alert(EventRefreshError, "cannot transfer rpz %s: %v", origin, err)
+					continue
+				}
+				refresh = z.Refresh
+				mu.Lock()
+				zones[i] = z
+				p.SetRPZones(zones)
+				mu.Unlock()
+			}
+		}(i, origin, server, z.Refresh)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	p.SetRPZones(zones)
+	return nil
+}
+
+// rpzStage applies the rule of the client or query name of the first
+// zone with one, else those triggered by the response.
+func (p *Proxy) rpzStage(next Handler) Handler {
+	return func(q *Query) {
+		zones := p.RPZones()
+		for _, z := range zones {
+			r := matchNet(z.clientIP, q.Client)
+			if r == nil {
+				r = matchName(z.qnames, q.Name)
+			}
+			if r != nil {
+				p.debugf(q, "rpz %s", r.trigger)
+				p.applyRPZ(q, r, next)
+				return
+			}
+		}
+		if len(zones) > 0 {
+			q.W = &rpzWriter{ResponseWriter: q.W, p: p, q: q, zones: zones}
+		}
+		next(q)
+	}
+}
+
+// applyRPZ applies the action of a rule triggered by a query.
+func (p *Proxy) applyRPZ(q *Query, r *rpzRule, next Handler) {
+	switch r.action {
+	case rpzPassthru:
+		next(q)
+		return
+	case rpzTCPOnly:
+		if overTCP(q) {
+			next(q)
+			return
+		}
+	case rpzLocal:
+		// Local data with a CNAME is resolved like a rewritten query.
+		if cname := rpzCNAME(r, q.Name); cname != nil && q.Req.Question[0].Qtype != dns.TypeCNAME {
+			p.blocked(q)
+			q.W = &cnameWriter{ResponseWriter: q.W, from: q.Name, to: cname.Target}
+			q.Req = q.Req.Copy()
+			q.Req.Question[0].Name, q.Name = cname.Target, cname.Target
+			next(q)
+			return
+		}
+	}
+	p.blocked(q)
+	if m := rpzResponse(q.Req, q.Name, r, overTCP(q)); m != nil {
+		q.W.WriteMsg(m)
+	}
+}
+
+// rpzCNAME returns the CNAME of the local data of a rule for name, nil if
+// there is none.
+func rpzCNAME(r *rpzRule, name string) *dns.CNAME {
+	for _, rr := range r.data {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return &dns.CNAME{Hdr: rpzHeader(rr, name), Target: cname.Target}
+		}
+	}
+	return nil
+}
+
+func rpzHeader(rr dns.RR, name string) dns.RR_Header {
+	h := *rr.Header()
+	h.Name = name
+	return h
+}
+
+// rpzResponse returns the response of a rule to req for name, nil to drop
+// the query.
+func rpzResponse(req *dns.Msg, name string, r *rpzRule, tcp bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	switch r.action {
+	case rpzNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case rpzNoData:
+	case rpzDrop:
+		return nil
+	case rpzTCPOnly:
+		m.Truncated = !tcp
+	case rpzLocal:
+		qtype := req.Question[0].Qtype
+		for _, rr := range r.data {
+			h := rr.Header()
+			if h.Rrtype == qtype || h.Rrtype == dns.TypeCNAME || qtype == dns.TypeANY {
+				rr = dns.Copy(rr)
+				rr.Header().Name = req.Question[0].Name
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	return m
+}
+
+// rpzWriter applies the rules triggered by responses to a query.
+type rpzWriter struct {
+	dns.ResponseWriter
+	p     *Proxy
+	q     *Query
+	zones []*RPZ
+}
+
+func (w *rpzWriter) WriteMsg(m *dns.Msg) error {
+	for _, z := range w.zones {
+		r := z.matchResponse(m)
+		if r == nil {
+			continue
+		}
+		w.p.debugf(w.q, "rpz %s", r.trigger)
+		if r.action == rpzPassthru || r.action == rpzTCPOnly && overTCP(w.q) {
+			break
+		}
+		w.p.blocked(w.q)
+		resp := rpzResponse(w.q.Req, w.q.Name, r, overTCP(w.q))
+		if resp == nil {
+			return nil
+		}
+		return w.ResponseWriter.WriteMsg(resp)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,60 @@
+package dnsproxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRPZNetTriggers(t *testing.T) {
+	const zone = `$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+@ NS localhost.
+32.1.2.0.192.rpz-ip CNAME .
+24.0.2.0.198.rpz-ip CNAME *.
+48.zz.1.db8.2001.rpz-ip CNAME .
+128.1.zz.rpz-ip CNAME rpz-drop.
+64.zz.2001.rpz-client-ip CNAME rpz-passthru.
+128.8.7.6.5.4.3.2.1.rpz-ip CNAME .
+`
+	z, err := ParseRPZ("rpz.example.", "test", strings.NewReader(zone))
+	if err != nil {
+		t.Fatalf("ParseRPZ: %v", err)
+	}
+	for _, tt := range []struct {
+		rules   []rpzNetRule
+		ip      string
+		trigger string
+	}{
+		{z.ip, "192.0.2.1", "32.1.2.0.192.rpz-ip.rpz.example."},
+		{z.ip, "198.0.2.7", "24.0.2.0.198.rpz-ip.rpz.example."},
+		{z.ip, "2001:db8:1::53", "48.zz.1.db8.2001.rpz-ip.rpz.example."},
+		{z.ip, "::1", "128.1.zz.rpz-ip.rpz.example."},
+		{z.ip, "1:2:3:4:5:6:7:8", "128.8.7.6.5.4.3.2.1.rpz-ip.rpz.example."},
+		{z.ip, "2001:db8:2::53", ""},
+		{z.clientIP, "2001::7", "64.zz.2001.rpz-client-ip.rpz.example."},
+	} {
+		r := matchNet(tt.rules, net.ParseIP(tt.ip))
+		trigger := ""
+		if r != nil {
+			trigger = r.trigger
+		}
+		if trigger != tt.trigger {
+			t.Errorf("%s: got trigger %q; want %q", tt.ip, trigger, tt.trigger)
+		}
+	}
+}
+
+func TestRPZInvalidNet(t *testing.T) {
+	for _, trigger := range []string{
+		"33.1.2.0.192",  // prefix too long
+		"32.1.2.0.256",  // octet too large
+		"48.zz.zz.2001", // several ::
+	} {
+		zone := "@ 300 SOA localhost. root.localhost. 1 3600 600 86400 300\n" +
+			trigger + ".rpz-ip 300 CNAME .\n"
+		if _, err := ParseRPZ("rpz.example.", "test", strings.NewReader(zone)); err == nil {
+			t.Errorf("%s: no error", trigger)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Rule matches queries for names ending in Domain, without case, on a
+// label boundary: .example.com. matches the names under example.com., and
+// example.com. the name itself too. With Exact, it only matches Domain
+// itself, and with Apex, a Domain with a leading dot also matches the name
+// without it, as NewRule sets for *.example.com.
+// If Clients is not empty, it only matches clients within these networks.
+// If Groups is not empty, it only matches clients of one of these groups.
+// If Schedule is not empty, it only matches during one of its windows.
+type Rule struct {
+	Domain   string
+	Exact    bool
+	Apex     bool
+	Clients  []*net.IPNet
+	Groups   []string
+	Schedule Schedule
+
+	spec string // as parsed by ParseRule
+}
+
+// String returns the rule as parsed, or its domain if it was not.
+func (r *Rule) String() string {
+	if r.spec != "" {
+		return r.spec
+	}
+	return r.Domain
+}
+
+// NewRule returns a rule matching names ending in domain, made fully
+// qualified, and for *.example.com. example.com. and the names under it.
+func NewRule(domain string) *Rule {
+	domain = strings.ToLower(domain)
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	if strings.HasPrefix(domain, "*.") {
+		return &Rule{Domain: domain[1:], Apex: true}
+	}
+	return &Rule{Domain: domain}
+}
+
+// newRouteRule returns the rule of a route for domain, which matches the
+// name itself only unless it starts with a dot (names under it) or a
+// wildcard (the name and names under it), or is the root.
+func newRouteRule(domain string) *Rule {
+	r := NewRule(domain)
+	r.Exact = !strings.HasPrefix(r.Domain, ".")
+	return r
+}
+
+// matchName reports whether the rule matches a name in lower case.
+func (r *Rule) matchName(name string) bool {
+	switch {
+	case r.Exact:
+		return name == r.Domain
+	case strings.HasPrefix(r.Domain, "."):
+		return strings.HasSuffix(name, r.Domain) || r.Apex && name == r.Domain[1:]
+	default:
+		return name == r.Domain || strings.HasSuffix(name, "."+r.Domain)
+	}
+}
+
+// setOptions parses options of the form key=value shared by all rules.
+func (r *Rule) setOptions(opts []string) error {
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid option %q, must be key=value", opt)
+		}
+		switch kv[0] {
+		case "clients":
+			for _, c := range strings.Split(kv[1], "+") {
+				n, err := ParseNet(c)
+				if err != nil {
+					return err
+				}
+				r.Clients = append(r.Clients, n)
+			}
+		case "group":
+			for _, g := range strings.Split(kv[1], "+") {
+				if g == "" {
+					return errors.New("empty group name")
+				}
+				r.Groups = append(r.Groups, g)
+			}
+		case "schedule":
+			s, err := ParseSchedule(kv[1])
+			if err != nil {
+				return err
+			}
+			r.Schedule = s
+		default:
+			return fmt.Errorf("unknown option %q", kv[0])
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule matches a query for name from client at now.
+// Rules restricted to groups do not match, see MatchQuery.
+func (r *Rule) Match(name string, client net.IP, now time.Time) bool {
+	return r.match(name, client, "", now)
+}
+
+// MatchQuery reports whether the rule matches a query.
+func (r *Rule) MatchQuery(q *Query) bool {
+	return r.match(q.Name, q.Client, q.Group, q.Time)
+}
+
+func (r *Rule) match(name string, client net.IP, group string, now time.Time) bool {
+	if !r.matchName(strings.ToLower(name)) {
+		return false
+	}
+	if len(r.Groups) > 0 && !contains(r.Groups, group) {
+		return false
+	}
+	if len(r.Schedule) > 0 && !r.Schedule.Active(now) {
+		return false
+	}
+	if len(r.Clients) == 0 {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+	for _, n := range r.Clients {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRule parses a rule of the form domain[;option=value...], where
+// options are clients=cidr+..., group=name+... and schedule=....
+func ParseRule(s string) (*Rule, error) {
+	opts := strings.Split(s, ";")
+	r := NewRule(opts[0])
+	if err := r.setOptions(opts[1:]); err != nil {
+		return nil, err
+	}
+	r.spec = s
+	return r, nil
+}
+
+// FallbackDefault is the Fallback of routes falling back to the default
+// upstreams.
+const FallbackDefault = "default"
+
+// A Route sends queries matched by its rule to one of its upstreams.
+// If ConsulService is set, the upstreams are meant to be discovered from
+// this Consul service (see Consul.Watch).
+// If SOCKS5 is set, upstreams are reached through this SOCKS5 proxy instead
+// of the one of the proxy, or directly if "direct".
+// If Source is set, queries are sent from this local address instead of
+// the one of the proxy.
+// If Fallback is set, the route is forward-first rather than forward-only:
+// when its upstream fails or answers SERVFAIL, queries are resolved by
+// Recursive, or sent to a default upstream if FallbackDefault.
+// EDNS options are added to the queries sent to its upstreams, e.g. one
+// their software requires, and options of the codes of StripEDNS removed.
+type Route struct {
+	Rule
+	Upstreams     *UpstreamSet
+	ConsulService string
+	SOCKS5        string
+	Source        net.IP
+	Fallback      string
+	EDNS          []*dns.EDNS0_LOCAL
+	StripEDNS     []uint16
+
+	spec    string // as parsed, identifying the route in cache keys
+	catalog string // origin of the Catalog which added it, if any
+}
+
+// String returns the route as parsed, or its domain if it was not.
+func (r *Route) String() string {
+	if r.spec != "" {
+		return r.spec
+	}
+	return r.Domain
+}
+
+// setOptions parses the options specific to routes and those of all rules.
+func (r *Route) setOptions(opts []string) error {
+	var rest []string
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		switch {
+		case len(kv) == 2 && kv[0] == "socks5":
+			if kv[1] != "direct" && !ValidSOCKS5(kv[1]) {
+				return fmt.Errorf("invalid socks5 %q, must be [user:password@]host:port or direct", kv[1])
+			}
+			r.SOCKS5 = kv[1]
+		case len(kv) == 2 && kv[0] == "source":
+			if r.Source = net.ParseIP(kv[1]); r.Source == nil {
+				return fmt.Errorf("invalid source IP %q", kv[1])
+			}
+		case len(kv) == 2 && kv[0] == "fallback":
+			if kv[1] != Recursive && kv[1] != FallbackDefault {
+				return fmt.Errorf("invalid fallback %q, must be %s or %s", kv[1], Recursive, FallbackDefault)
+			}
+			r.Fallback = kv[1]
+		case len(kv) == 2 && kv[0] == "edns":
+			var err error
+			if r.EDNS, err = parseEDNSOptions(kv[1]); err != nil {
+				return err
+			}
+		case len(kv) == 2 && kv[0] == "strip-edns":
+			var err error
+			if r.StripEDNS, err = parseEDNSCodes(kv[1]); err != nil {
+				return err
+			}
+		default:
+			rest = append(rest, opt)
+		}
+	}
+	return r.Rule.setOptions(rest)
+}
+
+// ParseRoute parses a route of the form domain=upstreams[;option=value...],
+// with the same options as ParseRule, socks5=[user:password@]host:port or
+// socks5=direct, source=IP, fallback=recursive|default, edns=code:hex+...
+// and strip-edns=code+.... Upstreams are a + separated list of upstream
+// addresses (see ValidUpstream) picked at random, or consul:service to
+// discover them from Consul, initially empty.
+func ParseRoute(s string) (*Route, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return nil, errors.New("must be domain=host:port")
+	}
+	opts := strings.Split(kv[1], ";")
+	r := &Route{Rule: *newRouteRule(kv[0]), Upstreams: NewUpstreamSet(), spec: s}
+	if strings.HasPrefix(opts[0], "consul:") {
+		r.ConsulService = strings.TrimPrefix(opts[0], "consul:")
+		if r.ConsulService == "" {
+			return nil, errors.New("missing consul service name")
+		}
+	} else {
+		addrs := strings.Split(opts[0], "+")
+		for _, addr := range addrs {
+			if !ValidUpstream(addr) {
+				return nil, fmt.Errorf("invalid upstream %q", addr)
+			}
+		}
+		r.Upstreams.Set(addrs)
+	}
+	if err := r.setOptions(opts[1:]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sortRoutes orders routes so that the most specific match comes first:
+// exact routes first, then longest domain first and, for the same domain,
+// routes restricted to clients, groups or a schedule before unrestricted
+// ones.
+func sortRoutes(routes []*Route) {
+	restricted := func(r *Route) bool {
+		return len(r.Clients) > 0 || len(r.Groups) > 0 || len(r.Schedule) > 0
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Exact != routes[j].Exact {
+			return routes[i].Exact
+		}
+		if len(routes[i].Domain) != len(routes[j].Domain) {
+			return len(routes[i].Domain) > len(routes[j].Domain)
+		}
+		return restricted(routes[i]) && !restricted(routes[j])
+	})
+}
+
+// ValidHostPort reports whether s is of the form host:port.
+func ValidHostPort(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" || port == "" {
+		return false
+	}
+	return true
+}
+
+// ParseNet parses a CIDR, or a single IP as a network of one address.
+func ParseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", s)
+	}
+	return n, nil
+}
+
+// A Schedule is a list of weekly time windows, in local time.
+type Schedule []window
+
+// window is active on days (bit per time.Weekday) between from and to,
+// expressed as durations since midnight. If to is before from, the window
+// wraps past midnight into the next day.
+type window struct {
+	days     uint8
+	from, to time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedule parses a + separated list of windows [days@]HH:MM-HH:MM,
+// where days is a day (Mon) or a range of days (Mon-Fri), e.g.
+// Mon-Fri@09:00-17:00+Sat@10:00-12:00 or 22:00-06:00 for every night.
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	for _, w := range strings.Split(s, "+") {
+		win := window{days: 0x7f}
+		if i := strings.Index(w, "@"); i >= 0 {
+			days, err := parseDays(w[:i])
+			if err != nil {
+				return nil, err
+			}
+			win.days, w = days, w[i+1:]
+		}
+		span := strings.SplitN(w, "-", 2)
+		if len(span) != 2 {
+			return nil, fmt.Errorf("invalid time window %q, must be HH:MM-HH:MM", w)
+		}
+		var err error
+		if win.from, err = parseClock(span[0]); err != nil {
+			return nil, err
+		}
+		if win.to, err = parseClock(span[1]); err != nil {
+			return nil, err
+		}
+		sched = append(sched, win)
+	}
+	return sched, nil
+}
+
+func parseDays(s string) (uint8, error) {
+	span := strings.SplitN(strings.ToLower(s), "-", 2)
+	from, ok := weekdays[span[0]]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %q", span[0])
+	}
+	to := from
+	if len(span) == 2 {
+		if to, ok = weekdays[span[1]]; !ok {
+			return 0, fmt.Errorf("invalid day %q", span[1])
+		}
+	}
+	var days uint8
+	for d := from; ; d = (d + 1) % 7 {
+		days |= 1 << uint(d)
+		if d == to {
+			break
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether now is within one of the windows of the schedule.
+func (s Schedule) Active(now time.Time) bool {
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	today := uint8(1) << uint(now.Weekday())
+	yesterday := uint8(1) << uint((now.Weekday()+6)%7)
+	for _, w := range s {
+		switch {
+		case w.from <= w.to:
+			if w.days&today != 0 && clock >= w.from && clock < w.to {
+				return true
+			}
+		case clock >= w.from:
+			if w.days&today != 0 {
+				return true
+			}
+		case clock < w.to:
+			// Past midnight: the window started the day before.
+			if w.days&yesterday != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
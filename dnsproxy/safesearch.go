@@ -0,0 +1,102 @@
+package dnsproxy
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// safeSearchNames maps the names of search engines and YouTube to the
+// names of their restricted modes, which they document to CNAME to.
+var safeSearchNames = map[string]string{
+	"www.bing.com.":             "strict.bing.com.",
+	"duckduckgo.com.":           "safe.duckduckgo.com.",
+	"www.duckduckgo.com.":       "safe.duckduckgo.com.",
+	"www.youtube.com.":          "restrict.youtube.com.",
+	"m.youtube.com.":            "restrict.youtube.com.",
+	"youtubei.googleapis.com.":  "restrict.youtube.com.",
+	"youtube.googleapis.com.":   "restrict.youtube.com.",
+	"www.youtube-nocookie.com.": "restrict.youtube.com.",
+	"www.google.com.":           "forcesafesearch.google.com.",
+	"google.com.":               "forcesafesearch.google.com.",
+	"yandex.ru.":                "familysearch.yandex.ru.",
+	"www.yandex.ru.":            "familysearch.yandex.ru.",
+	"yandex.com.":               "familysearch.yandex.ru.",
+	"www.yandex.com.":           "familysearch.yandex.ru.",
+	"pixabay.com.":              "safesearch.pixabay.com.",
+	"www.pixabay.com.":          "safesearch.pixabay.com.",
+}
+
+// googleDomain matches the country domains of Google search.
+var googleDomain = regexp.MustCompile(`^(www\.)?google\.([a-z]{2,3}|com?\.[a-z]{2})\.$`)
+
+// safeSearchTarget returns the name of the restricted mode of a search
+// engine name, empty if it has none.
+func safeSearchTarget(name string) string {
+	name = strings.ToLower(name)
+	if to, ok := safeSearchNames[name]; ok {
+		return to
+	}
+	if googleDomain.MatchString(name) {
+		return "forcesafesearch.google.com."
+	}
+	return ""
+}
+
+// safeSearch reports whether the searches of the client of a query are
+// restricted.
+func (p *Proxy) safeSearch(q *Query) bool {
+	for _, g := range p.SafeSearch {
+		if g == "*" || g == q.Group && q.Group != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// safeSearchStage rewrites the queries for search engines to the names
+// of their restricted modes, answering with a CNAME to them.
+func (p *Proxy) safeSearchStage(next Handler) Handler {
+	return func(q *Query) {
+		to := safeSearchTarget(q.Name)
+		if to == "" || !p.safeSearch(q) {
+			next(q)
+			return
+		}
+		p.debugf(q, "safe search rewrites to %s", to)
+		q.W = &cnameWriter{ResponseWriter: q.W, from: q.Name, to: to}
+		q.Req = q.Req.Copy()
+		q.Req.Question[0].Name, q.Name = to, to
+		next(q)
+	}
+}
+
+// cnameWriter answers for the original name of a query rewritten to
+// another name with a CNAME to it, followed by its records.
+type cnameWriter struct {
+	dns.ResponseWriter
+	from, to string // original and rewritten name
+}
+
+func (w *cnameWriter) WriteMsg(m *dns.Msg) error {
+	for i := range m.Question {
+		if strings.EqualFold(m.Question[i].Name, w.to) {
+			m.Question[i].Name = w.from
+		}
+	}
+	if m.Rcode == dns.RcodeSuccess {
+		ttl := uint32(300)
+		for _, rr := range m.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		cname := &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: w.from, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: w.to,
+		}
+		m.Answer = append([]dns.RR{cname}, m.Answer...)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
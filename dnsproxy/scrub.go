@@ -0,0 +1,128 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// scrub removes the records of a response which are out of bailiwick, to
+// limit what a rogue or poisoned upstream can inject in the cache:
+//
+//   - answers must be for the query name or the names it is aliased to by
+//     the CNAME and DNAME records kept,
+//   - authority records must be for zones of these names,
+//   - additional records must be for names the records kept refer to,
+//   - records of a routed query must be within the domain of the route.
+//
+// Signatures are kept along with the records they cover.
+func scrub(m *dns.Msg, qname, domain string) {
+	inDomain := func(name string) bool {
+		return domain == "" || dns.IsSubDomain(domain, name)
+	}
+	names := map[string]bool{strings.ToLower(qname): true}
+	kept := make([]bool, len(m.Answer))
+	// Aliases can come in any order, loop until no more record is kept.
+	for changed := true; changed; {
+		changed = false
+		for i, rr := range m.Answer {
+			if kept[i] {
+				continue
+			}
+			h := rr.Header()
+			owner := strings.ToLower(h.Name)
+			switch rr := rr.(type) {
+			case *dns.DNAME:
+				for n := range names {
+					if dns.IsSubDomain(owner, n) && n != owner {
+						kept[i], changed = true, true
+						names[strings.ToLower(dns.Fqdn(strings.TrimSuffix(n, owner)+rr.Target))] = true
+						break
+					}
+				}
+			case *dns.CNAME:
+				if names[owner] {
+					kept[i], changed = true, true
+					names[strings.ToLower(rr.Target)] = true
+				}
+			default:
+				kept[i] = names[owner]
+			}
+			if !inDomain(owner) {
+				kept[i] = false
+			}
+		}
+	}
+	m.Answer = keep(m.Answer, kept)
+
+	// Zones are the owners of SOA and NS records for one of the names,
+	// DNSSEC records of the authority must be within one of them.
+	zones := make(map[string]bool)
+	kept = make([]bool, len(m.Ns))
+	for i, rr := range m.Ns {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if h.Rrtype != dns.TypeSOA && h.Rrtype != dns.TypeNS || !inDomain(owner) {
+			continue
+		}
+		for n := range names {
+			if dns.IsSubDomain(owner, n) {
+				kept[i], zones[owner] = true, true
+				break
+			}
+		}
+	}
+	for i, rr := range m.Ns {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDS, dns.TypeRRSIG:
+			for z := range zones {
+				if dns.IsSubDomain(z, owner) {
+					kept[i] = true
+					break
+				}
+			}
+		}
+	}
+	m.Ns = keep(m.Ns, kept)
+
+	// Additional records are glue for names referred to by records kept.
+	targets := make(map[string]bool)
+	for _, rr := range append(append([]dns.RR(nil), m.Answer...), m.Ns...) {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			targets[strings.ToLower(rr.Ns)] = true
+		case *dns.MX:
+			targets[strings.ToLower(rr.Mx)] = true
+		case *dns.SRV:
+			targets[strings.ToLower(rr.Target)] = true
+		case *dns.SVCB:
+			targets[strings.ToLower(svcbTarget(rr))] = true
+		case *dns.HTTPS:
+			targets[strings.ToLower(svcbTarget(&rr.SVCB))] = true
+		}
+	}
+	kept = make([]bool, len(m.Extra))
+	for i, rr := range m.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+			kept[i] = true
+		case dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG:
+			kept[i] = targets[owner] && inDomain(owner)
+		}
+	}
+	m.Extra = keep(m.Extra, kept)
+}
+
+// keep returns the records flagged in kept.
+func keep(rrs []dns.RR, kept []bool) []dns.RR {
+	var out []dns.RR
+	for i, rr := range rrs {
+		if kept[i] {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
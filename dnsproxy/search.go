@@ -0,0 +1,58 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// searchStage completes single-label names with the SearchDomains, sending
+// each completed name in turn through the next stages, and answers with the
+// first positive answer: a CNAME from the name to the completed one followed
+// by its records. Queries no domain completes are passed on as they are.
+func (p *Proxy) searchStage(next Handler) Handler {
+	return func(q *Query) {
+		if len(p.SearchDomains) == 0 || dns.CountLabel(q.Name) != 1 {
+			next(q)
+			return
+		}
+		// The names tried see the same configuration.
+		p.config(q)
+		for _, d := range p.SearchDomains {
+			name := q.Name + dns.Fqdn(strings.TrimPrefix(d, "."))
+			p.debugf(q, "search tries %s", name)
+			w := &searchWriter{ResponseWriter: q.W}
+			sq := *q
+			sq.W = w
+			sq.Req = q.Req.Copy()
+			sq.Req.Question[0].Name, sq.Name = name, name
+			next(&sq)
+			if w.msg != nil && w.msg.Rcode == dns.RcodeSuccess && len(w.msg.Answer) > 0 {
+				(&cnameWriter{ResponseWriter: q.W, from: q.Name, to: name}).WriteMsg(w.msg)
+				return
+			}
+		}
+		next(q)
+	}
+}
+
+// searchWriter keeps the response to a query completed with a search
+// domain rather than writing it.
+type searchWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *searchWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *searchWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
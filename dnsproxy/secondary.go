@@ -0,0 +1,450 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// minRefresh bounds how often a secondary zone is checked.
+const minRefresh = 30 * time.Second
+
+// A Secondary mirrors a zone from its primary, as a secondary server does:
+// it transfers the zone (AXFR) when run, then again, incrementally (IXFR)
+// if the primary can, whenever the serial of the primary increases, which
+// it checks at the refresh interval of the SOA and on NOTIFY from the
+// primary. It answers the queries for the zone authoritatively, and its
+// transfers to the clients allowed by the proxy, so that the secondaries
+// behind the proxy do not each cause a transfer from the primary. Create
+// one with NewSecondary, add its Stage to the chain of a proxy and Run it.
+type Secondary struct {
+	// Origin is the name of the zone and Primary the host:port of its
+	// primary server.
+	Origin  string
+	Primary string
+	// Alert is called with an EventRefreshError when the zone cannot be
+	// refreshed, if not nil.
+	Alert func(*Event)
+
+	mu      sync.RWMutex
+	soa     *dns.SOA            // nil until transferred, or once expired
+	records map[string]dns.RR   // by rrKey, the SOA excepted
+	names   map[string][]dns.RR // by owner, empty non-terminals included
+	notify  chan struct{}
+	changed func() // called once the zone is replaced, if not nil
+}
+
+// NewSecondary returns the secondary of a zone transferred from primary.
+func NewSecondary(origin, primary string) *Secondary {
+	return &Secondary{Origin: dns.Fqdn(strings.ToLower(origin)), Primary: primary,
+		notify: make(chan struct{}, 1)}
+}
+
+// Serial returns the serial of the zone, false if it has not been
+// transferred or has expired.
+func (s *Secondary) Serial() (uint32, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.soa == nil {
+		return 0, false
+	}
+	return s.soa.Serial, true
+}
+
+// Stage is the middleware answering the queries for the zone and its
+// transfers, and the NOTIFY of the primary, for the chain of a proxy.
+// Queries are passed on until the zone is transferred.
+func (s *Secondary) Stage(next Handler) Handler {
+	return func(q *Query) {
+		name := strings.ToLower(q.Name)
+		if q.Req.Opcode == dns.OpcodeNotify && name == s.Origin && s.fromPrimary(q) {
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(q.Req)
+			resp.Authoritative = true
+			q.W.WriteMsg(resp)
+			return
+		}
+		if q.Req.Opcode != dns.OpcodeQuery || !dns.IsSubDomain(s.Origin, name) {
+			next(q)
+			return
+		}
+		if _, ok := s.Serial(); !ok {
+			next(q)
+			return
+		}
+		if isTransfer(q.Req) {
+			s.transferOut(q)
+			return
+		}
+		q.W.WriteMsg(s.answer(q.Req))
+	}
+}
+
+// fromPrimary reports whether a query comes from the primary, or from
+// anyone if the primary is given by host name.
+func (s *Secondary) fromPrimary(q *Query) bool {
+	host, _, _ := net.SplitHostPort(s.Primary)
+	ip := net.ParseIP(host)
+	return ip == nil || ip.Equal(q.Client)
+}
+
+// answer answers a query for a name of the zone, as its authoritative
+// server would.
+func (s *Secondary) answer(req *dns.Msg) *dns.Msg {
+	question := req.Question[0]
+	name := strings.ToLower(question.Name)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Names below a delegation are answered with a referral.
+	var ancestors []string
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if name[i:] == s.Origin {
+			break
+		}
+		ancestors = append(ancestors, name[i:])
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		cut := ancestors[i]
+		if cut == name && question.Qtype == dns.TypeDS {
+			break // answered by the parent, the zone
+		}
+		if ns := rrsOfType(s.names[cut], dns.TypeNS); ns != nil {
+			resp.Ns = ns
+			for _, rr := range ns {
+				target := strings.ToLower(rr.(*dns.NS).Ns)
+				resp.Extra = append(resp.Extra, rrsOfType(s.names[target], dns.TypeA)...)
+				resp.Extra = append(resp.Extra, rrsOfType(s.names[target], dns.TypeAAAA)...)
+			}
+			return resp
+		}
+	}
+
+	resp.Authoritative = true
+	for hops := 0; hops < 8; hops++ {
+		rrs, ok := s.lookup(name)
+		if !ok {
+			if len(resp.Answer) == 0 {
+				resp.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+		var answers []dns.RR
+		for _, rr := range rrs {
+			if t := rr.Header().Rrtype; t == question.Qtype || question.Qtype == dns.TypeANY {
+				answers = append(answers, rr)
+			}
+		}
+		if answers != nil {
+			resp.Answer = append(resp.Answer, answers...)
+			break
+		}
+		// Follow CNAMEs within the zone.
+		cname := rrsOfType(rrs, dns.TypeCNAME)
+		if cname == nil {
+			break
+		}
+		resp.Answer = append(resp.Answer, cname...)
+		name = strings.ToLower(cname[0].(*dns.CNAME).Target)
+		if !dns.IsSubDomain(s.Origin, name) {
+			return resp
+		}
+	}
+	if len(resp.Answer) == 0 || resp.Rcode == dns.RcodeNameError {
+		// The SOA of negative answers has their TTL (RFC 2308).
+		soa := dns.Copy(s.soa).(*dns.SOA)
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		resp.Ns = []dns.RR{soa}
+	}
+	return resp
+}
+
+// lookup returns the records of a name of the zone, or of the wildcard of
+// its closest encloser owned by name, false if it does not exist.
+func (s *Secondary) lookup(name string) ([]dns.RR, bool) {
+	if rrs, ok := s.names[name]; ok {
+		return rrs, true
+	}
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if _, ok := s.names[name[i:]]; !ok {
+			continue
+		}
+		wildcard, ok := s.names["*."+name[i:]]
+		if !ok {
+			return nil, false
+		}
+		var rrs []dns.RR
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+// rrsOfType returns the records of a type, nil if none.
+func rrsOfType(rrs []dns.RR, t uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// transferOut sends the zone to a client over TCP, in full even for IXFR
+// unless the client is up to date.
+func (s *Secondary) transferOut(q *Query) {
+	if !overTCP(q) {
+		reply(q.W, q.Req, dns.RcodeRefused)
+		return
+	}
+	s.mu.RLock()
+	soa := s.soa
+	records := make([]dns.RR, 0, len(s.records))
+	for _, rr := range s.records {
+		records = append(records, rr)
+	}
+	s.mu.RUnlock()
+	if q.Req.Question[0].Qtype == dns.TypeIXFR && len(q.Req.Ns) > 0 {
+		if have, ok := q.Req.Ns[0].(*dns.SOA); ok && !serialNewer(soa.Serial, have.Serial) {
+			resp := new(dns.Msg)
+			resp.SetReply(q.Req)
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{soa}
+			q.W.WriteMsg(resp)
+			return
+		}
+	}
+	// Envelopes of at most 100 records, between the SOA.
+	ch := make(chan *dns.Envelope, len(records)/100+3)
+	ch <- &dns.Envelope{RR: []dns.RR{soa}}
+	for i := 0; i < len(records); i += 100 {
+		end := i + 100
+		if end > len(records) {
+			end = len(records)
+		}
+		ch <- &dns.Envelope{RR: records[i:end]}
+	}
+	ch <- &dns.Envelope{RR: []dns.RR{soa}}
+	close(ch)
+	t := new(dns.Transfer)
+	t.Out(q.W, q.Req, ch)
+}
+
+// Run transfers the zone, then keeps it up to date until stop is closed:
+// the serial of the primary is checked at the refresh interval of the SOA,
+// or on NOTIFY, and at its retry interval after a failure. The zone
+// expires, and queries for it are passed on, if it cannot be refreshed for
+// the expire interval of the SOA.
+func (s *Secondary) Run(stop <-chan struct{}) {
+	refreshed := time.Now()
+	for {
+		wait := minRefresh
+		err := s.refresh()
+		s.mu.RLock()
+		soa := s.soa
+		s.mu.RUnlock()
+		switch {
+		case err == nil:
+			refreshed = time.Now()
+			if soa != nil {
+				wait = time.Duration(soa.Refresh) * time.Second
+			}
+		default:
+			if s.Alert != nil {
+				s.Alert(&Event{Time: time.Now(), Kind: EventRefreshError,
+					Message: fmt.Sprintf("cannot refresh zone %s from %s: %v", s.Origin, s.Primary, err)})
+			}
+			if soa != nil {
+				wait = time.Duration(soa.Retry) * time.Second
+				if time.Since(refreshed) > time.Duration(soa.Expire)*time.Second {
+					s.set(nil, nil)
+				}
+			}
+		}
+		if wait < minRefresh {
+			wait = minRefresh
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		case <-s.notify:
+			t.Stop()
+		}
+	}
+}
+
+// refresh transfers the zone if the serial of the primary is newer, or if
+// there is none: incrementally if possible, else in full.
+func (s *Secondary) refresh() error {
+	serial, ok := s.Serial()
+	if !ok {
+		return s.transfer(false)
+	}
+	primary, err := s.primarySerial()
+	if err != nil {
+		return err
+	}
+	if !serialNewer(primary, serial) {
+		return nil
+	}
+	if err := s.transfer(true); err == nil {
+		return nil
+	}
+	return s.transfer(false)
+}
+
+// primarySerial returns the serial of the zone on the primary.
+func (s *Secondary) primarySerial() (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(s.Origin, dns.TypeSOA)
+	c := &dns.Client{Timeout: dialTimeout}
+	resp, _, err := c.Exchange(m, s.Primary)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(m, s.Primary)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA in response (%s)", dns.RcodeToString[resp.Rcode])
+}
+
+// serialNewer reports whether serial a is newer than b, in serial number
+// arithmetic (RFC 1982).
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// transfer transfers the zone from the primary, with IXFR if ixfr.
+func (s *Secondary) transfer(ixfr bool) error {
+	m := new(dns.Msg)
+	if ixfr {
+		s.mu.RLock()
+		soa := s.soa
+		s.mu.RUnlock()
+		m.SetIxfr(s.Origin, soa.Serial, soa.Ns, soa.Mbox)
+	} else {
+		m.SetAxfr(s.Origin)
+	}
+	t := &dns.Transfer{DialTimeout: dialTimeout}
+	envelopes, err := t.In(m, s.Primary)
+	if err != nil {
+		return err
+	}
+	var rrs []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return s.apply(rrs, ixfr)
+}
+
+// apply applies the records of a transfer: the zone between its SOA, or
+// for IXFR the sequences of an old SOA, the records deleted, a new SOA and
+// the records added (RFC 1995), unless the primary sent the zone in full.
+func (s *Secondary) apply(rrs []dns.RR, ixfr bool) error {
+	if len(rrs) == 0 {
+		return errors.New("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("transfer does not start with a SOA")
+	}
+	if len(rrs) == 1 {
+		if ixfr {
+			return nil // up to date
+		}
+		return errors.New("transfer does not end with a SOA")
+	}
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		return errors.New("transfer does not end with a SOA")
+	}
+	records := make(map[string]dns.RR)
+	if ixfr && rrs[1].Header().Rrtype == dns.TypeSOA {
+		s.mu.RLock()
+		for k, rr := range s.records {
+			records[k] = rr
+		}
+		s.mu.RUnlock()
+		adding := true
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			switch {
+			case rr.Header().Rrtype == dns.TypeSOA:
+				adding = !adding
+			case adding:
+				records[rrKey(rr)] = rr
+			default:
+				delete(records, rrKey(rr))
+			}
+		}
+	} else {
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			records[rrKey(rr)] = rr
+		}
+	}
+	s.set(soa, records)
+	return nil
+}
+
+// rrKey returns the key of a record in a zone: its owner, class, type and
+// data, regardless of its TTL.
+func rrKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	rr.Header().Ttl = 0
+	return rr.String()
+}
+
+// set replaces the zone, or expires it if soa is nil.
+func (s *Secondary) set(soa *dns.SOA, records map[string]dns.RR) {
+	names := make(map[string][]dns.RR)
+	for _, rr := range records {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(s.Origin, owner) {
+			continue
+		}
+		names[owner] = append(names[owner], rr)
+		for i, end := dns.NextLabel(owner, 0); !end && dns.IsSubDomain(s.Origin, owner[i:]); i, end = dns.NextLabel(owner, i) {
+			if _, ok := names[owner[i:]]; !ok {
+				names[owner[i:]] = nil
+			}
+		}
+	}
+	if soa != nil {
+		names[s.Origin] = append(names[s.Origin], soa)
+	}
+	s.mu.Lock()
+	s.soa, s.records, s.names = soa, records, names
+	s.mu.Unlock()
+	if s.changed != nil {
+		s.changed()
+	}
+}
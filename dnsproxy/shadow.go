@@ -0,0 +1,38 @@
+package dnsproxy
+
+import (
+	"math/rand"
+
+	"github.com/miekg/dns"
+)
+
+// maxShadowQueries bounds the queries in flight to the shadow upstream, so
+// that a slow one does not pile them up. Queries beyond are not mirrored.
+const maxShadowQueries = 64
+
+// mirror sends a copy of a query to the shadow upstream, if any, for the
+// sample of queries set by ShadowPercent, discarding the response.
+func (p *Proxy) mirror(q *Query) {
+	if p.Shadow == "" || rand.Float64()*100 >= p.ShadowPercent {
+		return
+	}
+	select {
+	case p.shadowing <- struct{}{}:
+	default:
+		return
+	}
+	// The shadow is reached like a default upstream, not through the
+	// SOCKS5 proxy or from the source address of the route.
+	shadow := &Query{W: q.W, Req: q.Req.Copy(), Name: q.Name, Client: q.Client,
+		Dest: q.Dest, Time: q.Time, Upstream: p.Shadow, TraceID: q.TraceID}
+	go func() {
+		defer func() { <-p.shadowing }()
+		resp, err := p.exchange(shadow, shadow.Req)
+		switch {
+		case err != nil:
+			p.logf("shadow %s: [%s] %s: %v", p.Shadow, shadow.TraceID, shadow.Name, err)
+		case resp.Rcode == dns.RcodeServerFailure:
+			p.logf("shadow %s: [%s] %s: SERVFAIL", p.Shadow, shadow.TraceID, shadow.Name)
+		}
+	}()
+}
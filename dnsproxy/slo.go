@@ -0,0 +1,193 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sloShortWindow is the window the burn rate of an SLO must also exceed 1
+// over for it to be violated, so that it is met again soon after the
+// responses are.
+const sloShortWindow = 5 * time.Minute
+
+// An SLO is a service level objective for the responses of a proxy over a
+// sliding Window: Percentile percent of them answered within Latency, or
+// SERVFAIL responses at most ErrorRate of them. Its burn rate is the rate
+// of bad responses over the rate allowed, the error budget: above 1, the
+// budget of the window runs out. An SLO is violated when its burn rate is
+// above 1 over both its Window and the last 5 minutes, once there were
+// enough responses. Create one with ParseSLO.
+type SLO struct {
+	Percentile float64
+	Latency    time.Duration
+	ErrorRate  float64
+	Window     time.Duration
+
+	spec string
+
+	mu       sync.Mutex
+	buckets  []sloBucket // by minute, modulo their number
+	violated bool
+}
+
+// sloBucket counts the responses of a minute.
+type sloBucket struct {
+	minute     int64
+	total, bad uint64
+}
+
+// An SLOStatus is the state of an SLO, as in the Stats.
+type SLOStatus struct {
+	Objective string        `json:"objective"`
+	Window    time.Duration `json:"window"`
+	Responses uint64        `json:"responses"`
+	Bad       uint64        `json:"bad"`
+	// BurnRate is the rate of bad responses over the error budget in the
+	// Window, ShortBurnRate the same in the last 5 minutes.
+	BurnRate      float64 `json:"burn_rate"`
+	ShortBurnRate float64 `json:"short_burn_rate"`
+	Violated      bool    `json:"violated"`
+}
+
+// ParseSLO parses an SLO: p99<50ms for 99% of responses within 50ms, or
+// errors<0.1% for at most 0.1% of SERVFAIL responses, over an hour unless
+// followed by ;window=duration, e.g. p99.9<100ms;window=30m.
+func ParseSLO(s string) (*SLO, error) {
+	opts := strings.Split(s, ";")
+	objective, bound, ok := strings.Cut(opts[0], "<")
+	if !ok {
+		return nil, errors.New("must be pN<latency or errors<N%")
+	}
+	slo := &SLO{Window: time.Hour, spec: s}
+	switch {
+	case objective == "errors":
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(bound, "%"), 64)
+		if err != nil || !strings.HasSuffix(bound, "%") || rate <= 0 || rate >= 100 {
+			return nil, fmt.Errorf("invalid error rate %q, must be a percentage", bound)
+		}
+		slo.ErrorRate = rate / 100
+	case strings.HasPrefix(objective, "p"):
+		var err error
+		slo.Percentile, err = strconv.ParseFloat(objective[1:], 64)
+		if err != nil || slo.Percentile <= 0 || slo.Percentile >= 100 {
+			return nil, fmt.Errorf("invalid percentile %q", objective)
+		}
+		if slo.Latency, err = time.ParseDuration(bound); err != nil || slo.Latency <= 0 {
+			return nil, fmt.Errorf("invalid latency %q", bound)
+		}
+	default:
+		return nil, fmt.Errorf("invalid objective %q, must be pN or errors", objective)
+	}
+	for _, opt := range opts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] != "window" {
+			return nil, fmt.Errorf("invalid option %q", opt)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil || d < sloShortWindow || d > 7*24*time.Hour {
+			return nil, fmt.Errorf("invalid window %q, must be between 5m and 168h", kv[1])
+		}
+		slo.Window = d.Round(time.Minute)
+	}
+	return slo, nil
+}
+
+// String returns the SLO as parsed.
+func (s *SLO) String() string {
+	return s.spec
+}
+
+// budget returns the rate of bad responses the SLO allows.
+func (s *SLO) budget() float64 {
+	if s.ErrorRate > 0 {
+		return s.ErrorRate
+	}
+	return 1 - s.Percentile/100
+}
+
+// observe counts a response and, on the first of a minute, returns the
+// state of the SLO if it became violated or met again, else nil.
+func (s *SLO) observe(d time.Duration, rcode int, now time.Time) (changed *SLOStatus) {
+	bad := rcode == dns.RcodeServerFailure
+	if s.ErrorRate == 0 {
+		bad = d > s.Latency
+	}
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets == nil {
+		n := int(s.Window / time.Minute)
+		if n < 1 {
+			n = 1
+		}
+		s.buckets = make([]sloBucket, n)
+	}
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+		if st := s.status(minute); st.Violated != s.violated {
+			changed, s.violated = st, st.Violated
+		}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+	return changed
+}
+
+// status returns the state of the SLO with its mutex held, over the
+// minutes before minute.
+func (s *SLO) status(minute int64) *SLOStatus {
+	st := &SLOStatus{Objective: s.spec, Window: s.Window}
+	var shortTotal, shortBad uint64
+	for _, b := range s.buckets {
+		if b.minute >= minute || b.minute < minute-int64(len(s.buckets)) {
+			continue
+		}
+		st.Responses += b.total
+		st.Bad += b.bad
+		if b.minute >= minute-int64(sloShortWindow/time.Minute) {
+			shortTotal += b.total
+			shortBad += b.bad
+		}
+	}
+	if st.Responses > 0 {
+		st.BurnRate = float64(st.Bad) / float64(st.Responses) / s.budget()
+	}
+	if shortTotal > 0 {
+		st.ShortBurnRate = float64(shortBad) / float64(shortTotal) / s.budget()
+	}
+	st.Violated = st.Responses >= minErrorRateResponses && st.BurnRate > 1 && st.ShortBurnRate > 1
+	return st
+}
+
+// Status returns the state of the SLO over the last complete minutes.
+func (s *SLO) Status() *SLOStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status(time.Now().Unix() / 60)
+}
+
+// observeSLOs counts a response in the SLOs of the proxy, alerting when one
+// is violated or met again.
+func (p *Proxy) observeSLOs(d time.Duration, rcode int, now time.Time) {
+	for _, s := range p.SLOs {
+		st := s.observe(d, rcode, now)
+		if st == nil {
+			continue
+		}
+		if st.Violated {
+			p.alert(EventSLOViolated, "SLO %s violated: burn rate %.1f over %v, %.1f over %v",
+				s, st.BurnRate, s.Window, st.ShortBurnRate, sloShortWindow)
+		} else {
+			p.alert(EventSLOMet, "SLO %s met again: burn rate %.1f over %v", s, st.BurnRate, s.Window)
+		}
+	}
+}
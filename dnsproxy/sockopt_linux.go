@@ -0,0 +1,16 @@
+package dnsproxy
+
+import "syscall"
+
+// bindToDevice returns a dialer control binding sockets to an interface.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
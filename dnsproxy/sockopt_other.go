@@ -0,0 +1,16 @@
+//go:build !linux
+
+package dnsproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice returns a dialer control binding sockets to an interface,
+// which is only supported on Linux.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to an interface is only supported on Linux")
+	}
+}
@@ -0,0 +1,84 @@
+package dnsproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// specialTTL is the TTL of the loopback addresses of localhost names.
+const specialTTL = 3600
+
+// specialDomain returns the domain a name is in and is answered locally
+// for, empty if none: a special-use domain (RFC 6761 and 7686) with
+// SpecialUse set, or one of PrivateDomains.
+func (p *Proxy) specialDomain(name string) string {
+	if p.SpecialUse {
+		for _, d := range []string{"localhost.", "invalid.", "test.", "onion."} {
+			if dns.IsSubDomain(d, name) {
+				return d
+			}
+		}
+	}
+	for _, d := range p.PrivateDomains {
+		if d = dns.Fqdn(strings.ToLower(strings.TrimPrefix(d, "."))); dns.IsSubDomain(d, name) {
+			return d
+		}
+	}
+	return ""
+}
+
+// specialStage answers the queries for special-use and private domains,
+// unless a route other than the default one (.) matches them, e.g. of .onion
+// to Tor or of .corp to internal servers: localhost names with the loopback
+// addresses (RFC 6761), the others with NXDOMAIN, so that they do not leak
+// to upstreams (RFC 7686). Queries already routed by a policy are passed on.
+// Stages answering names locally, e.g. of secondary zones, containers or
+// mDNS, go before it so that they answer first.
+func (p *Proxy) specialStage(next Handler) Handler {
+	return func(q *Query) {
+		name := strings.ToLower(q.Name)
+		domain := p.specialDomain(name)
+		if q.Upstream != "" || domain == "" {
+			next(q)
+			return
+		}
+		for _, r := range p.config(q).Routes {
+			if r.Domain != "." && r.MatchQuery(q) {
+				next(q)
+				return
+			}
+		}
+		p.debugf(q, "%s answered locally", domain)
+		m := new(dns.Msg)
+		m.SetReply(q.Req)
+		m.Authoritative = true
+		if domain != "localhost." {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, specialSOA(domain))
+			q.W.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: q.Req.Question[0].Name, Class: dns.ClassINET, Ttl: specialTTL}
+		switch q.Req.Question[0].Qtype {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1).To4()})
+		case dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		default:
+			m.Ns = append(m.Ns, specialSOA(domain))
+		}
+		q.W.WriteMsg(m)
+	}
+}
+
+// specialSOA returns the SOA of a domain answered locally, for the negative
+// answers to be cached (RFC 2308).
+func specialSOA(domain string) *dns.SOA {
+	return &dns.SOA{Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: specialTTL},
+		Ns: "localhost.", Mbox: "nobody.invalid.", Serial: 1,
+		Refresh: 3600, Retry: 600, Expire: 86400, Minttl: specialTTL}
+}
@@ -0,0 +1,513 @@
+package dnsproxy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxTrackedNames bounds the names counted for the top names. When full,
+// counts are halved and the names left at zero forgotten, so the names
+// queried most stay on top.
+const maxTrackedNames = 10000
+
+// downAfter is the number of consecutive failures after which an upstream
+// is considered down, until it answers again.
+const downAfter = 5
+
+// minErrorRateResponses is the number of responses in a minute under
+// which the rate of errors is not checked, too small to be meaningful.
+const minErrorRateResponses = 100
+
+// Stats are the counters of the queries of a proxy since it started.
+type Stats struct {
+	Started   time.Time         `json:"started"`
+	Queries   uint64            `json:"queries"`
+	Blocked   uint64            `json:"blocked"`
+	CacheHits uint64            `json:"cache_hits"`
+	Rcodes    map[string]uint64 `json:"rcodes"`
+	// CacheMisses is the number of queries the cache could not answer,
+	// CacheHitRatio the ratio of the queries it answered, and CacheTypes
+	// the same by query type.
+	CacheMisses   uint64                     `json:"cache_misses"`
+	CacheHitRatio float64                    `json:"cache_hit_ratio"`
+	CacheTypes    map[string]*CacheTypeStats `json:"cache_types,omitempty"`
+	// Cache is the state of the cache, if it is a StatsCache.
+	Cache *CacheStats `json:"cache,omitempty"`
+	// QPS is the number of queries per second of the last minute, oldest
+	// first.
+	QPS        []uint64                  `json:"qps"`
+	TopNames   []NameCount               `json:"top_names"`
+	TopBlocked []NameCount               `json:"top_blocked"`
+	Upstreams  map[string]*UpstreamStats `json:"upstreams"`
+	// Overloaded is the number of queries answered OverloadRcode since
+	// too many were in flight, see MaxInFlight and MaxPerUpstream.
+	Overloaded uint64 `json:"overloaded"`
+	// Transfers are the counters of the zone transfers, by client.
+	Transfers map[string]*TransferStats `json:"transfers,omitempty"`
+	// SLOs are the states of the SLOs of the proxy, if any.
+	SLOs []*SLOStatus `json:"slos,omitempty"`
+	// Listeners are the counters of the listeners by transport, e.g.
+	// ListenerUDP, to see which ones clients use.
+	Listeners map[string]*ListenerStats `json:"listeners,omitempty"`
+}
+
+// CacheTypeStats are the counters of the cache for a query type.
+type CacheTypeStats struct {
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// hitRatio returns the ratio of hits, 0 without queries.
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// ListenerStats are the counters of the listeners of a transport.
+type ListenerStats struct {
+	Queries uint64 `json:"queries"`
+	// Connections is the number of connections accepted, Active of those
+	// still open and HandshakeFailures of those whose TLS handshake
+	// failed, none over UDP and HTTP/3.
+	Connections       uint64 `json:"connections,omitempty"`
+	Active            int64  `json:"active,omitempty"`
+	HandshakeFailures uint64 `json:"handshake_failures,omitempty"`
+	// BytesIn and BytesOut are the size of the DNS messages received and
+	// sent, framing, TLS and HTTP left out.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// TransferStats are the counters of the zone transfers of a client.
+type TransferStats struct {
+	// Transfers is the number of transfers completed, Rejected of those
+	// refused beyond MaxTransfers, Aborted of those beyond MaxTransferSize
+	// and Failed of those which failed once started.
+	Transfers uint64 `json:"transfers"`
+	Rejected  uint64 `json:"rejected"`
+	Aborted   uint64 `json:"aborted"`
+	Failed    uint64 `json:"failed"`
+	// Bytes is the size of the records transferred.
+	Bytes uint64 `json:"bytes"`
+}
+
+// transferOutcome is how a transfer ended.
+type transferOutcome int
+
+const (
+	transferDone transferOutcome = iota
+	transferRejected
+	transferAborted
+	transferFailed
+)
+
+// A NameCount is how many times a name was queried, approximately.
+type NameCount struct {
+	Name    string `json:"name"`
+	Unicode string `json:"unicode,omitempty"` // name with U-labels, if it has A-labels
+	Count   uint64 `json:"count"`
+}
+
+// UpstreamStats are the counters of the queries forwarded to an upstream.
+type UpstreamStats struct {
+	Queries  uint64 `json:"queries"`
+	Failures uint64 `json:"failures"`
+	// Latency is the average time of successful exchanges.
+	Latency     time.Duration `json:"latency"`
+	LastError   string        `json:"last_error,omitempty"`
+	LastFailure time.Time     `json:"last_failure,omitempty"`
+	Down        bool          `json:"down"`
+	// Connections is the number of TCP and TLS connections dialed with
+	// UpstreamKeepalive, Reused of the queries sent over idle ones.
+	Connections uint64 `json:"connections,omitempty"`
+	Reused      uint64 `json:"reused,omitempty"`
+
+	total       time.Duration // of successful exchanges
+	consecutive int           // failures
+}
+
+// stats collects the Stats of a proxy.
+type stats struct {
+	mu        sync.Mutex
+	started   time.Time
+	queries   uint64
+	blocked   uint64
+	cacheHits uint64
+	overloads uint64
+	rcodes    map[int]uint64
+	seconds   [60]uint64 // queries by unix second modulo 60
+	last      int64      // unix second of the last query
+	names     map[string]uint64
+	blocks    map[string]uint64
+	upstreams map[string]*UpstreamStats
+	transfers map[string]*TransferStats // by client
+	listeners map[string]*ListenerStats // by transport
+
+	cacheMisses uint64
+	cacheType   map[uint16]*CacheTypeStats // by query type
+
+	// Responses and SERVFAIL responses of the current minute.
+	errStart             time.Time
+	responses, servfails uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		started:   time.Now(),
+		rcodes:    make(map[int]uint64),
+		names:     make(map[string]uint64),
+		blocks:    make(map[string]uint64),
+		upstreams: make(map[string]*UpstreamStats),
+		transfers: make(map[string]*TransferStats),
+		cacheType: make(map[uint16]*CacheTypeStats),
+		listeners: make(map[string]*ListenerStats),
+	}
+}
+
+// tick moves the per second counters to now, clearing the seconds skipped.
+func (s *stats) tick(now int64) {
+	if now <= s.last {
+		return
+	}
+	for t := s.last + 1; t <= now && t <= s.last+60; t++ {
+		s.seconds[t%60] = 0
+	}
+	s.last = now
+}
+
+func (s *stats) query(name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	s.tick(now.Unix())
+	s.seconds[now.Unix()%60]++
+	count(s.names, strings.ToLower(name))
+}
+
+// response counts the rcode of a response and, once a minute, returns
+// the rate of SERVFAIL responses of the last minute, if there were enough.
+func (s *stats) response(rcode int, now time.Time) (rate float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rcodes[rcode]++
+	if now.Sub(s.errStart) >= time.Minute {
+		if s.responses >= minErrorRateResponses {
+			rate, ok = float64(s.servfails)/float64(s.responses), true
+		}
+		s.errStart, s.responses, s.servfails = now, 0, 0
+	}
+	s.responses++
+	if rcode == dns.RcodeServerFailure {
+		s.servfails++
+	}
+	return rate, ok
+}
+
+func (s *stats) block(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked++
+	count(s.blocks, strings.ToLower(name))
+}
+
+// blocked marks a query blocked and counts it, unless it is a dry run.
+func (p *Proxy) blocked(q *Query) {
+	q.Verdict = "block"
+	if !q.DryRun {
+		p.stats.block(q.Name)
+	}
+}
+
+func (s *stats) cacheHit(qtype uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cacheHits++
+	s.cacheTypeStats(qtype).Hits++
+}
+
+func (s *stats) cacheMiss(qtype uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cacheMisses++
+	s.cacheTypeStats(qtype).Misses++
+}
+
+// cacheTypeStats returns the cache counters of a query type, with s.mu
+// held.
+func (s *stats) cacheTypeStats(qtype uint16) *CacheTypeStats {
+	t, ok := s.cacheType[qtype]
+	if !ok {
+		t = &CacheTypeStats{}
+		s.cacheType[qtype] = t
+	}
+	return t
+}
+
+func (s *stats) overload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overloads++
+}
+
+// transfer counts a zone transfer to a client of size bytes.
+func (s *stats) transfer(client string, size int64, outcome transferOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transfers[client]
+	if !ok {
+		t = &TransferStats{}
+		s.transfers[client] = t
+	}
+	t.Bytes += uint64(size)
+	switch outcome {
+	case transferDone:
+		t.Transfers++
+	case transferRejected:
+		t.Rejected++
+	case transferAborted:
+		t.Aborted++
+	case transferFailed:
+		t.Failed++
+	}
+}
+
+// listener returns the counters of the listeners of a transport, with the
+// mutex held.
+func (s *stats) listener(transport string) *ListenerStats {
+	l, ok := s.listeners[transport]
+	if !ok {
+		l = &ListenerStats{}
+		s.listeners[transport] = l
+	}
+	return l
+}
+
+// listenerQuery counts a query over a transport.
+func (s *stats) listenerQuery(transport string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listener(transport).Queries++
+}
+
+// listenerBytes counts the bytes of messages received and sent over a
+// transport.
+func (s *stats) listenerBytes(transport string, in, out int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.listener(transport)
+	l.BytesIn += uint64(in)
+	l.BytesOut += uint64(out)
+}
+
+// listenerConn counts a connection accepted over a transport, or closed if
+// !open.
+func (s *stats) listenerConn(transport string, open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.listener(transport)
+	if open {
+		l.Connections++
+		l.Active++
+	} else {
+		l.Active--
+	}
+}
+
+// handshakeFailure counts a failed TLS handshake over a transport.
+func (s *stats) handshakeFailure(transport string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listener(transport).HandshakeFailures++
+}
+
+// upstreamConn counts a connection dialed to an upstream, or a query sent
+// over an idle one if reused.
+func (s *stats) upstreamConn(upstream string, reused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstreams[upstream]
+	if !ok {
+		u = &UpstreamStats{}
+		s.upstreams[upstream] = u
+	}
+	if reused {
+		u.Reused++
+	} else {
+		u.Connections++
+	}
+}
+
+// exchange counts an exchange with an upstream and reports whether the
+// upstream went down or up again.
+func (s *stats) exchange(upstream string, d time.Duration, err error) (changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstreams[upstream]
+	if !ok {
+		u = &UpstreamStats{}
+		s.upstreams[upstream] = u
+	}
+	u.Queries++
+	if err != nil {
+		u.Failures++
+		u.LastError, u.LastFailure = err.Error(), time.Now()
+		if u.consecutive++; u.consecutive == downAfter {
+			u.Down = true
+			return true
+		}
+		return false
+	}
+	u.total += d
+	u.consecutive = 0
+	if u.Down {
+		u.Down = false
+		return true
+	}
+	return false
+}
+
+// count counts a name, halving all counts when too many names are counted.
+func count(names map[string]uint64, name string) {
+	if _, ok := names[name]; !ok && len(names) >= maxTrackedNames {
+		for n, c := range names {
+			if c /= 2; c == 0 {
+				delete(names, n)
+			} else {
+				names[n] = c
+			}
+		}
+	}
+	names[name]++
+}
+
+// top returns the n names counted most, most first.
+func top(names map[string]uint64, n int) []NameCount {
+	list := make([]NameCount, 0, len(names))
+	for name, c := range names {
+		list = append(list, NameCount{Name: name, Count: c})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	for i := range list {
+		if u := UnicodeName(list[i].Name); u != list[i].Name {
+			list[i].Unicode = u
+		}
+	}
+	return list
+}
+
+func (s *stats) snapshot(now time.Time) *Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick(now.Unix())
+	st := &Stats{
+		Started:    s.started,
+		Queries:    s.queries,
+		Blocked:    s.blocked,
+		CacheHits:  s.cacheHits,
+		Overloaded: s.overloads,
+		Rcodes:     make(map[string]uint64),
+		TopNames:   top(s.names, 10),
+		TopBlocked: top(s.blocks, 10),
+		Upstreams:  make(map[string]*UpstreamStats),
+	}
+	st.CacheMisses, st.CacheHitRatio = s.cacheMisses, hitRatio(s.cacheHits, s.cacheMisses)
+	for rcode, n := range s.rcodes {
+		st.Rcodes[dns.RcodeToString[rcode]] = n
+	}
+	// The current second is not over, it is left out.
+	for t := now.Unix() - 59; t < now.Unix(); t++ {
+		st.QPS = append(st.QPS, s.seconds[t%60])
+	}
+	for addr, u := range s.upstreams {
+		c := *u
+		if succeeded := c.Queries - c.Failures; succeeded > 0 {
+			c.Latency = c.total / time.Duration(succeeded)
+		}
+		st.Upstreams[addr] = &c
+	}
+	if len(s.cacheType) > 0 {
+		st.CacheTypes = make(map[string]*CacheTypeStats)
+		for qtype, t := range s.cacheType {
+			c := *t
+			c.HitRatio = hitRatio(c.Hits, c.Misses)
+			st.CacheTypes[dns.Type(qtype).String()] = &c
+		}
+	}
+	if len(s.listeners) > 0 {
+		st.Listeners = make(map[string]*ListenerStats)
+		for name, l := range s.listeners {
+			c := *l
+			st.Listeners[name] = &c
+		}
+	}
+	if len(s.transfers) > 0 {
+		st.Transfers = make(map[string]*TransferStats)
+		for client, t := range s.transfers {
+			c := *t
+			st.Transfers[client] = &c
+		}
+	}
+	return st
+}
+
+// Stats returns the counters of the queries since the proxy started.
+func (p *Proxy) Stats() *Stats {
+	st := p.stats.snapshot(time.Now())
+	if c, ok := p.Cache.(StatsCache); ok {
+		cs := c.CacheStats()
+		st.Cache = &cs
+	}
+	for _, s := range p.SLOs {
+		st.SLOs = append(st.SLOs, s.Status())
+	}
+	return st
+}
+
+// statsStage counts the queries and the rcodes of their responses.
+func (p *Proxy) statsStage(next Handler) Handler {
+	return func(q *Query) {
+		if q.DryRun {
+			next(q)
+			return
+		}
+		p.stats.query(q.Name, q.Time)
+		p.stats.listenerQuery(transport(q))
+		q.W = &statsWriter{ResponseWriter: q.W, p: p, start: q.Time}
+		if p.tailing() {
+			q.W = &tailWriter{ResponseWriter: q.W, p: p, q: q}
+		}
+		next(q)
+	}
+}
+
+// statsWriter counts the rcodes of the responses to queries.
+type statsWriter struct {
+	dns.ResponseWriter
+	p     *Proxy
+	start time.Time
+}
+
+func (w *statsWriter) WriteMsg(m *dns.Msg) error {
+	now := time.Now()
+	w.p.observeSLOs(now.Sub(w.start), m.Rcode, now)
+	rate, ok := w.p.stats.response(m.Rcode, now)
+	if ok && w.p.MaxErrorRate > 0 && rate > w.p.MaxErrorRate {
+		w.p.alert(EventErrorRate, "%.1f%% of SERVFAIL responses in the last minute", 100*rate)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
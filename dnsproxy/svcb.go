@@ -0,0 +1,115 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// svcbOf returns the SVCB data of an SVCB or HTTPS record, nil for other
+// types.
+func svcbOf(rr dns.RR) *dns.SVCB {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	}
+	return nil
+}
+
+// svcbTarget returns the name the endpoints of an SVCB record are at: its
+// target, or its owner if the target is "." in service mode (RFC 9460).
+func svcbTarget(s *dns.SVCB) string {
+	if s.Target == "." && s.Priority != 0 {
+		return s.Hdr.Name
+	}
+	return s.Target
+}
+
+// parseSVCBKeys parses a list of SvcParam keys separated by commas, by
+// name (ech, ipv6hint...) or as keyNNNNN.
+func parseSVCBKeys(s string) ([]dns.SVCBKey, error) {
+	var keys []dns.SVCBKey
+	for _, name := range splitList(s) {
+		key, ok := svcbKey(strings.ToLower(name))
+		if !ok || key == dns.SVCB_MANDATORY {
+			return nil, fmt.Errorf("invalid SvcParam key %q", name)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no SvcParam keys")
+	}
+	return keys, nil
+}
+
+func svcbKey(name string) (dns.SVCBKey, bool) {
+	for k := dns.SVCB_MANDATORY; k <= dns.SVCB_OHTTP; k++ {
+		if k.String() == name {
+			return k, true
+		}
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(name, "key"), 10, 16); err == nil && strings.HasPrefix(name, "key") {
+		return dns.SVCBKey(n), true
+	}
+	return 0, false
+}
+
+// svcbStripWriter removes SvcParams from the SVCB and HTTPS records of
+// responses, e.g. ech so that the names of TLS connections stay visible to
+// filtering, or ipv6hint on networks without IPv6. It is set after the
+// cache, which keeps the records of upstreams whole.
+type svcbStripWriter struct {
+	dns.ResponseWriter
+	keys []dns.SVCBKey
+}
+
+func (w *svcbStripWriter) WriteMsg(m *dns.Msg) error {
+	m.Answer = stripSVCB(m.Answer, w.keys)
+	m.Extra = stripSVCB(m.Extra, w.keys)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// stripSVCB returns records with keys removed from the SVCB and HTTPS
+// ones, copied not to change cached records. A record requiring one of
+// the keys in its mandatory parameter is removed, clients could not use
+// it without.
+func stripSVCB(rrs []dns.RR, keys []dns.SVCBKey) []dns.RR {
+	strip := func(key dns.SVCBKey) bool {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+	var out []dns.RR
+	for _, rr := range rrs {
+		if svcbOf(rr) == nil {
+			out = append(out, rr)
+			continue
+		}
+		rr = dns.Copy(rr)
+		s := svcbOf(rr)
+		var values []dns.SVCBKeyValue
+		usable := true
+		for _, v := range s.Value {
+			if m, ok := v.(*dns.SVCBMandatory); ok {
+				for _, k := range m.Code {
+					usable = usable && !strip(k)
+				}
+			}
+			if !strip(v.Key()) {
+				values = append(values, v)
+			}
+		}
+		if usable {
+			s.Value = values
+			out = append(out, rr)
+		}
+	}
+	return out
+}
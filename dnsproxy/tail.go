@@ -0,0 +1,99 @@
+package dnsproxy
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// tailBuffer is the number of queries buffered for each tail, beyond which
+// queries are dropped until the reader catches up.
+const tailBuffer = 256
+
+// A TailFilter selects the queries of a tail.
+type TailFilter struct {
+	// Client, if not nil, is the network of the clients.
+	Client *net.IPNet
+	// Name, if not empty, is a pattern of the names (see path.Match), e.g.
+	// "*.example.com.", matched without case.
+	Name string
+	// Rcode, if not negative, is the rcode of the responses.
+	Rcode int
+}
+
+func (f *TailFilter) match(e *QueryLogEntry, client net.IP, rcode int) bool {
+	if f.Client != nil && (client == nil || !f.Client.Contains(client)) {
+		return false
+	}
+	if f.Name != "" {
+		if ok, _ := path.Match(strings.ToLower(f.Name), strings.ToLower(e.Name)); !ok {
+			return false
+		}
+	}
+	return f.Rcode < 0 || f.Rcode == rcode
+}
+
+// tail is a reader of the queries answered.
+type tail struct {
+	filter TailFilter
+	c      chan *QueryLogEntry
+}
+
+// Tail returns the queries answered from now on which match a filter, as
+// they are answered, until stop is called. Queries the reader is too slow
+// for are dropped rather than slowing down the proxy.
+func (p *Proxy) Tail(f TailFilter) (queries <-chan *QueryLogEntry, stop func()) {
+	t := &tail{filter: f, c: make(chan *QueryLogEntry, tailBuffer)}
+	p.tailMu.Lock()
+	if p.tails == nil {
+		p.tails = make(map[*tail]struct{})
+	}
+	p.tails[t] = struct{}{}
+	p.tailMu.Unlock()
+	return t.c, func() {
+		p.tailMu.Lock()
+		defer p.tailMu.Unlock()
+		delete(p.tails, t)
+	}
+}
+
+// tailing reports whether any query is tailed.
+func (p *Proxy) tailing() bool {
+	p.tailMu.Lock()
+	defer p.tailMu.Unlock()
+	return len(p.tails) > 0
+}
+
+// tailWriter sends the responses to a query to the tails.
+type tailWriter struct {
+	dns.ResponseWriter
+	p *Proxy
+	q *Query
+}
+
+func (w *tailWriter) WriteMsg(m *dns.Msg) error {
+	q := w.q
+	client := q.Client
+	var e *QueryLogEntry
+	if l := w.p.QueryLog; l != nil {
+		// Tails are anonymized and redacted as the query log is.
+		client = l.truncate(client)
+		e = l.redact(newQueryLogEntry(q, m, l.client(q.Client)))
+	} else {
+		e = newQueryLogEntry(q, m, client.String())
+	}
+	w.p.tailMu.Lock()
+	for t := range w.p.tails {
+		if !t.filter.match(e, client, m.Rcode) {
+			continue
+		}
+		select {
+		case t.c <- e:
+		default:
+		}
+	}
+	w.p.tailMu.Unlock()
+	return w.ResponseWriter.WriteMsg(m)
+}
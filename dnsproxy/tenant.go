@@ -0,0 +1,237 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// A Tenant is a listener, or a path of the DNS over HTTPS server, with its
+// own routes, blocks, default upstreams, policy and transfer ACL, to serve
+// several tenants from one process.
+type Tenant struct {
+	Name          string
+	Address       string // empty to serve DoHPath only
+	AllowTransfer []string
+	// DoHPath is the URL path of the tenant on the DoH server, if any,
+	// restricted to DoHUsers (name to password) if not empty.
+	DoHPath  string
+	DoHUsers map[string]string
+	// Routes, Blocks, Default and Policy are nil if not set, the defaults
+	// of New then apply.
+	Routes  []*Route
+	Blocks  []*Rule
+	Default []string
+	Policy  Policy
+}
+
+// LoadTenants reads tenants from a file of sections, one per tenant, of
+// key = value lines, keys being repeatable and values lists:
+//
+//	[a]
+//	address = :5301
+//	route = .example.com.=10.0.0.1:53,.corp.=10.0.0.2:53
+//	block = ads.example.com.
+//	default = 10.0.0.53:53
+//	allow-transfer = 10.0.0.8,10.1.0.0/24
+//	policy = /etc/dns-reverse-proxy/a.policy
+//	doh-path = /dns-query/a
+//	doh-auth = alice:secret,bob:secret
+//
+// Empty lines and lines starting with # are ignored.
+func LoadTenants(path string) ([]*Tenant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTenants(path, f)
+}
+
+// readTenants reads tenants, naming errors after the file name.
+func readTenants(name string, in io.Reader) ([]*Tenant, error) {
+	var tenants []*Tenant
+	var data map[string]string // of the current tenant
+	seen := make(map[string]bool)
+	done := func() error {
+		if len(tenants) == 0 {
+			return nil
+		}
+		return tenants[len(tenants)-1].set(data)
+	}
+	s := bufio.NewScanner(in)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := done(); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			t := &Tenant{Name: strings.TrimSpace(line[1 : len(line)-1])}
+			if t.Name == "" || seen[t.Name] {
+				return nil, fmt.Errorf("%s:%d: invalid or duplicate tenant %q", name, n, t.Name)
+			}
+			seen[t.Name] = true
+			tenants = append(tenants, t)
+			data = make(map[string]string)
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || data == nil {
+			return nil, fmt.Errorf("%s:%d: expected [tenant] or key = value", name, n)
+		}
+		key := strings.TrimSpace(kv[0])
+		if _, ok := data[key]; ok {
+			data[key] += ","
+		}
+		data[key] += strings.TrimSpace(kv[1])
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := done(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return tenants, nil
+}
+
+// set sets the fields of a tenant from the values of its section.
+func (t *Tenant) set(data map[string]string) error {
+	t.Address, t.DoHPath = data["address"], data["doh-path"]
+	if t.Address == "" && t.DoHPath == "" {
+		return fmt.Errorf("tenant %s: no address or doh-path", t.Name)
+	}
+	if t.DoHPath != "" && !strings.HasPrefix(t.DoHPath, "/") {
+		return fmt.Errorf("tenant %s: invalid doh-path %q", t.Name, t.DoHPath)
+	}
+	t.AllowTransfer = splitList(data["allow-transfer"])
+	for _, s := range t.AllowTransfer {
+		if !ValidAllowTransfer(s) {
+			return fmt.Errorf("tenant %s: invalid allow-transfer %q", t.Name, s)
+		}
+	}
+	for _, e := range splitList(data["doh-auth"]) {
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("tenant %s: invalid doh-auth, must be user:password", t.Name)
+		}
+		if t.DoHUsers == nil {
+			t.DoHUsers = make(map[string]string)
+		}
+		t.DoHUsers[kv[0]] = kv[1]
+	}
+	kube := make(map[string]string)
+	for key, value := range data {
+		switch key {
+		case "address", "allow-transfer", "doh-path", "doh-auth":
+		case "route":
+			t.Routes = []*Route{}
+			for _, e := range splitList(value) {
+				r, err := ParseRoute(e)
+				if err == nil && r.ConsulService != "" {
+					err = errors.New("consul upstreams are not supported for tenants")
+				}
+				if err != nil {
+					return fmt.Errorf("tenant %s: route %q: %v", t.Name, e, err)
+				}
+				t.Routes = append(t.Routes, r)
+			}
+		case "block":
+			kube["blocks"] = value
+		case "default":
+			kube["default"] = value
+		case "policy":
+			policy, err := LoadPolicy(value)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %v", t.Name, err)
+			}
+			if policy == nil {
+				policy = Policy{}
+			}
+			t.Policy = policy
+		default:
+			return fmt.Errorf("tenant %s: unknown key %q", t.Name, key)
+		}
+	}
+	// Blocks and default upstreams are parsed as in a ConfigMap.
+	c, err := parseKubeConfig(kube)
+	if err != nil {
+		return fmt.Errorf("tenant %s: %v", t.Name, err)
+	}
+	t.Blocks, t.Default = c.Blocks, c.Default
+	return nil
+}
+
+// Apply sets the routes, blocks, default upstreams, policy and transfer
+// ACL of a tenant on a proxy, which must listen to its address.
+func (t *Tenant) Apply(p *Proxy) {
+	p.AllowTransfer = t.AllowTransfer
+	p.Update(func(s *Snapshot) {
+		if t.Routes != nil {
+			s.Routes = append([]*Route(nil), t.Routes...)
+		}
+		if t.Blocks != nil {
+			s.Blocks = append([]*Rule(nil), t.Blocks...)
+		}
+		if t.Default != nil {
+			s.Default = append([]string(nil), t.Default...)
+		}
+		if t.Policy != nil {
+			s.Policy = t.Policy
+		}
+	})
+}
+
+// NewTenant returns a proxy for a tenant, listening to its address only,
+// with the settings of p, its exported fields, and those of the tenant
+// applied. Those of the state of p are not shared: its Default, History,
+// QueryLog and SLOs are those of New, and its Cache a new one of the same
+// kind, for tenants with different upstreams not to share responses.
+func (p *Proxy) NewTenant(t *Tenant) *Proxy {
+	tp := New(t.Address)
+	// Fields added later are cloned too, unless listed below.
+	src, dst := reflect.ValueOf(p).Elem(), reflect.ValueOf(tp).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	tp.Address, tp.TLSAddress, tp.TLSConfig = t.Address, "", nil
+	tp.Default, tp.History, tp.QueryLog, tp.SLOs = PublicServers, nil, nil, nil
+	switch c := p.Cache.(type) {
+	case *MemoryCache:
+		tp.Cache = NewMemoryCache(c.MaxSize)
+	case *RedisCache:
+		rc := NewRedisCache(c.Addr)
+		rc.Password, rc.DB, rc.Timeout = c.Password, c.DB, c.Timeout
+		rc.Prefix = c.Prefix + t.Name + ":"
+		tp.Cache = rc
+	}
+	t.Apply(tp)
+	return tp
+}
+
+// StartTenants returns a proxy for each tenant, see NewTenant, started if
+// the tenant has an address, and resolving the host names of its upstreams
+// (see WatchHosts).
+func (p *Proxy) StartTenants(tenants []*Tenant) ([]*Proxy, error) {
+	var proxies []*Proxy
+	for _, t := range tenants {
+		tp := p.NewTenant(t)
+		go tp.WatchHosts(nil)
+		proxies = append(proxies, tp)
+		if t.Address == "" {
+			continue
+		}
+		if err := tp.Start(); err != nil {
+			return proxies, fmt.Errorf("tenant %s: %v", t.Name, err)
+		}
+	}
+	return proxies, nil
+}
@@ -0,0 +1,132 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// transparent is a listener control for TPROXY: the socket accepts traffic
+// for any destination and, with SO_REUSEADDR, can share its port with the
+// sockets sending replies from original destinations.
+func transparent(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		s := int(fd)
+		if err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		// Set IPv4 and IPv6 options, dual-stack sockets need both.
+		err4 := unix.SetsockoptInt(s, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		err6 := unix.SetsockoptInt(s, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		if err4 != nil && err6 != nil {
+			err = err4
+			return
+		}
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			err4 = unix.SetsockoptInt(s, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			err6 = unix.SetsockoptInt(s, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			if err4 != nil && err6 != nil {
+				err = err4
+			}
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// listenTransparent listens to TCP and UDP in TPROXY mode.
+func listenTransparent(address string) (net.PacketConn, net.Listener, error) {
+	lc := &net.ListenConfig{Control: transparent}
+	pc, err := listenPacket(lc, "udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := listenStream(lc, "tcp", address)
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return &tproxyPacketConn{UDPConn: pc.(*net.UDPConn)}, l, nil
+}
+
+// tproxyPacketConn receives datagrams intercepted by TPROXY and replies
+// from their original destination. Accepted TCP connections need no such
+// care, their local address is the original destination.
+type tproxyPacketConn struct {
+	*net.UDPConn
+}
+
+// tproxyAddr is the address of a client whose query was intercepted.
+type tproxyAddr struct {
+	client *net.UDPAddr
+	dest   *net.UDPAddr // original destination
+}
+
+func (a *tproxyAddr) Network() string { return "udp" }
+func (a *tproxyAddr) String() string  { return a.client.String() }
+
+// OrigDst returns the original destination of the query.
+func (a *tproxyAddr) OrigDst() net.Addr { return a.dest }
+
+func (c *tproxyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, addr, err := c.ReadMsgUDP(b, oob)
+		if err != nil {
+			return n, addr, err
+		}
+		dest, err := origDst(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		return n, &tproxyAddr{client: addr, dest: dest}, nil
+	}
+}
+
+func (c *tproxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*tproxyAddr)
+	if !ok {
+		return c.UDPConn.WriteTo(b, addr)
+	}
+	// Reply from a socket bound to the original destination, which is not
+	// a local address, so that the client accepts the reply.
+	lc := &net.ListenConfig{Control: transparent}
+	pc, err := lc.ListenPacket(context.Background(), "udp", a.dest.String())
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+	return pc.WriteTo(b, a.client)
+}
+
+// origDst returns the original destination from the control messages of
+// a datagram.
+func origDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// struct sockaddr_in
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// struct sockaddr_in6
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errors.New("no original destination")
+}
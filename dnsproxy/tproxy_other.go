@@ -0,0 +1,14 @@
+//go:build !linux
+
+package dnsproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// listenTransparent listens to TCP and UDP in TPROXY mode, which is only
+// supported on Linux.
+func listenTransparent(address string) (net.PacketConn, net.Listener, error) {
+	return nil, nil, errors.New("dnsproxy: transparent mode is only supported on Linux")
+}
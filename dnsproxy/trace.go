@@ -0,0 +1,76 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// A Trace is the outcome of a query sent through the stages of a proxy in
+// dry run by Trace.
+type Trace struct {
+	// Steps are the decisions of the stages about the query, as logged
+	// with Debug, rewrites included.
+	Steps []string
+	// Cache is "hit" if the query was answered from the cache, "miss" if
+	// not, or empty if it did not get to the cache.
+	Cache string
+	// Upstream is the upstream the query would be forwarded to, and Route
+	// the route it matched, if any.
+	Upstream string
+	Route    *Route
+	// Response is the response of the stage which answered the query, nil
+	// if it would be forwarded or was dropped.
+	Response *dns.Msg
+}
+
+func (t *Trace) stepf(format string, v ...interface{}) {
+	t.Steps = append(t.Steps, fmt.Sprintf(format, v...))
+}
+
+// Trace sends a query from client through the stages of the proxy in dry
+// run (see Query.DryRun) and returns the decisions taken about it. The query
+// is neither forwarded nor counted, nor cached.
+func (p *Proxy) Trace(req *dns.Msg, client net.IP) *Trace {
+	w := &traceWriter{trace: new(Trace), remote: &net.UDPAddr{IP: client}}
+	w.local, _ = net.ResolveUDPAddr("udp", p.Address)
+	p.ServeDNS(w, req)
+	return w.trace
+}
+
+// traceWriter is the dns.ResponseWriter of a query traced, keeping the
+// response of the stage answering it.
+type traceWriter struct {
+	trace  *Trace
+	local  *net.UDPAddr
+	remote *net.UDPAddr
+}
+
+func (w *traceWriter) LocalAddr() net.Addr {
+	if w.local == nil {
+		return &net.UDPAddr{}
+	}
+	return w.local
+}
+
+func (w *traceWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *traceWriter) WriteMsg(m *dns.Msg) error {
+	w.trace.Response = m.Copy()
+	return nil
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.trace.Response = m
+	return len(b), nil
+}
+
+func (w *traceWriter) Close() error        { return nil }
+func (w *traceWriter) TsigStatus() error   { return nil }
+func (w *traceWriter) TsigTimersOnly(bool) {}
+func (w *traceWriter) Hijack()             {}
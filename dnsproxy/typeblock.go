@@ -0,0 +1,103 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Actions of type blocks.
+const (
+	TypeBlockRefuse = "refuse" // REFUSED
+	TypeBlockNoData = "nodata" // NOERROR without records
+	TypeBlockDrop   = "drop"   // no answer
+)
+
+// A TypeBlock blocks the queries matched by its rule for some types, e.g.
+// ANY everywhere or TXT in a sensitive zone, answering as set by Action.
+type TypeBlock struct {
+	Rule
+	Types  []uint16
+	Action string
+
+	spec string // as parsed
+}
+
+// String returns the type block as parsed.
+func (b *TypeBlock) String() string { return b.spec }
+
+// ParseTypeBlock parses a type block of the form domain=type+...[;option=...],
+// with the same options as ParseRule and action=refuse|nodata|drop, refuse
+// if not given, e.g. .=ANY or .corp.=TXT;action=nodata.
+func ParseTypeBlock(s string) (*TypeBlock, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return nil, errors.New("must be domain=type+...")
+	}
+	opts := strings.Split(kv[1], ";")
+	b := &TypeBlock{Rule: *NewRule(kv[0]), Action: TypeBlockRefuse}
+	for _, t := range strings.Split(opts[0], "+") {
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", t)
+		}
+		b.Types = append(b.Types, qtype)
+	}
+	var rest []string
+	for _, opt := range opts[1:] {
+		if !strings.HasPrefix(opt, "action=") {
+			rest = append(rest, opt)
+			continue
+		}
+		switch b.Action = strings.TrimPrefix(opt, "action="); b.Action {
+		case TypeBlockRefuse, TypeBlockNoData, TypeBlockDrop:
+		default:
+			return nil, fmt.Errorf("invalid action %q, must be %s, %s or %s", b.Action, TypeBlockRefuse, TypeBlockNoData, TypeBlockDrop)
+		}
+	}
+	if err := b.setOptions(rest); err != nil {
+		return nil, err
+	}
+	b.spec = s
+	return b, nil
+}
+
+// MatchQuery reports whether the type block matches a query.
+func (b *TypeBlock) MatchQuery(q *Query) bool {
+	qtype := q.Req.Question[0].Qtype
+	for _, t := range b.Types {
+		if t == qtype {
+			return b.Rule.MatchQuery(q)
+		}
+	}
+	return false
+}
+
+// TypeBlocks returns the type blocks.
+func (p *Proxy) TypeBlocks() []*TypeBlock {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*TypeBlock(nil), p.typeBlocks...)
+}
+
+// SetTypeBlocks replaces all type blocks, the first matching a query
+// applying.
+func (p *Proxy) SetTypeBlocks(blocks []*TypeBlock) {
+	blocks = append([]*TypeBlock(nil), blocks...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.typeBlocks = blocks
+}
+
+// blockType answers a query blocked by a type block as set by its action.
+func blockType(q *Query, b *TypeBlock) {
+	switch b.Action {
+	case TypeBlockDrop:
+	case TypeBlockNoData:
+		reply(q.W, q.Req, dns.RcodeSuccess)
+	default:
+		reply(q.W, q.Req, dns.RcodeRefused)
+	}
+}
@@ -0,0 +1,237 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyName is the name of the pipe an upgraded process tells its parent it
+// is ready on, among the files it inherits.
+const readyName = "dnsproxy-ready"
+
+// handoff holds the sockets of the process: those inherited from systemd
+// (socket activation) or from the process upgraded, not yet listened to,
+// and those listened to, handed to the new process on upgrade.
+var handoff struct {
+	sync.Mutex
+	once      sync.Once
+	listeners []net.Listener
+	conns     []net.PacketConn
+	ready     *os.File
+	upgraded  bool
+	listening []interface{ File() (*os.File, error) }
+}
+
+// inherit takes the sockets passed by systemd or the process upgraded, as
+// in sd_listen_fds: LISTEN_FDS files from descriptor 3, named by
+// LISTEN_FDNAMES, if LISTEN_PID is not set (upgrade) or is the process.
+func inherit() {
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid := os.Getenv("LISTEN_PID"); n <= 0 || pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		if i < len(names) && names[i] == readyName {
+			handoff.ready, handoff.upgraded = f, true
+			continue
+		}
+		if l, err := net.FileListener(f); err == nil {
+			handoff.listeners = append(handoff.listeners, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			handoff.conns = append(handoff.conns, pc)
+		}
+		f.Close()
+	}
+}
+
+// sameAddr reports whether an address is the one to listen to on network,
+// e.g. [::]:53 for :53 on tcp.
+func sameAddr(a net.Addr, network, address string) bool {
+	if !strings.HasPrefix(network, a.Network()) {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ahost, aport, err := net.SplitHostPort(a.String())
+	if err != nil || port != aport {
+		return false
+	}
+	ip, aip := net.ParseIP(host), net.ParseIP(ahost)
+	if host == "" || ip != nil && ip.IsUnspecified() {
+		return aip != nil && aip.IsUnspecified()
+	}
+	return ip != nil && ip.Equal(aip)
+}
+
+// Listen is like net.Listen, but takes the listener of address if the
+// process inherited it, and hands it on upgrade.
+func Listen(network, address string) (net.Listener, error) {
+	return listenStream(&net.ListenConfig{}, network, address)
+}
+
+// ListenPacket is like net.ListenPacket, but takes the socket of address if
+// the process inherited it, and hands it on upgrade.
+func ListenPacket(network, address string) (net.PacketConn, error) {
+	return listenPacket(&net.ListenConfig{}, network, address)
+}
+
+func listenStream(lc *net.ListenConfig, network, address string) (net.Listener, error) {
+	handoff.once.Do(inherit)
+	handoff.Lock()
+	defer handoff.Unlock()
+	for i, l := range handoff.listeners {
+		if sameAddr(l.Addr(), network, address) {
+			handoff.listeners = append(handoff.listeners[:i], handoff.listeners[i+1:]...)
+			handoff.listening = append(handoff.listening, l.(interface{ File() (*os.File, error) }))
+			return l, nil
+		}
+	}
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := l.(interface{ File() (*os.File, error) }); ok {
+		handoff.listening = append(handoff.listening, f)
+	}
+	return l, nil
+}
+
+func listenPacket(lc *net.ListenConfig, network, address string) (net.PacketConn, error) {
+	handoff.once.Do(inherit)
+	handoff.Lock()
+	defer handoff.Unlock()
+	for i, pc := range handoff.conns {
+		if sameAddr(pc.LocalAddr(), network, address) {
+			handoff.conns = append(handoff.conns[:i], handoff.conns[i+1:]...)
+			handoff.listening = append(handoff.listening, pc.(interface{ File() (*os.File, error) }))
+			return pc, nil
+		}
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := pc.(interface{ File() (*os.File, error) }); ok {
+		handoff.listening = append(handoff.listening, f)
+	}
+	return pc, nil
+}
+
+// Ready closes the inherited sockets not listened to, no longer in the
+// configuration, and, in a process started by Upgrade, tells its parent it
+// is ready to serve. Call it once all the listeners are started.
+func Ready() error {
+	handoff.once.Do(inherit)
+	handoff.Lock()
+	defer handoff.Unlock()
+	for _, l := range handoff.listeners {
+		l.Close()
+	}
+	for _, pc := range handoff.conns {
+		pc.Close()
+	}
+	handoff.listeners, handoff.conns = nil, nil
+	if handoff.ready == nil {
+		return nil
+	}
+	defer func() { handoff.ready = nil }()
+	defer handoff.ready.Close()
+	_, err := handoff.ready.Write([]byte{1})
+	return err
+}
+
+// Upgraded reports whether the process was started by Upgrade, to take over
+// from its parent, e.g. appending to the files it still writes to rather
+// than truncating them.
+func Upgraded() bool {
+	handoff.once.Do(inherit)
+	handoff.Lock()
+	defer handoff.Unlock()
+	return handoff.upgraded
+}
+
+// Upgrade starts the executable of the process again, e.g. once replaced by
+// a new version, with the same arguments and the sockets listened to, and
+// returns once it is ready (see Ready), within timeout. The caller should
+// then stop its proxies, which finish the queries in flight while the new
+// process answers the next ones on the same sockets, so that none is
+// refused or lost. On error, the new process is killed.
+func Upgrade(timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	handoff.Lock()
+	var files []*os.File
+	for _, l := range handoff.listening {
+		// Sockets closed since, e.g. of stopped tenants, fail.
+		if f, err := l.File(); err == nil {
+			files = append(files, f)
+		}
+	}
+	handoff.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	names := make([]string, len(files), len(files)+1)
+	for i := range names {
+		names[i] = "listener"
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "LISTEN_") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("LISTEN_FDS=%d", len(cmd.ExtraFiles)),
+		"LISTEN_FDNAMES="+strings.Join(append(names, readyName), ":"))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	ready := make(chan error, 1)
+	go func() {
+		// The pipe is closed without a byte if the process exits early.
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			ready <- errors.New("new process exited before ready")
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("new process not ready in time")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Process.Release()
+}
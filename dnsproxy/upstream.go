@@ -0,0 +1,42 @@
+package dnsproxy
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// An UpstreamSet is a set of upstreams (host:port) which can be updated live.
+type UpstreamSet struct {
+	mu    sync.RWMutex
+	addrs []string
+}
+
+// NewUpstreamSet returns a set of upstreams.
+func NewUpstreamSet(addrs ...string) *UpstreamSet {
+	return &UpstreamSet{addrs: addrs}
+}
+
+// Addrs returns the upstreams of the set.
+func (s *UpstreamSet) Addrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.addrs...)
+}
+
+// Set replaces the upstreams of the set.
+func (s *UpstreamSet) Set(addrs []string) {
+	addrs = append([]string(nil), addrs...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs = addrs
+}
+
+// Pick returns one of the upstreams at random, or empty if there are none.
+func (s *UpstreamSet) Pick() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.addrs) == 0 {
+		return ""
+	}
+	return s.addrs[rand.Intn(len(s.addrs))]
+}
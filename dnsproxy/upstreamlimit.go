@@ -0,0 +1,71 @@
+package dnsproxy
+
+import "math/rand"
+
+// upstreamLimit returns the maximum number of queries in flight to an
+// upstream, 0 for no limit.
+func (p *Proxy) upstreamLimit(upstream string) int {
+	if n, ok := p.UpstreamLimits[upstream]; ok {
+		return n
+	}
+	return p.MaxPerUpstream
+}
+
+// acquireUpstream takes a slot of the upstream of a query or, if it is
+// saturated, of another upstream of its route or of the defaults, which
+// then becomes the upstream of the query. It reports whether it got one,
+// to be given back with releaseUpstream.
+func (p *Proxy) acquireUpstream(q *Query) bool {
+	if p.MaxPerUpstream <= 0 && len(p.UpstreamLimits) == 0 {
+		return true
+	}
+	if p.tryUpstream(q.Upstream) {
+		return true
+	}
+	var others []string
+	switch {
+	case q.Route != nil:
+		others = q.Route.Upstreams.Addrs()
+	case p.isDefault(q):
+		others = append(others, p.config(q).Default...)
+	}
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	for _, u := range others {
+		if u != q.Upstream && p.tryUpstream(u) {
+			p.debugf(q, "upstream %s saturated, spilling over to %s", q.Upstream, u)
+			q.Upstream = u
+			return true
+		}
+	}
+	return false
+}
+
+// tryUpstream takes a slot of an upstream if it has one left.
+func (p *Proxy) tryUpstream(upstream string) bool {
+	limit := p.upstreamLimit(upstream)
+	if limit <= 0 {
+		return true
+	}
+	p.upstreamMu.Lock()
+	defer p.upstreamMu.Unlock()
+	if p.upstreamInFlight[upstream] >= limit {
+		return false
+	}
+	if p.upstreamInFlight == nil {
+		p.upstreamInFlight = make(map[string]int)
+	}
+	p.upstreamInFlight[upstream]++
+	return true
+}
+
+// releaseUpstream gives back a slot taken by acquireUpstream.
+func (p *Proxy) releaseUpstream(upstream string) {
+	if p.upstreamLimit(upstream) <= 0 {
+		return
+	}
+	p.upstreamMu.Lock()
+	defer p.upstreamMu.Unlock()
+	if p.upstreamInFlight[upstream]--; p.upstreamInFlight[upstream] <= 0 {
+		delete(p.upstreamInFlight, upstream)
+	}
+}
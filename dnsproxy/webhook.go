@@ -0,0 +1,95 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Kinds of events.
+const (
+	EventUpstreamDown = "upstream_down"
+	EventUpstreamUp   = "upstream_up"
+	EventErrorRate    = "error_rate"
+	EventDetection    = "detection"
+	EventRefreshError = "refresh_error"
+	EventReport       = "report"
+	EventFlood        = "flood"
+	EventBan          = "ban"
+	EventSLOViolated  = "slo_violated"
+	EventSLOMet       = "slo_met"
+)
+
+// An Event is something worth alerting about, e.g. an upstream down.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	// Report is the report of a report event.
+	Report *Report `json:"report,omitempty"`
+}
+
+// A Webhook posts events to a URL, as JSON or as Slack messages.
+type Webhook struct {
+	URL string
+	// Slack posts {"text": "..."}, which Slack and compatible chats such
+	// as Mattermost accept, instead of the Event.
+	Slack bool
+	// Client to post with, a client with a 10s timeout if nil.
+	Client *http.Client
+}
+
+// Send posts an event.
+func (w *Webhook) Send(e *Event) error {
+	var v interface{} = e
+	if w.Slack {
+		text := fmt.Sprintf("dns-reverse-proxy %s: %s", e.Kind, e.Message)
+		if e.Report != nil {
+			text += "\n```" + e.Report.String() + "```"
+		}
+		v = map[string]string{"text": text}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// alert sends an event to the Alert function of the proxy, if any.
+func (p *Proxy) alert(kind, format string, v ...interface{}) {
+	if p.Alert == nil {
+		return
+	}
+	go p.Alert(&Event{Time: time.Now(), Kind: kind, Message: fmt.Sprintf(format, v...)})
+}
+
+// Alerter returns a function logging events and posting them to webhooks,
+// in the background, for the Alert of a proxy.
+func Alerter(hooks []*Webhook) func(*Event) {
+	return func(e *Event) {
+		log.Printf("%s: %s", e.Kind, e.Message)
+		for _, h := range hooks {
+			go func(h *Webhook) {
+				if err := h.Send(e); err != nil {
+					log.Printf("cannot send %s event to webhook: %v", e.Kind, err)
+				}
+			}(h)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges changes the root directory to dir if not empty, then
+// switches to the user of spec, user or user:group by name or ID, if not
+// empty, with the primary group of the user unless given. It is called once
+// listening, so that ports below 1024 can be bound as root.
+func dropPrivileges(spec, dir string) error {
+	var uid, gid int
+	if spec != "" {
+		name, group, _ := strings.Cut(spec, ":")
+		u, err := lookupUser(name)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("user %s has no numeric ID", name)
+		}
+		if group == "" {
+			group = u.Gid
+		}
+		if gid, err = lookupGroup(group); err != nil {
+			return err
+		}
+	}
+	// Users and groups are looked up before, /etc may not be in dir.
+	if dir != "" {
+		if err := syscall.Chroot(dir); err != nil {
+			return fmt.Errorf("chroot %s: %v", dir, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	// A process started on upgrade already runs as the user.
+	if spec == "" || os.Geteuid() == uid && os.Getegid() == gid {
+		return nil
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %v", uid, err)
+	}
+	return nil
+}
+
+// lookupUser looks up a user by name, else by ID.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, nerr := strconv.Atoi(name); nerr == nil {
+			return user.LookupId(name)
+		}
+	}
+	return u, err
+}
+
+// lookupGroup returns the ID of a group given by name or ID.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on Windows, run the service as a less
+// privileged account instead.
+func dropPrivileges(spec, dir string) error {
+	if spec == "" && dir == "" {
+		return nil
+	}
+	return errors.New("-user and -chroot are not supported on Windows")
+}
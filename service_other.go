@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// service manages the Windows service, only on Windows.
+func service(args []string) {
+	fmt.Fprintln(os.Stderr, "services are only supported on Windows, use the init script or systemd")
+	os.Exit(2)
+}
+
+// startService does nothing: only Windows has services.
+func startService(stop chan<- os.Signal) (stopped func()) {
+	return func() {}
+}
@@ -0,0 +1,170 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service and of its event source.
+const serviceName = "dns-reverse-proxy"
+
+// service manages the Windows service:
+//
+//	service install [flags]  installs it to run with flags, started at boot
+//	service uninstall
+//	service start
+//	service stop
+func service(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s service install [flags] | uninstall | start | stop\n", os.Args[0])
+		os.Exit(2)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalf("cannot connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exe, err = filepath.Abs(exe); err != nil {
+			log.Fatal(err)
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "DNS reverse proxy",
+			Description: "Routes DNS queries to DNS servers.",
+			StartType:   mgr.StartAutomatic,
+		}, args[1:]...)
+		if err != nil {
+			log.Fatalf("cannot install service: %v", err)
+		}
+		defer s.Close()
+		err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+		if err != nil {
+			s.Delete()
+			log.Fatalf("cannot install event source: %v", err)
+		}
+		fmt.Printf("installed service %s: %s %s\n", serviceName, exe, strings.Join(args[1:], " "))
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			log.Fatalf("cannot open service: %v", err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			log.Fatalf("cannot uninstall service: %v", err)
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			log.Printf("cannot remove event source: %v", err)
+		}
+	case "start":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			log.Fatalf("cannot open service: %v", err)
+		}
+		defer s.Close()
+		if err := s.Start(); err != nil {
+			log.Fatalf("cannot start service: %v", err)
+		}
+	case "stop":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			log.Fatalf("cannot open service: %v", err)
+		}
+		defer s.Close()
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			log.Fatalf("cannot stop service: %v", err)
+		}
+		// Wait for the proxy to save its cache and close its files.
+		for deadline := time.Now().Add(30 * time.Second); status.State != svc.Stopped; {
+			if time.Now().After(deadline) {
+				log.Fatal("service still stopping after 30s")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				log.Fatalf("cannot query service: %v", err)
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown service command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// startService reports to the service manager that the proxy runs, if it
+// was started as a Windows service, and sends stop requests to stop as a
+// signal, logging to the event log. The returned function reports that the
+// proxy stopped, once it has shut down.
+func startService(stop chan<- os.Signal) (stopped func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}
+	}
+	if l, err := eventlog.Open(serviceName); err == nil {
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{l})
+	}
+	h := &serviceHandler{stop: stop, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		if err := svc.Run(serviceName, h); err != nil {
+			log.Printf("service: %v", err)
+		}
+		close(done)
+	}()
+	return func() {
+		close(h.stopped)
+		<-done
+	}
+}
+
+// serviceHandler is the svc.Handler of the proxy.
+type serviceHandler struct {
+	stop    chan<- os.Signal
+	stopped chan struct{} // closed once shut down
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.stop <- os.Interrupt
+				<-h.stopped
+				return false, 0
+			}
+		case <-h.stopped:
+			// Stopped by itself, e.g. on a fatal error.
+			return false, 0
+		}
+	}
+}
+
+// eventLogWriter is a log output writing to the event log.
+type eventLogWriter struct {
+	l *eventlog.Log
+}
+
+func (w eventLogWriter) Write(b []byte) (int, error) {
+	return len(b), w.l.Info(1, strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// upgradeTimeout is how long the new process has to start on upgrade.
+const upgradeTimeout = 30 * time.Second
+
+// notifyUpgrade relays SIGUSR2, to start the executable again (e.g. once
+// replaced by a new version) with the listeners, and drain.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
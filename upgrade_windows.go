@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// upgradeTimeout is how long the new process has to start on upgrade.
+const upgradeTimeout = 30 * time.Second
+
+// notifyUpgrade does nothing: Windows has no SIGUSR2 and cannot hand
+// listeners to a new process.
+func notifyUpgrade(c chan<- os.Signal) {}